@@ -0,0 +1,180 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/petereps/gomirror/pkg/mirror"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+)
+
+// configFlags maps config paths to the flags that set them
+var configFlags = map[string]string{
+	"file":                      "file",
+	"port":                      "port",
+	"mode":                      "mode",
+	"h2c":                       "h2c",
+	"log-level":                 "log-level",
+	"tls.cert-file":             "tls-cert-file",
+	"tls.key-file":              "tls-key-file",
+	"mirror.url":                "mirror-url",
+	"mirror.headers":            "mirror-headers",
+	"primary.url":               "primary-url",
+	"primary.headers":           "primary-headers",
+	"primary.do-mirror-headers": "do-mirror-headers",
+	"primary.do-mirror-body":    "do-mirror-body",
+}
+
+// configEnv maps config paths to the environment variables, other than the
+// GOMIRROR_ ones, that set them
+var configEnv = map[string]string{
+	"file": "FILE",
+}
+
+func bindings(flags *pflag.FlagSet) mirror.Bindings {
+	b := mirror.Bindings{
+		Flags: make(map[string]*pflag.Flag),
+		Env:   configEnv,
+	}
+
+	for path, name := range configFlags {
+		if flag := flags.Lookup(name); flag != nil {
+			b.Flags[path] = flag
+		}
+	}
+
+	return b
+}
+
+func yamlScalar(value interface{}) string {
+	if d, ok := value.(time.Duration); ok {
+		// yaml would print the nanoseconds
+		return d.String()
+	}
+
+	out, err := yaml.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// writeYAML writes the described values as a yaml document, with the
+// source of every value in a comment
+func writeYAML(w io.Writer, values []mirror.DescribedValue) {
+	open := []string{}
+
+	for _, value := range values {
+		keys := strings.Split(value.Path, ".")
+		parents := keys[:len(keys)-1]
+
+		// close the sections that don't apply to this value
+		common := 0
+		for common < len(open) && common < len(parents) && open[common] == parents[common] {
+			common++
+		}
+		open = open[:common]
+
+		for _, parent := range parents[common:] {
+			fmt.Fprintf(w, "%s%s:\n", strings.Repeat("  ", len(open)), parent)
+			open = append(open, parent)
+		}
+
+		indent := strings.Repeat("  ", len(open))
+		comment := "# " + value.Source
+		if value.Note != "" {
+			comment += " (" + value.Note + ")"
+		}
+
+		key := keys[len(keys)-1]
+		switch v := value.Value.(type) {
+		case []map[string]string:
+			if len(v) == 0 {
+				fmt.Fprintf(w, "%s%s: [] %s\n", indent, key, comment)
+				continue
+			}
+			fmt.Fprintf(w, "%s%s: %s\n", indent, key, comment)
+			for _, header := range v {
+				fmt.Fprintf(w, "%s  - key: %s\n", indent, yamlScalar(header["key"]))
+				fmt.Fprintf(w, "%s    value: %s\n", indent, yamlScalar(header["value"]))
+			}
+		case []string:
+			if len(v) == 0 {
+				fmt.Fprintf(w, "%s%s: [] %s\n", indent, key, comment)
+				continue
+			}
+			fmt.Fprintf(w, "%s%s: %s\n", indent, key, comment)
+			for _, item := range v {
+				fmt.Fprintf(w, "%s  - %s\n", indent, yamlScalar(item))
+			}
+		default:
+			out := yamlScalar(v)
+			if !strings.Contains(out, "\n") {
+				fmt.Fprintf(w, "%s%s: %s %s\n", indent, key, out, comment)
+				continue
+			}
+
+			// lists of structs, eg mirror.diff.compare
+			fmt.Fprintf(w, "%s%s: %s\n", indent, key, comment)
+			for _, line := range strings.Split(out, "\n") {
+				fmt.Fprintf(w, "%s  %s\n", indent, line)
+			}
+		}
+	}
+}
+
+// configCmd groups the config subcommands
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the gomirror config",
+}
+
+// configPrintCmd prints the effective config
+var configPrintCmd = &cobra.Command{
+	Use:   "print",
+	Short: "Print the effective config, and where each value was set",
+	Long: `Prints the config after merging flags, environment variables, etcd, the
+config file and defaults. Every value is annotated with its source, and
+secrets are masked.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, err := loadConfig(cmd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error loading config: %s\n", err)
+			os.Exit(1)
+		}
+
+		values, err := cfg.Describe(bindings(cmd.Flags()))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error describing config: %s\n", err)
+			os.Exit(1)
+		}
+
+		output, _ := cmd.Flags().GetString("output")
+		switch output {
+		case "yaml":
+			writeYAML(os.Stdout, values)
+		case "json":
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			encoder.Encode(values)
+		default:
+			fmt.Fprintf(os.Stderr, "unknown output %q, expected yaml or json\n", output)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	configPrintCmd.Flags().
+		StringP("output", "o", "yaml", "Output format, either yaml or json")
+
+	configCmd.AddCommand(configPrintCmd)
+	rootCmd.AddCommand(configCmd)
+}
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/petereps/gomirror/pkg/report"
+
+	"github.com/spf13/cobra"
+)
+
+// outcomeLogs returns the outcome log of the config and its rotated
+// backups
+func outcomeLogs(cmd *cobra.Command) ([]string, error) {
+	cfg, err := loadConfig(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("error loading config: %s", err)
+	}
+
+	path := cfg.Mirror.OutcomeLog
+	if path == "" {
+		return nil, errors.New("no outcome logs given, and mirror.outcome-log isn't set")
+	}
+
+	backups, err := filepath.Glob(path + ".[0-9]*")
+	if err != nil {
+		return nil, err
+	}
+	return append(backups, path), nil
+}
+
+// reportCmd summarizes outcome logs
+var reportCmd = &cobra.Command{
+	Use:   "report [outcome-log...]",
+	Short: "Compare the primary and mirror responses recorded in outcome logs",
+	Long: `Summarizes the outcome logs written with mirror.outcome-log, comparing the
+latency percentiles, status codes, response bodies and error rates of the
+primary and mirror per route. Without arguments the outcome log of the
+config, and its rotated backups, is read, eg:
+
+  gomirror report -f config.yaml -o html > report.html`,
+	Run: func(cmd *cobra.Command, args []string) {
+		paths := args
+		if len(paths) == 0 {
+			var err error
+			if paths, err = outcomeLogs(cmd); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+
+		r, err := report.ReadFiles(paths...)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading outcome logs: %s\n", err)
+			os.Exit(1)
+		}
+
+		output, _ := cmd.Flags().GetString("output")
+		switch output {
+		case "text":
+			err = report.WriteText(os.Stdout, r)
+		case "json":
+			err = report.WriteJSON(os.Stdout, r)
+		case "html":
+			err = report.WriteHTML(os.Stdout, r)
+		default:
+			fmt.Fprintf(os.Stderr, "unknown output %q, expected text, json or html\n", output)
+			os.Exit(1)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error writing report: %s\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	reportCmd.Flags().
+		StringP("output", "o", "text", "Output format, either text, json or html")
+
+	rootCmd.AddCommand(reportCmd)
+}
@@ -16,6 +16,7 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -33,20 +34,19 @@ var rootCmd = &cobra.Command{
 	Short: "Mirror http requests to a different backend for testing or logging",
 	Long:  ``,
 	Run: func(cmd *cobra.Command, args []string) {
-		opts := []mirror.Option{}
-
-		cfgFile := os.Getenv("FILE")
-		if cfgFile == "" {
-			cfgFile, _ = cmd.PersistentFlags().GetString("file")
+		cfg, err := loadConfig(cmd)
+		if err != nil {
+			panic(err)
 		}
 
-		if cfgFile != "" {
-			opts = append(opts, mirror.WithConfigFile(cfgFile))
+		if err := cfg.Validate(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
 
-		cfg, err := mirror.InitConfig(opts...)
-		if err != nil {
-			panic(err)
+		if err := cfg.SetupLogging(); err != nil {
+			fmt.Fprintf(os.Stderr, "error opening log file: %s\n", err)
+			os.Exit(1)
 		}
 
 		mirrorProxy, err := mirror.New(cfg)
@@ -54,11 +54,40 @@ var rootCmd = &cobra.Command{
 			panic(err)
 		}
 
+		if viper.GetString("etcd-prefix") != "" {
+			go cfg.Watch(context.Background(), func(next *mirror.Config) {
+				if err := mirrorProxy.UpdateConfig(next); err != nil {
+					log.Printf("error applying config from etcd: %s", err)
+				}
+			})
+		}
+
 		fmt.Printf("Serving on port %d\n", cfg.Port)
 		log.Fatal(mirrorProxy.Serve(fmt.Sprintf(":%d", cfg.Port)))
 	},
 }
 
+// loadConfig loads the config from the --file flag, GOMIRROR_FILE or FILE
+// env vars and etcd. Environment variables and flags override the config
+func loadConfig(cmd *cobra.Command) (*mirror.Config, error) {
+	opts := []mirror.Option{}
+
+	cfgFile := viper.GetString("file")
+	if cfgFile == "" {
+		cfgFile = os.Getenv("FILE")
+	}
+
+	if cfgFile != "" {
+		opts = append(opts, mirror.WithConfigFile(cfgFile))
+	}
+
+	if prefix := viper.GetString("etcd-prefix"); prefix != "" {
+		opts = append(opts, mirror.WithEtcd(viper.GetStringSlice("etcd-endpoints"), prefix))
+	}
+
+	return mirror.InitConfig(opts...)
+}
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
@@ -74,6 +103,12 @@ func init() {
 	rootCmd.PersistentFlags().
 		StringP("file", "f", "", "Specify a filepath to load config from")
 
+	rootCmd.PersistentFlags().
+		StringSlice("etcd-endpoints", []string{"127.0.0.1:2379"}, "etcd endpoints to load config from when --etcd-prefix is set")
+
+	rootCmd.PersistentFlags().
+		String("etcd-prefix", "", "Load config from the keys under this etcd prefix, and apply changes live")
+
 	rootCmd.PersistentFlags().
 		StringP("mirror-url", "m", "", "Upstream server to mirror incoming requests to (wont effect the primary servers request)")
 
@@ -83,6 +118,18 @@ func init() {
 	rootCmd.PersistentFlags().
 		IntP("port", "P", 0, "port to serve the mirror on")
 
+	rootCmd.PersistentFlags().
+		String("tls-cert-file", "", "Certificate file to serve TLS with (TLS is enabled when both --tls-cert-file and --tls-key-file are set)")
+
+	rootCmd.PersistentFlags().
+		String("tls-key-file", "", "Private key file to serve TLS with")
+
+	rootCmd.PersistentFlags().
+		String("mode", "http", "Either http, or tcp to mirror raw tcp connections (urls are then in the form tcp://host:port)")
+
+	rootCmd.PersistentFlags().
+		Bool("h2c", false, "Accept cleartext HTTP/2 (h2c) connections, eg for grpc clients")
+
 	rootCmd.PersistentFlags().
 		Bool("do-mirror-headers", true, "Directive to mirror all incoming headers to the mirrored server")
 
@@ -90,15 +137,20 @@ func init() {
 		Bool("do-mirror-body", true, "Directive to mirror request body to mirrored server (small performance hit)")
 
 	rootCmd.PersistentFlags().
-		StringArray("mirror-headers", []string{}, "Headers to add to the mirrored request. in the form of --mirror-headers header=value --mirror-headers header2=value2...")
+		StringArray("mirror-headers", []string{}, "Headers to add to the mirrored request. in the form of --mirror-headers header=value --mirror-headers header2=value2... (merged with the config file headers)")
 
 	rootCmd.PersistentFlags().
-		StringArray("primary-headers", []string{}, "Headers to add to the primary request. in the form of --primary-headers header=value --primary-headers header2=value2...")
+		StringArray("primary-headers", []string{}, "Headers to add to the primary request. in the form of --primary-headers header=value --primary-headers header2=value2... (merged with the config file headers)")
 
 	viper.BindPFlags(rootCmd.PersistentFlags())
+	viper.BindEnv("file", mirror.EnvName("file"))
+	viper.BindEnv("etcd-prefix", mirror.EnvName("etcd-prefix"))
+	viper.BindEnv("etcd-endpoints", mirror.EnvName("etcd-endpoints"))
 	viper.BindPFlag("mirror.url", rootCmd.PersistentFlags().Lookup("mirror-url"))
 	viper.BindPFlag("primary.url", rootCmd.PersistentFlags().Lookup("primary-url"))
 	viper.BindPFlag("primary.do-mirror-headers", rootCmd.PersistentFlags().Lookup("do-mirror-headers"))
 	viper.BindPFlag("primary.do-mirror-body", rootCmd.PersistentFlags().Lookup("do-mirror-body"))
+	viper.BindPFlag("tls.cert-file", rootCmd.PersistentFlags().Lookup("tls-cert-file"))
+	viper.BindPFlag("tls.key-file", rootCmd.PersistentFlags().Lookup("tls-key-file"))
 
 }
@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/petereps/gomirror/pkg/mirror"
+
+	"github.com/spf13/cobra"
+)
+
+// validateCmd checks a config without serving it
+var validateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Validate the config, exiting non-zero when it has problems",
+	Long: `Loads the config the same way as serving would and reports every problem
+found, eg:
+
+  gomirror validate -f config.yaml`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, err := loadConfig(cmd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error loading config: %s\n", err)
+			os.Exit(1)
+		}
+
+		if err := cfg.Validate(); err != nil {
+			if validationErr, ok := err.(mirror.ValidationError); ok {
+				for _, fieldErr := range validationErr {
+					fmt.Fprintln(os.Stderr, fieldErr)
+				}
+			} else {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			os.Exit(1)
+		}
+
+		fmt.Println("config is valid")
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(validateCmd)
+}
@@ -0,0 +1,151 @@
+package discovery
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Strategies used to pick an endpoint when several serve a name
+const (
+	// RoundRobin picks the endpoints in turn, the default
+	RoundRobin = "round-robin"
+	// Random picks a random endpoint
+	Random = "random"
+)
+
+// Balancer picks among the endpoints of a Resolver
+type Balancer struct {
+	resolver Resolver
+	strategy string
+	log      logrus.FieldLogger
+	// next is the round robin position, updated atomically
+	next uint32
+}
+
+// NewBalancer returns a Balancer picking endpoints from resolver with
+// strategy, either RoundRobin or Random. It logs to log, or the standard
+// logrus logger when it is nil
+func NewBalancer(resolver Resolver, strategy string, log logrus.FieldLogger) *Balancer {
+	return &Balancer{resolver: resolver, strategy: strategy, log: logger(log)}
+}
+
+// Pick returns one of the endpoints for name, ok is false when there are
+// none
+func (b *Balancer) Pick(name string) (endpoint Endpoint, ok bool) {
+	endpoints := b.resolver.Resolve(name)
+	if len(endpoints) == 0 {
+		return Endpoint{}, false
+	}
+
+	var i int
+	switch b.strategy {
+	case Random:
+		i = rand.Intn(len(endpoints))
+	default:
+		i = int((atomic.AddUint32(&b.next, 1) - 1) % uint32(len(endpoints)))
+	}
+
+	return endpoints[i], true
+}
+
+// address replaces the host of address with a picked endpoint. An endpoint
+// port wins over the port of address, which is the port of the name
+func (b *Balancer) address(host, port string) string {
+	endpoint, ok := b.Pick(host)
+	if !ok {
+		b.log.Errorf("no endpoints found for host %s. Defering to system dns", host)
+		endpoint = Endpoint{Host: host}
+	}
+
+	if endpoint.Port != "" {
+		port = endpoint.Port
+	}
+
+	if port == "" {
+		return endpoint.Host
+	}
+	return net.JoinHostPort(endpoint.Host, port)
+}
+
+// DialContext dials address, replacing its host with an endpoint picked
+// for every new connection. Hosts without endpoints are dialed as is,
+// using the system dns. Connections are reused for several requests, use
+// Transport to pick an endpoint for every request
+func (b *Balancer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	return (&net.Dialer{}).DialContext(ctx, network, b.address(host, port))
+}
+
+// Transport sends every request to an endpoint picked by Balancer, the
+// way ReverseProxy does, with Next. The Host header is kept
+type Transport struct {
+	Balancer *Balancer
+	Next     http.RoundTripper
+}
+
+// Transport returns a Transport picking an endpoint for every request sent
+// with next
+func (b *Balancer) Transport(next http.RoundTripper) *Transport {
+	return &Transport{Balancer: b, Next: next}
+}
+
+// RoundTrip sends req to an endpoint of its host
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	picked := req.Clone(req.Context())
+	if picked.Host == "" {
+		picked.Host = req.URL.Host
+	}
+	picked.URL.Host = t.Balancer.address(req.URL.Hostname(), req.URL.Port())
+	return t.Next.RoundTrip(picked)
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// ReverseProxy will return a httputil.ReverseProxy that picks an endpoint
+// for every request instead of the systems dns call
+func (b *Balancer) ReverseProxy(target *url.URL) *httputil.ReverseProxy {
+	targetQuery := target.RawQuery
+
+	director := func(req *http.Request) {
+		req.URL.Scheme = target.Scheme
+		req.URL.Host = b.address(target.Hostname(), target.Port())
+
+		req.URL.Path = singleJoiningSlash(target.Path, req.URL.Path)
+		if targetQuery == "" || req.URL.RawQuery == "" {
+			req.URL.RawQuery = targetQuery + req.URL.RawQuery
+		} else {
+			req.URL.RawQuery = targetQuery + "&" + req.URL.RawQuery
+		}
+
+		if _, ok := req.Header["User-Agent"]; !ok {
+			// explicitly disable User-Agent so it's not set to default value
+			req.Header.Set("User-Agent", "")
+		}
+
+	}
+
+	return &httputil.ReverseProxy{Director: director}
+}
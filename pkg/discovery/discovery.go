@@ -0,0 +1,169 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Endpoint is an address serving a name
+type Endpoint struct {
+	// Host is an ip address or a host name
+	Host string
+	// Port is empty when the endpoint doesn't declare one, the port of the
+	// requested address is used instead
+	Port string
+}
+
+func (e Endpoint) String() string {
+	if e.Port == "" {
+		return e.Host
+	}
+	return net.JoinHostPort(e.Host, e.Port)
+}
+
+// ParseEndpoint parses an endpoint in the form host:port or host
+func ParseEndpoint(s string) (Endpoint, error) {
+	if s == "" {
+		return Endpoint{}, fmt.Errorf("empty endpoint")
+	}
+
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		// no port
+		if _, _, err := net.SplitHostPort(s + ":0"); err != nil {
+			return Endpoint{}, fmt.Errorf("invalid endpoint %q", s)
+		}
+		return Endpoint{Host: s}, nil
+	}
+
+	if host == "" {
+		return Endpoint{}, fmt.Errorf("invalid endpoint %q, missing host", s)
+	}
+	return Endpoint{Host: host, Port: port}, nil
+}
+
+// Resolver finds the endpoints serving a name, eg the host of a url
+type Resolver interface {
+	// Resolve returns the current endpoints for name, it is empty when none
+	// are known
+	Resolve(name string) []Endpoint
+	// Watch sends the endpoints for name, starting with the current ones
+	// and then whenever they change, until ctx is done. Slow readers only
+	// get the latest endpoints
+	Watch(ctx context.Context, name string) <-chan []Endpoint
+	// Close stops the resolver refreshing its endpoints
+	Close()
+}
+
+// Watchers keeps the watch channels of a Resolver
+type Watchers struct {
+	mux   sync.Mutex
+	chans map[string][]chan []Endpoint
+	last  map[string][]Endpoint
+}
+
+// init makes the maps of w, w.mux must be held
+func (w *Watchers) init() {
+	if w.last == nil {
+		w.chans = make(map[string][]chan []Endpoint)
+		w.last = make(map[string][]Endpoint)
+	}
+}
+
+// Watch returns a channel that is sent the endpoints for name, starting
+// with current, whenever Notify is called with different endpoints. It is
+// closed when ctx is done
+func (w *Watchers) Watch(ctx context.Context, name string, current []Endpoint) <-chan []Endpoint {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	w.init()
+
+	c := make(chan []Endpoint, 1)
+	c <- current
+	w.chans[name] = append(w.chans[name], c)
+	if _, ok := w.last[name]; !ok {
+		w.last[name] = current
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		w.mux.Lock()
+		defer w.mux.Unlock()
+
+		chans := w.chans[name]
+		for i := range chans {
+			if chans[i] == c {
+				w.chans[name] = append(chans[:i], chans[i+1:]...)
+				break
+			}
+		}
+		close(c)
+	}()
+
+	return c
+}
+
+// Notify sends endpoints to the watchers of name, if they changed
+func (w *Watchers) Notify(name string, endpoints []Endpoint) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	w.init()
+
+	if last, ok := w.last[name]; ok && reflect.DeepEqual(last, endpoints) {
+		return
+	}
+	w.last[name] = endpoints
+
+	for _, c := range w.chans[name] {
+		// replace an update the watcher hasn't read yet
+		select {
+		case <-c:
+		default:
+		}
+		c <- endpoints
+	}
+}
+
+// forget drops the last endpoints sent for name, unless it is watched,
+// and reports whether it did
+func (w *Watchers) forget(name string) bool {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if len(w.chans[name]) > 0 {
+		return false
+	}
+	delete(w.chans, name)
+	delete(w.last, name)
+	return true
+}
+
+// Names returns the names that are watched
+func (w *Watchers) Names() []string {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	names := []string{}
+	for name, chans := range w.chans {
+		if len(chans) > 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// logger returns log, or the standard logrus logger when it is nil
+func logger(log logrus.FieldLogger) logrus.FieldLogger {
+	if log == nil {
+		return logrus.StandardLogger()
+	}
+	return log
+}
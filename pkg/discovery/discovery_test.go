@@ -0,0 +1,154 @@
+package discovery
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEndpoint(t *testing.T) {
+	endpoint, err := ParseEndpoint("10.0.0.1:8080")
+	assert.NoError(t, err)
+	assert.Equal(t, Endpoint{Host: "10.0.0.1", Port: "8080"}, endpoint)
+
+	endpoint, err = ParseEndpoint("api.internal")
+	assert.NoError(t, err)
+	assert.Equal(t, Endpoint{Host: "api.internal"}, endpoint)
+
+	endpoint, err = ParseEndpoint("[::1]:80")
+	assert.NoError(t, err)
+	assert.Equal(t, "[::1]:80", endpoint.String())
+
+	for _, invalid := range []string{"", ":80", "a:b:c"} {
+		_, err = ParseEndpoint(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestBalancer(t *testing.T) {
+	static := NewStatic(map[string][]Endpoint{
+		"api.internal": {{Host: "10.0.0.1", Port: "8080"}, {Host: "10.0.0.2"}, {Host: "10.0.0.3"}},
+	})
+
+	balancer := NewBalancer(static, RoundRobin, nil)
+	picked := []string{}
+	for i := 0; i < 4; i++ {
+		endpoint, ok := balancer.Pick("api.internal")
+		assert.True(t, ok)
+		picked = append(picked, endpoint.Host)
+	}
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.1"}, picked)
+
+	// the endpoint port wins over the port of the name
+	assert.Equal(t, "10.0.0.2:80", balancer.address("api.internal", "80"))
+	assert.Equal(t, "10.0.0.3", balancer.address("api.internal", ""))
+	assert.Equal(t, "10.0.0.1:8080", balancer.address("api.internal", "80"))
+
+	random := NewBalancer(static, Random, nil)
+	for i := 0; i < 10; i++ {
+		endpoint, ok := random.Pick("api.internal")
+		assert.True(t, ok)
+		assert.Contains(t, static.Resolve("api.internal"), endpoint)
+	}
+
+	_, ok := balancer.Pick("gone.internal")
+	assert.False(t, ok)
+	assert.Equal(t, "gone.internal:80", balancer.address("gone.internal", "80"))
+}
+
+func TestBalancerReverseProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RequestURI()))
+	}))
+	defer backend.Close()
+
+	backendURL, _ := url.Parse(backend.URL)
+	endpoint, err := ParseEndpoint(backendURL.Host)
+	assert.NoError(t, err)
+
+	static := NewStatic(map[string][]Endpoint{"api.internal": {endpoint}})
+	target, _ := url.Parse("http://api.internal:8080/base?a=1")
+
+	proxy := httptest.NewServer(NewBalancer(static, RoundRobin, nil).ReverseProxy(target))
+	defer proxy.Close()
+
+	res, err := http.Get(proxy.URL + "/path?b=2")
+	assert.NoError(t, err)
+
+	body, err := ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "/base/path?a=1&b=2", string(body))
+}
+
+func TestBalancerTransport(t *testing.T) {
+	hits := make(chan string, 4)
+	backend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "api.internal:8080", r.Host)
+			hits <- name
+		}))
+	}
+	first, second := backend("first"), backend("second")
+	defer first.Close()
+	defer second.Close()
+
+	endpoints := []Endpoint{}
+	for _, server := range []*httptest.Server{first, second} {
+		u, _ := url.Parse(server.URL)
+		endpoint, err := ParseEndpoint(u.Host)
+		assert.NoError(t, err)
+		endpoints = append(endpoints, endpoint)
+	}
+
+	static := NewStatic(map[string][]Endpoint{"api.internal": endpoints})
+	client := &http.Client{Transport: NewBalancer(static, RoundRobin, nil).Transport(http.DefaultTransport)}
+
+	// connections are kept alive, but every request picks an endpoint
+	for i := 0; i < 4; i++ {
+		res, err := client.Get("http://api.internal:8080/")
+		assert.NoError(t, err)
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+
+	picked := map[string]int{}
+	for i := 0; i < 4; i++ {
+		picked[<-hits]++
+	}
+	assert.Equal(t, map[string]int{"first": 2, "second": 2}, picked)
+}
+
+func TestWatchers(t *testing.T) {
+	var watchers Watchers
+	first := []Endpoint{{Host: "10.0.0.1"}}
+	second := []Endpoint{{Host: "10.0.0.2"}}
+	third := []Endpoint{{Host: "10.0.0.3"}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	watch := watchers.Watch(ctx, "api.internal", first)
+	assert.Equal(t, first, <-watch)
+	assert.Equal(t, []string{"api.internal"}, watchers.Names())
+
+	// unchanged endpoints aren't sent
+	watchers.Notify("api.internal", first)
+	select {
+	case endpoints := <-watch:
+		t.Fatalf("unexpected endpoints %v", endpoints)
+	default:
+	}
+
+	// slow watchers only get the latest endpoints
+	watchers.Notify("api.internal", second)
+	watchers.Notify("api.internal", third)
+	assert.Equal(t, third, <-watch)
+
+	cancel()
+	_, ok := <-watch
+	assert.False(t, ok)
+	assert.Empty(t, watchers.Names())
+}
@@ -0,0 +1,393 @@
+package discovery
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Bounds on the time between lookups of a name, whatever the ttl of its
+// records. Failed lookups are retried after DNSMinRefresh
+var (
+	DNSMinRefresh = time.Second
+	DNSMaxRefresh = 5 * time.Minute
+)
+
+// DNSNegativeTTL is the time a name without records is kept before it is
+// looked up again, when the server doesn't say with an SOA record
+var DNSNegativeTTL = 30 * time.Second
+
+// DNSIdleTimeout is how long a name that isn't resolved or watched is kept
+// up to date, before it is forgotten
+var DNSIdleTimeout = 10 * time.Minute
+
+const dnsTimeout = 5 * time.Second
+
+// DNS is a Resolver looking up names with a dns server, and looking them
+// up again when their records expire. Names starting with an underscore,
+// eg _http._tcp.api.internal, are SRV records and resolve to the target
+// and port of every record. Other names resolve to their A and AAAA
+// records
+type DNS struct {
+	server string
+	log    logrus.FieldLogger
+
+	mux   sync.Mutex
+	names map[string]*dnsName
+
+	watchers Watchers
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+// dnsName is a name that is kept up to date, endpoints is nil until the
+// first lookup is done
+type dnsName struct {
+	endpoints []Endpoint
+	// used is when the name was last resolved or watched
+	used time.Time
+	// ready is closed once the first lookup is done
+	ready chan struct{}
+}
+
+// resolvConf is read for the default dns server
+var resolvConf = "/etc/resolv.conf"
+
+func defaultDNSServer() (string, error) {
+	f, err := os.Open(resolvConf)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53"), nil
+		}
+	}
+
+	return "", fmt.Errorf("no nameserver in %s", resolvConf)
+}
+
+// NewDNS returns a Resolver using the dns server at server (host:port), or
+// the first nameserver in /etc/resolv.conf when it is empty. Names are
+// looked up the first time they are resolved or watched. It logs to log, or
+// the standard logrus logger when it is nil
+func NewDNS(server string, log logrus.FieldLogger) (*DNS, error) {
+	if server == "" {
+		var err error
+		if server, err = defaultDNSServer(); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &DNS{
+		server: server,
+		log:    logger(log),
+		names:  make(map[string]*dnsName),
+		ctx:    ctx,
+		cancel: cancel,
+	}, nil
+}
+
+// name returns the dnsName for name, starting to keep it up to date when
+// it is new. d.mux must be held
+func (d *DNS) name(name string) *dnsName {
+	n, ok := d.names[name]
+	if !ok {
+		n = &dnsName{ready: make(chan struct{})}
+		d.names[name] = n
+
+		d.wg.Add(1)
+		go d.refresh(name, n)
+	}
+	n.used = time.Now()
+	return n
+}
+
+// idle forgets name when it hasn't been resolved for DNSIdleTimeout and
+// isn't watched, and reports whether it did
+func (d *DNS) idle(name string, n *dnsName) bool {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	if time.Since(n.used) < DNSIdleTimeout || !d.watchers.forget(name) {
+		return false
+	}
+	delete(d.names, name)
+	return true
+}
+
+// Resolve returns the endpoints for name. The first lookup of a name is
+// done in the background, so until it is done there are no endpoints and
+// callers fall back to the system dns
+func (d *DNS) Resolve(name string) []Endpoint {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return d.name(name).endpoints
+}
+
+// Watch sends the endpoints for name whenever a lookup changes them
+func (d *DNS) Watch(ctx context.Context, name string) <-chan []Endpoint {
+	// lookups notify while holding d.mux, so none is missed in between
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return d.watchers.Watch(ctx, name, d.name(name).endpoints)
+}
+
+// Close stops looking up names
+func (d *DNS) Close() {
+	d.cancel()
+	d.wg.Wait()
+}
+
+// refresh looks up name until the resolver is closed or the name is idle,
+// waiting for the ttl of the records between lookups
+func (d *DNS) refresh(name string, n *dnsName) {
+	defer d.wg.Done()
+
+	first := true
+	for {
+		endpoints, ttl, err := d.lookup(name)
+		if err != nil {
+			d.log.WithError(err).WithField("name", name).Errorln("dns lookup failed, keeping the previous endpoints")
+			ttl = DNSMinRefresh
+		} else {
+			d.mux.Lock()
+			n.endpoints = endpoints
+			d.watchers.Notify(name, endpoints)
+			d.mux.Unlock()
+		}
+
+		if first {
+			close(n.ready)
+			first = false
+		}
+
+		if ttl < DNSMinRefresh {
+			ttl = DNSMinRefresh
+		}
+		if ttl > DNSMaxRefresh {
+			ttl = DNSMaxRefresh
+		}
+
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-time.After(ttl):
+		}
+
+		if d.idle(name, n) {
+			d.log.WithField("name", name).Debugln("dns name is idle, no longer looking it up")
+			return
+		}
+	}
+}
+
+// lookup queries the records for name, returning their endpoints and the
+// lowest ttl, or the negative ttl when there are none
+func (d *DNS) lookup(name string) ([]Endpoint, time.Duration, error) {
+	qtypes := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	if strings.HasPrefix(name, "_") {
+		qtypes = []dnsmessage.Type{dnsmessage.TypeSRV}
+	}
+
+	var answers, authorities []dnsmessage.Resource
+	for _, qtype := range qtypes {
+		typeAnswers, typeAuthorities, err := d.query(name, qtype)
+		if err != nil {
+			return nil, 0, err
+		}
+		answers = append(answers, typeAnswers...)
+		authorities = append(authorities, typeAuthorities...)
+	}
+
+	endpoints := []Endpoint{}
+	var ttl uint32
+	for _, answer := range answers {
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			endpoints = append(endpoints, Endpoint{Host: net.IP(body.A[:]).String()})
+		case *dnsmessage.AAAAResource:
+			endpoints = append(endpoints, Endpoint{Host: net.IP(body.AAAA[:]).String()})
+		case *dnsmessage.SRVResource:
+			endpoints = append(endpoints, Endpoint{
+				Host: strings.TrimSuffix(body.Target.String(), "."),
+				Port: strconv.Itoa(int(body.Port)),
+			})
+		default:
+			// eg the CNAME records leading to the A records
+			continue
+		}
+
+		if ttl == 0 || answer.Header.TTL < ttl {
+			ttl = answer.Header.TTL
+		}
+	}
+
+	if len(endpoints) == 0 {
+		return endpoints, negativeTTL(authorities), nil
+	}
+
+	// the order of records is often shuffled by the server
+	sort.Slice(endpoints, func(i, j int) bool {
+		return endpoints[i].String() < endpoints[j].String()
+	})
+
+	return endpoints, time.Duration(ttl) * time.Second, nil
+}
+
+// negativeTTL returns how long a name without records is cached, the lower
+// of the ttl and the minimum ttl of the SOA records in authorities
+func negativeTTL(authorities []dnsmessage.Resource) time.Duration {
+	found := false
+	var lowest uint32
+	for _, authority := range authorities {
+		soa, ok := authority.Body.(*dnsmessage.SOAResource)
+		if !ok {
+			continue
+		}
+
+		ttl := authority.Header.TTL
+		if soa.MinTTL < ttl {
+			ttl = soa.MinTTL
+		}
+		if !found || ttl < lowest {
+			lowest = ttl
+		}
+		found = true
+	}
+
+	if !found {
+		return DNSNegativeTTL
+	}
+	return time.Duration(lowest) * time.Second
+}
+
+// query sends a query for name to the server, over udp and again over tcp
+// when the answer is truncated. A name that doesn't exist has no answers
+func (d *DNS) query(name string, qtype dnsmessage.Type) (answers, authorities []dnsmessage.Resource, err error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	id := uint16(rand.Intn(1 << 16))
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	if err := builder.StartQuestions(); err != nil {
+		return nil, nil, err
+	}
+	if err := builder.Question(dnsmessage.Question{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, nil, err
+	}
+	msg, err := builder.Finish()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res, err := d.exchange("udp", msg, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var parser dnsmessage.Parser
+	header, err := parser.Start(res)
+	if err != nil {
+		return nil, nil, err
+	}
+	if header.Truncated {
+		// the answer didn't fit in a datagram
+		if res, err = d.exchange("tcp", msg, id); err != nil {
+			return nil, nil, err
+		}
+		if header, err = parser.Start(res); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	switch header.RCode {
+	case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError:
+		// a name that doesn't exist has no endpoints
+	default:
+		return nil, nil, fmt.Errorf("dns lookup of %s failed: %s", name, header.RCode)
+	}
+
+	if err := parser.SkipAllQuestions(); err != nil {
+		return nil, nil, err
+	}
+	if answers, err = parser.AllAnswers(); err != nil {
+		return nil, nil, err
+	}
+	if authorities, err = parser.AllAuthorities(); err != nil {
+		return nil, nil, err
+	}
+	return answers, authorities, nil
+}
+
+// exchange sends msg to the server over network, udp or tcp, and returns
+// the answer with the same id
+func (d *DNS) exchange(network string, msg []byte, id uint16) ([]byte, error) {
+	conn, err := net.DialTimeout(network, d.server, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+
+	if network == "tcp" {
+		// messages over tcp are prefixed with their length
+		framed := make([]byte, 2+len(msg))
+		binary.BigEndian.PutUint16(framed, uint16(len(msg)))
+		copy(framed[2:], msg)
+		if _, err := conn.Write(framed); err != nil {
+			return nil, err
+		}
+
+		length := make([]byte, 2)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return nil, err
+		}
+		res := make([]byte, binary.BigEndian.Uint16(length))
+		if _, err := io.ReadFull(conn, res); err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 4096)
+	for {
+		read, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if read >= 2 && binary.BigEndian.Uint16(buf) == id {
+			return buf[:read], nil
+		}
+		// a late answer to an earlier query
+	}
+}
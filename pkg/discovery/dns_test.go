@@ -0,0 +1,371 @@
+package discovery
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDNS answers A, AAAA and SRV queries from records, with a ttl of a
+// second, over udp and tcp. Answers without records get an SOA record with
+// a minimum ttl of a minute, and the udp answers with records for the
+// names in truncate are truncated
+type fakeDNS struct {
+	conn     net.PacketConn
+	listener net.Listener
+
+	mux      sync.Mutex
+	a        map[string][]string
+	srv      map[string][]dnsmessage.SRVResource
+	truncate map[string]bool
+	tcp      int
+}
+
+func newFakeDNS(t *testing.T) *fakeDNS {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	listener, err := net.Listen("tcp", conn.LocalAddr().String())
+	assert.NoError(t, err)
+
+	f := &fakeDNS{
+		conn:     conn,
+		listener: listener,
+		a:        make(map[string][]string),
+		srv:      make(map[string][]dnsmessage.SRVResource),
+		truncate: make(map[string]bool),
+	}
+	go f.serve()
+	go f.serveTCP()
+	return f
+}
+
+func (f *fakeDNS) close() {
+	f.conn.Close()
+	f.listener.Close()
+}
+
+// setA sets the A records of name, and the AAAA records for ipv6 addresses
+func (f *fakeDNS) setA(name string, ips ...string) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.a[name] = ips
+}
+
+func (f *fakeDNS) setSRV(name string, srvs ...dnsmessage.SRVResource) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.srv[name] = srvs
+}
+
+func (f *fakeDNS) setTruncate(name string) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.truncate[name] = true
+}
+
+func (f *fakeDNS) tcpQueries() int {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.tcp
+}
+
+func (f *fakeDNS) answer(query []byte, udp bool) ([]byte, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	f.mux.Lock()
+	name := question.Name.String()
+	ips, srvs, truncate := f.a[name], f.srv[name], f.truncate[name]
+	if !udp {
+		f.tcp++
+	}
+	f.mux.Unlock()
+
+	exists := len(ips) > 0 || len(srvs) > 0
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if parsed := net.ParseIP(ip); parsed.To4() != nil {
+			v4 = append(v4, parsed.To4())
+		} else {
+			v6 = append(v6, parsed)
+		}
+	}
+	switch question.Type {
+	case dnsmessage.TypeA:
+		v6, srvs = nil, nil
+	case dnsmessage.TypeAAAA:
+		v4, srvs = nil, nil
+	default:
+		v4, v6 = nil, nil
+	}
+	records := len(v4) + len(v6) + len(srvs)
+
+	header.Response = true
+	if udp && truncate && records > 0 {
+		header.Truncated = true
+		v4, v6, srvs = nil, nil, nil
+	} else if !exists {
+		header.RCode = dnsmessage.RCodeNameError
+	}
+
+	builder := dnsmessage.NewBuilder(nil, header)
+	builder.StartQuestions()
+	builder.Question(question)
+	builder.StartAnswers()
+
+	resource := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 1}
+	for _, ip := range v4 {
+		a := dnsmessage.AResource{}
+		copy(a.A[:], ip)
+		builder.AResource(resource, a)
+	}
+	for _, ip := range v6 {
+		aaaa := dnsmessage.AAAAResource{}
+		copy(aaaa.AAAA[:], ip)
+		builder.AAAAResource(resource, aaaa)
+	}
+	for _, srv := range srvs {
+		builder.SRVResource(resource, srv)
+	}
+
+	if records == 0 {
+		builder.StartAuthorities()
+		zone, _ := dnsmessage.NewName("internal.")
+		builder.SOAResource(
+			dnsmessage.ResourceHeader{Name: zone, Class: dnsmessage.ClassINET, TTL: 120},
+			dnsmessage.SOAResource{NS: zone, MBox: zone, MinTTL: 60},
+		)
+	}
+
+	return builder.Finish()
+}
+
+func (f *fakeDNS) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := f.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		msg, err := f.answer(buf[:n], true)
+		if err != nil {
+			continue
+		}
+		f.conn.WriteTo(msg, addr)
+	}
+}
+
+func (f *fakeDNS) serveTCP() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			length := make([]byte, 2)
+			if _, err := io.ReadFull(conn, length); err != nil {
+				return
+			}
+			query := make([]byte, binary.BigEndian.Uint16(length))
+			if _, err := io.ReadFull(conn, query); err != nil {
+				return
+			}
+
+			msg, err := f.answer(query, false)
+			if err != nil {
+				return
+			}
+			binary.BigEndian.PutUint16(length, uint16(len(msg)))
+			conn.Write(append(length, msg...))
+		}()
+	}
+}
+
+// resolve resolves name once its first lookup is done
+func resolve(d *DNS, name string) []Endpoint {
+	d.Resolve(name)
+
+	d.mux.Lock()
+	n := d.names[name]
+	d.mux.Unlock()
+	<-n.ready
+	return d.Resolve(name)
+}
+
+func TestDNS(t *testing.T) {
+	DNSMinRefresh = 10 * time.Millisecond
+
+	server := newFakeDNS(t)
+	defer server.close()
+
+	server.setA("api.internal.", "10.0.0.1", "10.0.0.2")
+	target, _ := dnsmessage.NewName("api.internal.")
+	server.setSRV("_http._tcp.api.internal.", dnsmessage.SRVResource{Target: target, Port: 8080})
+
+	resolver, err := NewDNS(server.conn.LocalAddr().String(), nil)
+	assert.NoError(t, err)
+	defer resolver.Close()
+
+	assert.Equal(t, []Endpoint{{Host: "10.0.0.1"}, {Host: "10.0.0.2"}}, resolve(resolver, "api.internal"))
+	assert.Equal(t, []Endpoint{{Host: "api.internal", Port: "8080"}}, resolve(resolver, "_http._tcp.api.internal"))
+	assert.Empty(t, resolve(resolver, "gone.internal"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watch := resolver.Watch(ctx, "api.internal")
+	<-watch
+
+	// looked up again once the ttl expires
+	server.setA("api.internal.", "10.0.0.3")
+	select {
+	case <-time.After(5 * time.Second):
+		panic("timed out waiting for endpoints")
+	case endpoints := <-watch:
+		assert.Equal(t, []Endpoint{{Host: "10.0.0.3"}}, endpoints)
+	}
+
+	// the server going away keeps the previous endpoints
+	server.close()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, []Endpoint{{Host: "10.0.0.3"}}, resolver.Resolve("api.internal"))
+}
+
+func TestDNSAsync(t *testing.T) {
+	server := newFakeDNS(t)
+	defer server.close()
+	server.setA("api.internal.", "10.0.0.1")
+
+	resolver, err := NewDNS(server.conn.LocalAddr().String(), nil)
+	assert.NoError(t, err)
+	defer resolver.Close()
+
+	// the first lookup doesn't hold up the caller, watchers get its result
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watch := resolver.Watch(ctx, "api.internal")
+
+	endpoints := <-watch
+	if len(endpoints) == 0 {
+		select {
+		case <-time.After(5 * time.Second):
+			panic("timed out waiting for endpoints")
+		case endpoints = <-watch:
+		}
+	}
+	assert.Equal(t, []Endpoint{{Host: "10.0.0.1"}}, endpoints)
+}
+
+func TestDNSNegativeTTL(t *testing.T) {
+	server := newFakeDNS(t)
+	defer server.close()
+	server.setA("api.internal.", "10.0.0.1")
+
+	resolver, err := NewDNS(server.conn.LocalAddr().String(), nil)
+	assert.NoError(t, err)
+	defer resolver.Close()
+
+	// the lower of the SOA ttl and its minimum ttl
+	endpoints, ttl, err := resolver.lookup("gone.internal")
+	assert.NoError(t, err)
+	assert.Empty(t, endpoints)
+	assert.Equal(t, time.Minute, ttl)
+
+	assert.Equal(t, DNSNegativeTTL, negativeTTL(nil))
+}
+
+func TestDNSTruncated(t *testing.T) {
+	server := newFakeDNS(t)
+	defer server.close()
+	server.setA("big.internal.", "10.0.0.1", "10.0.0.2")
+	server.setTruncate("big.internal.")
+
+	resolver, err := NewDNS(server.conn.LocalAddr().String(), nil)
+	assert.NoError(t, err)
+	defer resolver.Close()
+
+	// the truncated answer is asked for again over tcp
+	endpoints, _, err := resolver.lookup("big.internal")
+	assert.NoError(t, err)
+	assert.Equal(t, []Endpoint{{Host: "10.0.0.1"}, {Host: "10.0.0.2"}}, endpoints)
+	assert.Equal(t, 1, server.tcpQueries())
+}
+
+func TestDNSIPv6(t *testing.T) {
+	server := newFakeDNS(t)
+	defer server.close()
+	server.setA("api.internal.", "10.0.0.1", "fd00::1")
+	server.setA("v6.internal.", "fd00::2")
+
+	resolver, err := NewDNS(server.conn.LocalAddr().String(), nil)
+	assert.NoError(t, err)
+	defer resolver.Close()
+
+	assert.Equal(t, []Endpoint{{Host: "10.0.0.1"}, {Host: "fd00::1"}}, resolve(resolver, "api.internal"))
+	assert.Equal(t, []Endpoint{{Host: "fd00::2"}}, resolve(resolver, "v6.internal"))
+}
+
+func TestDNSIdle(t *testing.T) {
+	DNSMinRefresh, DNSMaxRefresh, DNSIdleTimeout = 10*time.Millisecond, 10*time.Millisecond, 50*time.Millisecond
+	defer func() {
+		DNSMinRefresh, DNSMaxRefresh, DNSIdleTimeout = time.Second, 5*time.Minute, 10*time.Minute
+	}()
+
+	server := newFakeDNS(t)
+	defer server.close()
+	server.setA("api.internal.", "10.0.0.1")
+	server.setA("watched.internal.", "10.0.0.2")
+
+	resolver, err := NewDNS(server.conn.LocalAddr().String(), nil)
+	assert.NoError(t, err)
+	defer resolver.Close()
+
+	assert.Equal(t, []Endpoint{{Host: "10.0.0.1"}}, resolve(resolver, "api.internal"))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resolver.Watch(ctx, "watched.internal")
+
+	// names that aren't resolved are forgotten, unless they are watched
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		resolver.mux.Lock()
+		_, found := resolver.names["api.internal"]
+		resolver.mux.Unlock()
+		if !found {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			panic("timed out waiting for the name to be forgotten")
+		}
+	}
+	resolver.mux.Lock()
+	assert.Contains(t, resolver.names, "watched.internal")
+	resolver.mux.Unlock()
+
+	// and looked up again when they are resolved again
+	assert.Equal(t, []Endpoint{{Host: "10.0.0.1"}}, resolve(resolver, "api.internal"))
+}
+
+func TestDefaultDNSServer(t *testing.T) {
+	resolvConf = "/nonexistent/resolv.conf"
+	defer func() { resolvConf = "/etc/resolv.conf" }()
+
+	_, err := NewDNS("", nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,194 @@
+package discovery
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+// File is a Resolver reading endpoints from a file, which is reloaded when
+// it changes. Every line is a name followed by its endpoints, eg
+//
+//	# comments and blank lines are skipped
+//	api.internal 10.0.0.1:8080 10.0.0.2:8080
+//	api.internal 10.0.0.3:8080
+type File struct {
+	path string
+	// realPath is where path links to, only used by run
+	realPath string
+	log      logrus.FieldLogger
+	// endpoints holds the current map[string][]Endpoint
+	endpoints atomic.Value
+	watchers  Watchers
+	watcher   *fsnotify.Watcher
+	done      chan struct{}
+}
+
+// ParseEndpointsFile reads a file of endpoints in the format of File
+func ParseEndpointsFile(path string) (map[string][]Endpoint, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	endpoints := make(map[string][]Endpoint)
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected a name and its endpoints", path, line)
+		}
+
+		name := fields[0]
+		for _, field := range fields[1:] {
+			endpoint, err := ParseEndpoint(field)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+			}
+			endpoints[name] = append(endpoints[name], endpoint)
+		}
+	}
+
+	return endpoints, scanner.Err()
+}
+
+// fileReloadDelay is how long the file must be left unchanged before it is
+// reloaded, so that a file being written is only read once it is complete
+var fileReloadDelay = 100 * time.Millisecond
+
+// NewFile returns a Resolver for the endpoints in the file at path. The
+// directory of the file is watched, so files replaced by a rename, or a
+// symlink to a file that changes (eg a kubernetes config map) are reloaded
+// too. It logs to log, or the standard logrus logger when it is nil
+func NewFile(path string, log logrus.FieldLogger) (*File, error) {
+	path = filepath.Clean(path)
+	endpoints, err := ParseEndpointsFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	f := &File{path: path, log: logger(log), watcher: watcher, done: make(chan struct{})}
+	f.realPath, _ = filepath.EvalSymlinks(path)
+	f.endpoints.Store(endpoints)
+
+	go f.run()
+	return f, nil
+}
+
+func (f *File) current() map[string][]Endpoint {
+	return f.endpoints.Load().(map[string][]Endpoint)
+}
+
+// Resolve returns the endpoints for name
+func (f *File) Resolve(name string) []Endpoint {
+	return f.current()[name]
+}
+
+// Watch sends the endpoints for name whenever the file changes them
+func (f *File) Watch(ctx context.Context, name string) <-chan []Endpoint {
+	return f.watchers.Watch(ctx, name, f.Resolve(name))
+}
+
+// Close stops watching the file
+func (f *File) Close() {
+	f.watcher.Close()
+	<-f.done
+}
+
+func (f *File) reload() {
+	entry := f.log.WithField("file", f.path)
+
+	endpoints, err := ParseEndpointsFile(f.path)
+	if err != nil {
+		// eg the file is being replaced
+		entry.WithError(err).Errorln("error reloading endpoints, keeping the previous endpoints")
+		return
+	}
+	if len(endpoints) == 0 {
+		// eg truncated by a write that isn't done yet
+		entry.Errorln("endpoints file has no endpoints, keeping the previous endpoints")
+		return
+	}
+
+	f.endpoints.Store(endpoints)
+	entry.Infoln("reloaded endpoints")
+
+	for _, name := range f.watchers.Names() {
+		f.watchers.Notify(name, endpoints[name])
+	}
+}
+
+// changed reports whether event changes the file, rather than another file
+// in its directory. Symlinks change when where they link to does, eg the
+// ..data link of a kubernetes config map is replaced
+func (f *File) changed(event fsnotify.Event) bool {
+	if filepath.Clean(event.Name) == f.path {
+		return true
+	}
+	realPath, err := filepath.EvalSymlinks(f.path)
+	return err == nil && realPath != f.realPath
+}
+
+func (f *File) run() {
+	defer close(f.done)
+
+	// events are debounced, writes come as several events
+	timer := time.NewTimer(fileReloadDelay)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case event, ok := <-f.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&fsnotify.Chmod == event.Op || !f.changed(event) {
+				continue
+			}
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(fileReloadDelay)
+		case <-timer.C:
+			if _, err := os.Stat(f.path); err != nil {
+				// removed, wait for it to be written again
+				continue
+			}
+			f.realPath, _ = filepath.EvalSymlinks(f.path)
+			f.reload()
+		case err, ok := <-f.watcher.Errors:
+			if !ok {
+				return
+			}
+			f.log.WithError(err).WithField("file", f.path).Errorln("error watching endpoints file")
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package discovery
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+var testEndpointsFile = `
+# api replicas
+api.internal 10.0.0.1:8080 10.0.0.2:8080
+api.internal 10.0.0.3
+
+db.internal 10.0.1.1:5432
+`
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomirror-endpoints")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "endpoints")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(testEndpointsFile), 0644))
+
+	file, err := NewFile(path, nil)
+	assert.NoError(t, err)
+	defer file.Close()
+
+	assert.Equal(t, []Endpoint{
+		{Host: "10.0.0.1", Port: "8080"},
+		{Host: "10.0.0.2", Port: "8080"},
+		{Host: "10.0.0.3"},
+	}, file.Resolve("api.internal"))
+	assert.Empty(t, file.Resolve("cache.internal"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watch := file.Watch(ctx, "api.internal")
+	<-watch
+
+	// replaced with a rename, like a kubernetes config map
+	next := filepath.Join(dir, "endpoints.next")
+	assert.NoError(t, ioutil.WriteFile(next, []byte("api.internal 10.0.0.4:8080\n"), 0644))
+	assert.NoError(t, os.Rename(next, path))
+
+	select {
+	case <-time.After(5 * time.Second):
+		panic("timed out waiting for endpoints")
+	case endpoints := <-watch:
+		assert.Equal(t, []Endpoint{{Host: "10.0.0.4", Port: "8080"}}, endpoints)
+	}
+
+	// invalid and empty files are skipped
+	assert.NoError(t, ioutil.WriteFile(path, []byte("api.internal\n"), 0644))
+	time.Sleep(3 * fileReloadDelay)
+	assert.Equal(t, []Endpoint{{Host: "10.0.0.4", Port: "8080"}}, file.Resolve("api.internal"))
+
+	assert.NoError(t, ioutil.WriteFile(path, nil, 0644))
+	time.Sleep(3 * fileReloadDelay)
+	assert.Equal(t, []Endpoint{{Host: "10.0.0.4", Port: "8080"}}, file.Resolve("api.internal"))
+
+	// a file written in several steps is only read once it is complete
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0644)
+	assert.NoError(t, err)
+	f.WriteString("api.internal 10.0.0.5:8080")
+	f.Sync()
+	f.WriteString(" 10.0.0.6:8080\n")
+	assert.NoError(t, f.Close())
+
+	select {
+	case <-time.After(5 * time.Second):
+		panic("timed out waiting for endpoints")
+	case endpoints := <-watch:
+		assert.Equal(t, []Endpoint{{Host: "10.0.0.5", Port: "8080"}, {Host: "10.0.0.6", Port: "8080"}}, endpoints)
+	}
+}
+
+func TestFileOtherFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomirror-endpoints")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "endpoints")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(testEndpointsFile), 0644))
+
+	log, hook := test.NewNullLogger()
+	file, err := NewFile(path, log)
+	assert.NoError(t, err)
+	defer file.Close()
+
+	// changes to other files in the directory don't reload the file
+	other := filepath.Join(dir, "other")
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, ioutil.WriteFile(other, []byte("unrelated\n"), 0644))
+	}
+	time.Sleep(3 * fileReloadDelay)
+	assert.Empty(t, hook.AllEntries())
+}
+
+func TestFileSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomirror-endpoints")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// laid out like a kubernetes config map, the file links to ..data,
+	// which links to the current version
+	write := func(version, content string) {
+		assert.NoError(t, os.Mkdir(filepath.Join(dir, version), 0755))
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, version, "endpoints"), []byte(content), 0644))
+		assert.NoError(t, os.Symlink(version, filepath.Join(dir, "..data_tmp")))
+		assert.NoError(t, os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")))
+	}
+	write("v1", "api.internal 10.0.0.1:8080\n")
+	path := filepath.Join(dir, "endpoints")
+	assert.NoError(t, os.Symlink(filepath.Join("..data", "endpoints"), path))
+
+	file, err := NewFile(path, nil)
+	assert.NoError(t, err)
+	defer file.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watch := file.Watch(ctx, "api.internal")
+	assert.Equal(t, []Endpoint{{Host: "10.0.0.1", Port: "8080"}}, <-watch)
+
+	write("v2", "api.internal 10.0.0.2:8080\n")
+	select {
+	case <-time.After(5 * time.Second):
+		panic("timed out waiting for endpoints")
+	case endpoints := <-watch:
+		assert.Equal(t, []Endpoint{{Host: "10.0.0.2", Port: "8080"}}, endpoints)
+	}
+}
+
+func TestFileErrors(t *testing.T) {
+	_, err := NewFile("/nonexistent/endpoints", nil)
+	assert.Error(t, err)
+
+	f, err := ioutil.TempFile("", "gomirror-endpoints")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	f.WriteString("api.internal 10.0.0.1:8080 :80\n")
+	f.Close()
+
+	_, err = ParseEndpointsFile(f.Name())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), ":1:")
+}
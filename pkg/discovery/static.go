@@ -0,0 +1,28 @@
+package discovery
+
+import "context"
+
+// Static is a Resolver with a fixed list of endpoints for every name
+type Static struct {
+	endpoints map[string][]Endpoint
+	watchers  Watchers
+}
+
+// NewStatic returns a Resolver that always resolves the names in endpoints
+// to their endpoints
+func NewStatic(endpoints map[string][]Endpoint) *Static {
+	return &Static{endpoints: endpoints}
+}
+
+// Resolve returns the endpoints for name
+func (s *Static) Resolve(name string) []Endpoint {
+	return s.endpoints[name]
+}
+
+// Watch sends the endpoints for name, they never change
+func (s *Static) Watch(ctx context.Context, name string) <-chan []Endpoint {
+	return s.watchers.Watch(ctx, name, s.Resolve(name))
+}
+
+// Close does nothing
+func (s *Static) Close() {}
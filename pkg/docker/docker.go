@@ -1,123 +1,339 @@
 package docker
 
 import (
+	"errors"
 	"fmt"
-	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/petereps/gomirror/pkg/discovery"
+
+	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/sirupsen/logrus"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
 	"golang.org/x/net/context"
 )
 
-// DNSResolver uses the local docker sock to resolve ip addresses,
-// based on the identifier provided
+// DefaultLabelPrefix is the prefix of the labels containers are discovered
+// by, eg gomirror.host=api.internal and gomirror.port=8080
+const DefaultLabelPrefix = "gomirror"
+
+var _ discovery.Resolver = (*DNSResolver)(nil)
+
+// lookupDebounce is how long the resolver waits for more events before
+// looking up containers
+var lookupDebounce = 500 * time.Millisecond
+
+// Backoff between attempts to reconnect to the docker events stream
+var (
+	reconnectMinBackoff = time.Second
+	reconnectMaxBackoff = 30 * time.Second
+)
+
+var errEventsClosed = errors.New("docker events stream closed")
+
+// DefaultResyncInterval is how often containers are looked up again when
+// no events arrive, in case events were missed
+const DefaultResyncInterval = time.Minute
+
+// dockerClient is the part of *client.Client used by the resolver
+type dockerClient interface {
+	ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error)
+	ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error)
+	Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error)
+}
+
+// lifecycleEvents are the container events that change which containers
+// are running
+var lifecycleEvents = []string{
+	"start", "restart", "unpause", "pause", "stop", "die", "kill", "destroy",
+}
+
+// hostTable is a snapshot of the containers for every host. It is never
+// modified once stored, lookups build a new one
+type hostTable map[string][]discovery.Endpoint
+
+// SyncStatus is how fresh the containers of a DNSResolver are, eg for
+// health checks
+type SyncStatus struct {
+	// LastSync is when the containers were last looked up successfully
+	LastSync time.Time
+	// LastAttempt is when the containers were last looked up
+	LastAttempt time.Time
+	// LastError is the error of the last lookup, nil when it succeeded
+	LastError error
+}
+
+// DNSResolver is a discovery.Resolver using the local docker sock to
+// resolve ip addresses, based on the identifier provided. A single
+// goroutine follows the docker events and looks up containers, storing the
+// results as a snapshot that is read without locking
 type DNSResolver struct {
-	currentIP      string
-	cli            *client.Client
-	hostToIP       map[string]string
-	mux            sync.Mutex
-	debounce       *time.Timer
+	cli dockerClient
+	// hosts holds the current hostTable
+	hosts          atomic.Value
+	watchers       discovery.Watchers
 	hostIdentifier string
+	labelPrefix    string
+	// network is the docker network whose ip addresses are preferred
+	network string
+	// resync is the interval between full lookups, disabled when it is
+	// negative
+	resync time.Duration
+	log    logrus.FieldLogger
+
+	statusMux sync.Mutex
+	status    SyncStatus
+
+	cancel context.CancelFunc
+	done   chan struct{}
 }
 
-func singleJoiningSlash(a, b string) string {
-	aslash := strings.HasSuffix(a, "/")
-	bslash := strings.HasPrefix(b, "/")
+// NewDNSResolver returns an initialized DNSResolver, with ip addresses
+// filled in at the time of creation. Containers are found by the value of
+// the hostIdentifier environment variable, on any network, and looked up
+// again every DefaultResyncInterval. See NewDNSResolverWithOptions
+func NewDNSResolver(client *client.Client, hostIdentifier string) *DNSResolver {
+	return NewDNSResolverWithOptions(client, hostIdentifier, "", 0, nil)
+}
 
-	switch {
-	case aslash && bslash:
-		return a + b[1:]
-	case !aslash && !bslash:
-		return a + "/" + b
+// NewDNSResolverWithOptions returns an initialized DNSResolver like
+// NewDNSResolver. Finding containers by their environment needs an inspect
+// call per container, NewLabelDNSResolver is faster. Ip addresses on
+// network are preferred, unless it is empty. Containers are looked up again
+// every resync, DefaultResyncInterval when it is 0 and never when it is
+// negative. It logs to log, or the standard logrus logger when it is nil
+func NewDNSResolverWithOptions(client *client.Client, hostIdentifier, network string, resync time.Duration, log logrus.FieldLogger) *DNSResolver {
+	return newDNSResolver(client, hostIdentifier, "", network, resync, log)
+}
+
+// NewLabelDNSResolver returns an initialized DNSResolver that finds
+// containers by their <labelPrefix>.host label, and the port to use in
+// their <labelPrefix>.port label. Ip addresses on network are preferred,
+// unless it is empty. Containers are looked up again every resync, like
+// NewDNSResolverWithOptions
+func NewLabelDNSResolver(client *client.Client, labelPrefix, network string, resync time.Duration, log logrus.FieldLogger) *DNSResolver {
+	if labelPrefix == "" {
+		labelPrefix = DefaultLabelPrefix
 	}
-	return a + b
+	return newDNSResolver(client, "", labelPrefix, network, resync, log)
 }
 
-// ReverseProxy will return a httputil.ReverseProxy that uses the IPAddress
-// call of DNSResolver instead of the systems dns call
-func (d *DNSResolver) ReverseProxy(target *url.URL) *httputil.ReverseProxy {
-	targetQuery := target.RawQuery
+func newDNSResolver(cli dockerClient, hostIdentifier, labelPrefix, network string, resync time.Duration, log logrus.FieldLogger) *DNSResolver {
+	ctx, cancel := context.WithCancel(context.Background())
 
-	director := func(req *http.Request) {
-		req.URL.Scheme = target.Scheme
-		lookup := target.Hostname()
+	if resync == 0 {
+		resync = DefaultResyncInterval
+	}
+	if log == nil {
+		log = logrus.StandardLogger()
+	}
 
-		address := d.IPAddress(lookup)
-		if address == "" {
-			logrus.Errorf("no host found in docker for request host %s. Defering to system dns", lookup)
-			address = lookup
-		}
+	d := &DNSResolver{
+		cli:            cli,
+		hostIdentifier: hostIdentifier,
+		labelPrefix:    labelPrefix,
+		network:        network,
+		resync:         resync,
+		log:            log,
+		cancel:         cancel,
+		done:           make(chan struct{}),
+	}
+	d.hosts.Store(hostTable{})
 
-		if target.Port() != "" {
-			address = address + ":" + target.Port()
-		}
+	d.lookup(ctx)
+	go d.run(ctx)
+	return d
+}
 
-		req.URL.Host = address
+// Close stops following docker events
+func (d *DNSResolver) Close() {
+	d.cancel()
+	<-d.done
+}
 
-		req.URL.Path = singleJoiningSlash(target.Path, req.URL.Path)
-		if targetQuery == "" || req.URL.RawQuery == "" {
-			req.URL.RawQuery = targetQuery + req.URL.RawQuery
-		} else {
-			req.URL.RawQuery = targetQuery + "&" + req.URL.RawQuery
-		}
+// Listen blocks until ctx is done or the resolver is closed.
+//
+// Deprecated: the resolver follows docker events from its creation until
+// Close, Listen is kept for compatibility
+func (d *DNSResolver) Listen(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+	case <-d.done:
+	}
+	return nil
+}
 
-		if _, ok := req.Header["User-Agent"]; !ok {
-			// explicitly disable User-Agent so it's not set to default value
-			req.Header.Set("User-Agent", "")
-		}
+// ReverseProxy will return a httputil.ReverseProxy that uses the
+// containers of the resolver instead of the systems dns call.
+//
+// Deprecated: use discovery.NewBalancer(d, discovery.RoundRobin, log).ReverseProxy,
+// which balances over every container for the host
+func (d *DNSResolver) ReverseProxy(target *url.URL) *httputil.ReverseProxy {
+	return discovery.NewBalancer(d, discovery.RoundRobin, d.log).ReverseProxy(target)
+}
 
-	}
+// Status returns when the containers were last looked up, and the error
+// of the last lookup
+func (d *DNSResolver) Status() SyncStatus {
+	d.statusMux.Lock()
+	defer d.statusMux.Unlock()
+	return d.status
+}
 
-	return &httputil.ReverseProxy{Director: director}
+func (d *DNSResolver) table() hostTable {
+	return d.hosts.Load().(hostTable)
 }
 
-// NewDNSResolver returns an initialized DNSResolver, with ip addresses
-// filled in at the time of creation
-func NewDNSResolver(client *client.Client, hostIdentifier string) *DNSResolver {
-	d := &DNSResolver{cli: client, hostToIP: make(map[string]string), hostIdentifier: hostIdentifier}
-	d.lookupIPs(nil)
-	go d.Listen(context.Background())
-	return d
+// Resolve returns the ip address of every container for host, with the
+// port declared in its labels
+func (d *DNSResolver) Resolve(host string) []discovery.Endpoint {
+	return d.table()[host]
+}
+
+// Watch sends the containers for host whenever they change
+func (d *DNSResolver) Watch(ctx context.Context, host string) <-chan []discovery.Endpoint {
+	return d.watchers.Watch(ctx, host, d.Resolve(host))
 }
 
-// IPAddress gets an ip address by host name
+// IPAddress gets the ip address of the first container for host
 func (d *DNSResolver) IPAddress(host string) string {
-	return d.hostToIP[host]
+	if endpoints := d.Resolve(host); len(endpoints) > 0 {
+		return endpoints[0].Host
+	}
+	return ""
 }
 
-func (d *DNSResolver) lookupIPs(event interface{}) {
-	if d.debounce == nil {
-		d.debounce = time.NewTimer(500 * time.Millisecond)
-		<-d.debounce.C
+// IPAddresses gets the ip addresses of every container for host
+func (d *DNSResolver) IPAddresses(host string) []string {
+	ips := []string{}
+	for _, endpoint := range d.Resolve(host) {
+		ips = append(ips, endpoint.Host)
+	}
+	return ips
+}
+
+// setHosts replaces the containers for every host, dropping the hosts whose
+// containers stopped
+func (d *DNSResolver) setHosts(hosts hostTable) {
+	for host, endpoints := range hosts {
+		for _, endpoint := range endpoints {
+			d.log.WithField("host", host).WithField("ip_address", endpoint.Host).WithField("port", endpoint.Port).Debugln("found container")
+		}
+	}
+
+	d.hosts.Store(hosts)
+
+	for _, host := range d.watchers.Names() {
+		d.watchers.Notify(host, hosts[host])
+	}
+}
+
+// ipAddress returns the ip address of a container on the preferred
+// network. Containers off it, or without a preferred network, use the first
+// network by name with an ip address
+func (d *DNSResolver) ipAddress(networks map[string]*network.EndpointSettings) string {
+	if n := networks[d.network]; d.network != "" && n != nil && n.IPAddress != "" {
+		return n.IPAddress
+	}
+
+	names := make([]string, 0, len(networks))
+	for name := range networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if n := networks[name]; n != nil && n.IPAddress != "" {
+			return n.IPAddress
+		}
+	}
+	return ""
+}
+
+// lookup replaces the containers for every host. Errors are logged and the
+// previous containers are kept
+func (d *DNSResolver) lookup(ctx context.Context) error {
+	var hosts hostTable
+	var err error
+	if d.labelPrefix != "" {
+		hosts, err = d.lookupLabels(ctx)
 	} else {
-		d.debounce.Reset(500 * time.Millisecond)
-		return
+		hosts, err = d.lookupEnv(ctx)
 	}
 
-	logrus.WithField("event", fmt.Sprintf("%+v", event)).Debugln("looking up ip")
+	d.statusMux.Lock()
+	d.status.LastAttempt = time.Now()
+	d.status.LastError = err
+	if err == nil {
+		d.status.LastSync = d.status.LastAttempt
+	}
+	d.statusMux.Unlock()
 
-	d.debounce = nil
+	if err != nil {
+		d.log.WithError(err).Errorln("error looking up docker containers")
+		return err
+	}
 
+	d.setHosts(hosts)
+	return nil
+}
+
+// lookupLabels lists the running containers with a host label, the list
+// has their labels and networks so no inspect calls are needed
+func (d *DNSResolver) lookupLabels(ctx context.Context) (hostTable, error) {
+	hostLabel := d.labelPrefix + ".host"
+	portLabel := d.labelPrefix + ".port"
+
+	args := filters.NewArgs()
+	args.Add("status", "running")
+	args.Add("label", hostLabel)
+	containers, err := d.cli.ContainerList(ctx, types.ContainerListOptions{Filters: args})
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := make(hostTable)
+	for _, container := range containers {
+		if container.NetworkSettings == nil {
+			continue
+		}
+
+		host := container.Labels[hostLabel]
+		ip := d.ipAddress(container.NetworkSettings.Networks)
+		if host == "" || ip == "" {
+			continue
+		}
+
+		hosts[host] = append(hosts[host], discovery.Endpoint{Host: ip, Port: container.Labels[portLabel]})
+	}
+
+	return hosts, nil
+}
+
+func (d *DNSResolver) lookupEnv(ctx context.Context) (hostTable, error) {
 	cli := d.cli
 
 	args := filters.NewArgs()
 	args.Add("status", "running")
-	containers, err := cli.ContainerList(context.Background(), types.ContainerListOptions{Filters: args})
+	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{Filters: args})
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
+	hosts := make(hostTable)
 	for _, container := range containers {
-		c, err := cli.ContainerInspect(context.Background(), container.ID)
-		if err != nil {
+		c, err := cli.ContainerInspect(ctx, container.ID)
+		if err != nil || c.Config == nil || c.NetworkSettings == nil {
 			continue
 		}
 
@@ -129,40 +345,93 @@ func (d *DNSResolver) lookupIPs(event interface{}) {
 
 			if key := kv[0]; key == d.hostIdentifier {
 				host := kv[1]
-				for _, n := range c.NetworkSettings.Networks {
-					if n.IPAddress != "" {
-						logrus.WithField("host", host).WithField("ip_address", n.IPAddress).Infoln()
-						d.mux.Lock()
-						d.hostToIP[host] = n.IPAddress
-						d.mux.Unlock()
-						break
-					}
+				if ip := d.ipAddress(c.NetworkSettings.Networks); ip != "" {
+					hosts[host] = append(hosts[host], discovery.Endpoint{Host: ip})
 				}
 			}
 		}
 
 	}
+
+	return hosts, nil
 }
 
-// Listen listens for docker events, and resolves ips when they occur
-func (d *DNSResolver) Listen(ctx context.Context) error {
-	cli := d.cli
+// run follows the docker events until ctx is done, reconnecting with
+// backoff when the stream fails, eg when the docker daemon restarts
+func (d *DNSResolver) run(ctx context.Context) {
+	defer close(d.done)
+
+	backoff := reconnectMinBackoff
+	for {
+		err := d.watch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		d.log.WithError(err).WithField("retry_in", backoff).Warnln("docker events stream failed, reconnecting")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		// events may have been missed while disconnected
+		if d.lookup(ctx) == nil {
+			backoff = reconnectMinBackoff
+		} else if backoff *= 2; backoff > reconnectMaxBackoff {
+			backoff = reconnectMaxBackoff
+		}
+	}
+}
+
+// watch looks up containers after container lifecycle events, waiting for
+// the events to settle first, and every resync interval. It returns when
+// the events stream fails
+func (d *DNSResolver) watch(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
 	args := filters.NewArgs()
+	args.Add("type", "container")
+	for _, event := range lifecycleEvents {
+		args.Add("event", event)
+	}
+	if d.labelPrefix != "" {
+		args.Add("label", d.labelPrefix+".host")
+	}
 
-	messages, errC := cli.Events(ctx, types.EventsOptions{Filters: args})
+	messages, errC := d.cli.Events(ctx, types.EventsOptions{Filters: args})
 
+	var resync <-chan time.Time
+	if d.resync > 0 {
+		ticker := time.NewTicker(d.resync)
+		defer ticker.Stop()
+		resync = ticker.C
+	}
+
+	var debounce <-chan time.Time
 	for {
 		select {
 		case <-ctx.Done():
-			return nil
+			return ctx.Err()
 		case err := <-errC:
+			if err == nil {
+				err = errEventsClosed
+			}
 			return err
 		case event, ok := <-messages:
 			if !ok {
-				return nil
+				return errEventsClosed
 			}
-			go d.lookupIPs(event)
+			d.log.WithField("event", fmt.Sprintf("%+v", event)).Debugln("docker event")
+			debounce = time.After(lookupDebounce)
+		case <-debounce:
+			debounce = nil
+			d.lookup(ctx)
+		case <-resync:
+			d.log.Debugln("resyncing docker containers")
+			d.lookup(ctx)
 		}
 	}
 }
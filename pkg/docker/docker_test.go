@@ -2,17 +2,26 @@ package docker
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/petereps/gomirror/pkg/discovery"
 	"github.com/petereps/gomirror/pkg/testutils"
 
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
 )
 
@@ -25,11 +34,7 @@ func TestContainer(t *testing.T) {
 	assert.NoError(t, err)
 
 	resolver := NewDNSResolver(client, "VIRTUAL_HOST")
-
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	go resolver.Listen(ctx)
+	defer resolver.Close()
 
 	ip := resolver.IPAddress("testing-app.com")
 	assert.NotEmpty(t, ip)
@@ -65,3 +70,302 @@ func TestContainer(t *testing.T) {
 	assert.Equal(t, "hello world", string(body))
 
 }
+
+func TestLabelContainer(t *testing.T) {
+	r := testutils.GetServerContainer()
+	defer r.Close()
+	r.Expire(60)
+
+	client, err := client.NewEnvClient()
+	assert.NoError(t, err)
+
+	resolver := NewLabelDNSResolver(client, "", "", 0, nil)
+	defer resolver.Close()
+
+	endpoints := resolver.Resolve("testing-app.com")
+	assert.Len(t, endpoints, 1)
+	assert.Equal(t, "80", endpoints[0].Port)
+
+	// the port label wins over the port in the url
+	target, err := url.Parse("http://testing-app.com:8080")
+	assert.NoError(t, err)
+
+	balancer := discovery.NewBalancer(resolver, discovery.RoundRobin, nil)
+	proxy := httptest.NewServer(balancer.ReverseProxy(target))
+	defer proxy.Close()
+
+	res, err := http.Get(proxy.URL)
+	assert.NoError(t, err)
+
+	body, err := ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world", string(body))
+}
+
+func TestResolve(t *testing.T) {
+	resolver := &DNSResolver{log: logrus.StandardLogger()}
+	resolver.setHosts(hostTable{
+		"api.internal": {{Host: "10.0.0.1", Port: "8080"}, {Host: "10.0.0.2"}},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watch := resolver.Watch(ctx, "api.internal")
+	assert.Len(t, <-watch, 2)
+
+	// stopped containers are dropped on the next lookup
+	resolver.setHosts(hostTable{"api.internal": {{Host: "10.0.0.2"}}})
+	assert.Equal(t, []discovery.Endpoint{{Host: "10.0.0.2"}}, <-watch)
+	assert.Equal(t, []string{"10.0.0.2"}, resolver.IPAddresses("api.internal"))
+	assert.Empty(t, resolver.IPAddress("gone.internal"))
+}
+
+func TestPreferredNetwork(t *testing.T) {
+	networks := map[string]*network.EndpointSettings{
+		"frontend": {IPAddress: "172.18.0.2"},
+		"backend":  {IPAddress: "172.19.0.2"},
+		"none":     {},
+	}
+
+	resolver := &DNSResolver{log: logrus.StandardLogger()}
+	assert.Equal(t, "172.19.0.2", resolver.ipAddress(networks))
+
+	resolver.network = "frontend"
+	assert.Equal(t, "172.18.0.2", resolver.ipAddress(networks))
+
+	// containers off the preferred network use another one
+	resolver.network = "monitoring"
+	assert.Equal(t, "172.19.0.2", resolver.ipAddress(networks))
+
+	resolver.network = "none"
+	assert.Equal(t, "172.19.0.2", resolver.ipAddress(networks))
+
+	assert.Empty(t, resolver.ipAddress(map[string]*network.EndpointSettings{"none": {}}))
+}
+
+func TestResolverPreferredNetwork(t *testing.T) {
+	fake := &fakeDocker{}
+	fake.run("api.internal", "10.0.0.1")
+	fake.containers = append(fake.containers, types.Container{
+		Labels: map[string]string{"gomirror.host": "api.internal"},
+		NetworkSettings: &types.SummaryNetworkSettings{
+			Networks: map[string]*network.EndpointSettings{
+				"bridge":   {IPAddress: "10.0.0.3"},
+				"frontend": {IPAddress: "172.18.0.2"},
+			},
+		},
+	})
+
+	// the container only on the bridge network is still found
+	resolver := newDNSResolver(fake, "", DefaultLabelPrefix, "frontend", -1, nil)
+	defer resolver.Close()
+	assert.Equal(t, []string{"10.0.0.1", "172.18.0.2"}, resolver.IPAddresses("api.internal"))
+}
+
+// fakeDocker is an in memory dockerClient. Its events stream fails while
+// the daemon is down
+type fakeDocker struct {
+	mux        sync.Mutex
+	containers []types.Container
+	down       bool
+	streams    []chan events.Message
+	errs       []chan error
+}
+
+func (f *fakeDocker) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if f.down {
+		return nil, errors.New("cannot connect to the docker daemon")
+	}
+	return append([]types.Container{}, f.containers...), nil
+}
+
+func (f *fakeDocker) ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
+	return types.ContainerJSON{}, errors.New("not implemented")
+}
+
+func (f *fakeDocker) Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	messages := make(chan events.Message, 10)
+	errs := make(chan error, 1)
+	if f.down {
+		errs <- errors.New("cannot connect to the docker daemon")
+	} else {
+		f.streams = append(f.streams, messages)
+		f.errs = append(f.errs, errs)
+	}
+	return messages, errs
+}
+
+func (f *fakeDocker) run(host, ip string) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.containers = append(f.containers, types.Container{
+		Labels: map[string]string{"gomirror.host": host},
+		NetworkSettings: &types.SummaryNetworkSettings{
+			Networks: map[string]*network.EndpointSettings{"bridge": {IPAddress: ip}},
+		},
+	})
+	for _, stream := range f.streams {
+		stream <- events.Message{Action: "start"}
+	}
+}
+
+// restart fails the events streams, and brings the daemon back with no
+// containers
+func (f *fakeDocker) restart() {
+	f.mux.Lock()
+	f.down = true
+	for _, errs := range f.errs {
+		errs <- errors.New("unexpected EOF")
+	}
+	f.streams, f.errs = nil, nil
+	f.containers = nil
+	f.mux.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+
+	f.mux.Lock()
+	f.down = false
+	f.mux.Unlock()
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	for i := 0; i < 200; i++ {
+		if condition() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for the resolver")
+}
+
+func TestResolverReconnect(t *testing.T) {
+	lookupDebounce = time.Millisecond
+	reconnectMinBackoff = time.Millisecond
+	reconnectMaxBackoff = 10 * time.Millisecond
+
+	fake := &fakeDocker{}
+	fake.run("api.internal", "10.0.0.1")
+
+	resolver := newDNSResolver(fake, "", DefaultLabelPrefix, "", -1, nil)
+	defer resolver.Close()
+	assert.Equal(t, "10.0.0.1", resolver.IPAddress("api.internal"))
+
+	// read while the resolver updates
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					resolver.Resolve("api.internal")
+					resolver.IPAddress("api.internal")
+				}
+			}
+		}()
+	}
+
+	waitFor(t, func() bool {
+		fake.mux.Lock()
+		defer fake.mux.Unlock()
+		return len(fake.streams) > 0
+	})
+	fake.run("api.internal", "10.0.0.2")
+	waitFor(t, func() bool { return len(resolver.IPAddresses("api.internal")) == 2 })
+
+	// the daemon restarts without the containers, and they come back
+	fake.restart()
+	waitFor(t, func() bool { return len(resolver.IPAddresses("api.internal")) == 0 })
+
+	waitFor(t, func() bool {
+		fake.mux.Lock()
+		defer fake.mux.Unlock()
+		return len(fake.streams) > 0
+	})
+	fake.run("api.internal", "10.0.0.3")
+	waitFor(t, func() bool { return resolver.IPAddress("api.internal") == "10.0.0.3" })
+
+	close(stop)
+	readers.Wait()
+}
+
+func TestResolverDeprecated(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello world"))
+	}))
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	fake := &fakeDocker{}
+	fake.run("api.internal", serverURL.Hostname())
+	resolver := newDNSResolver(fake, "", DefaultLabelPrefix, "", -1, nil)
+
+	target, err := url.Parse("http://api.internal:" + serverURL.Port())
+	assert.NoError(t, err)
+	proxy := httptest.NewServer(resolver.ReverseProxy(target))
+	defer proxy.Close()
+
+	res, err := http.Get(proxy.URL)
+	assert.NoError(t, err)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world", string(body))
+
+	// Listen returns once the resolver is closed
+	listened := make(chan error)
+	go func() { listened <- resolver.Listen(context.Background()) }()
+	resolver.Close()
+	select {
+	case <-time.After(5 * time.Second):
+		panic("timed out waiting for listen")
+	case err := <-listened:
+		assert.NoError(t, err)
+	}
+}
+
+func TestResolverResync(t *testing.T) {
+	fake := &fakeDocker{}
+	fake.run("api.internal", "10.0.0.1")
+
+	resolver := newDNSResolver(fake, "", DefaultLabelPrefix, "", 10*time.Millisecond, nil)
+	defer resolver.Close()
+	assert.Equal(t, "10.0.0.1", resolver.IPAddress("api.internal"))
+	assert.NoError(t, resolver.Status().LastError)
+	synced := resolver.Status().LastSync
+	assert.False(t, synced.IsZero())
+
+	// a container whose start event was missed is found by the resync
+	fake.mux.Lock()
+	fake.containers = append(fake.containers, types.Container{
+		Labels: map[string]string{"gomirror.host": "api.internal"},
+		NetworkSettings: &types.SummaryNetworkSettings{
+			Networks: map[string]*network.EndpointSettings{"bridge": {IPAddress: "10.0.0.2"}},
+		},
+	})
+	fake.mux.Unlock()
+	waitFor(t, func() bool { return len(resolver.IPAddresses("api.internal")) == 2 })
+	assert.True(t, resolver.Status().LastSync.After(synced))
+
+	// failed lookups are reported, and keep the last sync time
+	fake.mux.Lock()
+	fake.down = true
+	fake.mux.Unlock()
+	waitFor(t, func() bool { return resolver.Status().LastError != nil })
+
+	status := resolver.Status()
+	assert.True(t, status.LastAttempt.After(status.LastSync))
+	assert.Len(t, resolver.IPAddresses("api.internal"), 2)
+}
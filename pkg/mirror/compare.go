@@ -0,0 +1,434 @@
+package mirror
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Comparator compares responses, eg of the primary and mirror, ignoring
+// differences that don't change their meaning: content encodings, header
+// case, the formatting of json, xml and form bodies, and optionally array
+// order, small numeric differences and whitespace
+type Comparator struct {
+	method  string
+	pattern string
+
+	ignore     []string
+	unordered  map[string]string
+	tolerance  float64
+	decimals   int
+	headers    []string
+	whitespace bool
+	message    *protoMessage
+	// maxDecoded is the most a body is inflated to, DefaultMaxDecodedSize
+	// when it is 0
+	maxDecoded int64
+}
+
+func (c *Comparator) decodeLimit() int64 {
+	if c.maxDecoded <= 0 {
+		return DefaultMaxDecodedSize
+	}
+	return c.maxDecoded
+}
+
+// parseRoute splits a route pattern into its optional method and path
+// pattern
+func parseRoute(route string) (method, pattern string, err error) {
+	fields := strings.Fields(route)
+	switch len(fields) {
+	case 1:
+		pattern = fields[0]
+	case 2:
+		method, pattern = strings.ToUpper(fields[0]), fields[1]
+	default:
+		return "", "", fmt.Errorf("invalid route %q, expected a method and path, eg GET /items/:id", route)
+	}
+
+	if !strings.HasPrefix(pattern, "/") {
+		return "", "", fmt.Errorf("route path %q must start with /", pattern)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return "", "", fmt.Errorf("invalid route path %q: %s", pattern, err)
+	}
+	return method, pattern, nil
+}
+
+// NewComparator returns the comparator configured by c. The route of c is
+// only used by Comparators
+func NewComparator(c *CompareConfig) (*Comparator, error) {
+	comparator := &Comparator{
+		ignore:     c.Ignore,
+		unordered:  map[string]string{},
+		tolerance:  c.Tolerance,
+		decimals:   c.Decimals,
+		whitespace: c.NormalizeWhitespace,
+	}
+
+	if c.Route != "" {
+		var err error
+		if comparator.method, comparator.pattern, err = parseRoute(c.Route); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.Tolerance < 0 {
+		return nil, fmt.Errorf("tolerance must not be negative, got %v", c.Tolerance)
+	}
+	if c.Decimals < 0 {
+		return nil, fmt.Errorf("decimals must not be negative, got %d", c.Decimals)
+	}
+
+	for _, array := range c.Unordered {
+		if array.Path != diffRoot && !strings.HasPrefix(array.Path, diffRoot+".") {
+			return nil, fmt.Errorf("unordered path %q must start with $", array.Path)
+		}
+		comparator.unordered[array.Path] = array.Key
+	}
+
+	for _, header := range c.Headers {
+		comparator.headers = append(comparator.headers, http.CanonicalHeaderKey(header))
+	}
+
+	if c.ProtoDescriptor != "" || c.ProtoMessage != "" {
+		if c.ProtoDescriptor == "" || c.ProtoMessage == "" {
+			return nil, errors.New("proto-descriptor and proto-message must be set together")
+		}
+
+		message, err := loadProtoMessage(c.ProtoDescriptor, c.ProtoMessage)
+		if err != nil {
+			return nil, err
+		}
+		comparator.message = message
+	}
+
+	return comparator, nil
+}
+
+// matches reports whether the comparator applies to a request
+func (c *Comparator) matches(method, requestPath string) bool {
+	if c.method != "" && c.method != method {
+		return false
+	}
+
+	matched, _ := path.Match(c.pattern, RouteOf(requestPath))
+	if !matched {
+		matched, _ = path.Match(c.pattern, requestPath)
+	}
+	return matched
+}
+
+// Compare returns the fields that differ between two responses: status,
+// the compared headers, eg headers.Content-Type, and the paths of the body
+// values that differ, eg $.items[*].id. Bodies that can't be parsed are
+// compared as a whole, as $, and truncated bodies aren't compared
+func (c *Comparator) Compare(a, b *CapturedResponse) []string {
+	fields := map[string]bool{}
+	if a.StatusCode != b.StatusCode && !c.ignored(diffStatus) {
+		fields[diffStatus] = true
+	}
+
+	for _, name := range c.headers {
+		field := "headers." + name
+		if !c.ignored(field) && !c.equalText(strings.Join(a.Header[name], ", "), strings.Join(b.Header[name], ", ")) {
+			fields[field] = true
+		}
+	}
+
+	if a.Truncated || b.Truncated {
+		// only part of a body was captured
+		return sortedFields(fields)
+	}
+
+	aTree, aText, aOK := c.body(a)
+	bTree, bText, bOK := c.body(b)
+	switch {
+	case c.ignored(diffRoot):
+	case aOK && bOK:
+		c.diff(diffRoot, aTree, bTree, fields)
+	case !c.equalText(string(aText), string(bText)):
+		fields[diffRoot] = true
+	}
+
+	return sortedFields(fields)
+}
+
+// ignored reports whether field, or one of its parents, isn't compared
+func (c *Comparator) ignored(field string) bool {
+	for _, ignore := range c.ignore {
+		if covers(ignore, field) {
+			return true
+		}
+	}
+	return false
+}
+
+// diff adds the paths of the values that differ between a and b to fields.
+// Array elements share the path [*], and ordered arrays of different
+// lengths differ as a whole. A key missing from one object differs from a
+// null one
+func (c *Comparator) diff(path string, a, b interface{}, fields map[string]bool) {
+	if c.ignored(path) {
+		return
+	}
+
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok {
+			fields[path] = true
+			return
+		}
+
+		for key, value := range a {
+			other, ok := b[key]
+			if !ok {
+				c.missing(path+"."+key, fields)
+				continue
+			}
+			c.diff(path+"."+key, value, other, fields)
+		}
+		for key := range b {
+			if _, ok := a[key]; !ok {
+				c.missing(path+"."+key, fields)
+			}
+		}
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok {
+			fields[path] = true
+			return
+		}
+
+		if key, ok := c.unordered[path]; ok {
+			c.diffUnordered(path, key, a, b, fields)
+			return
+		}
+
+		if len(a) != len(b) {
+			fields[path] = true
+			return
+		}
+		for i := range a {
+			c.diff(path+"[*]", a[i], b[i], fields)
+		}
+	default:
+		if !c.equalValues(a, b) {
+			fields[path] = true
+		}
+	}
+}
+
+// missing adds path to fields, for a key only one of the objects has
+func (c *Comparator) missing(path string, fields map[string]bool) {
+	if !c.ignored(path) {
+		fields[path] = true
+	}
+}
+
+// diffUnordered compares arrays as sets, matching elements by key, or
+// whole elements without a key
+func (c *Comparator) diffUnordered(path, key string, a, b []interface{}, fields map[string]bool) {
+	if len(a) != len(b) {
+		fields[path] = true
+		return
+	}
+
+	if key == "" {
+		used := make([]bool, len(b))
+		for _, x := range a {
+			found := false
+			for j, y := range b {
+				if used[j] {
+					continue
+				}
+
+				elementFields := map[string]bool{}
+				c.diff(path+"[*]", x, y, elementFields)
+				if len(elementFields) == 0 {
+					used[j], found = true, true
+					break
+				}
+			}
+			if !found {
+				fields[path] = true
+				return
+			}
+		}
+		return
+	}
+
+	aByKey, aOK := elementsByKey(a, key)
+	bByKey, bOK := elementsByKey(b, key)
+	if !aOK || !bOK {
+		fields[path] = true
+		return
+	}
+
+	for k, x := range aByKey {
+		y, ok := bByKey[k]
+		if !ok {
+			fields[path] = true
+			continue
+		}
+		c.diff(path+"[*]", x, y, fields)
+	}
+}
+
+// elementsByKey indexes array elements by their key field, ok is false
+// when an element has no key or a key is repeated
+func elementsByKey(elements []interface{}, key string) (map[string]interface{}, bool) {
+	byKey := map[string]interface{}{}
+	for _, element := range elements {
+		object, ok := element.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		value, ok := object[key]
+		if !ok {
+			return nil, false
+		}
+
+		k := fmt.Sprint(value)
+		if _, ok := byKey[k]; ok {
+			return nil, false
+		}
+		byKey[k] = element
+	}
+	return byKey, true
+}
+
+func (c *Comparator) equalValues(a, b interface{}) bool {
+	if reflect.DeepEqual(a, b) {
+		return true
+	}
+
+	// integers are compared exactly, they may not fit in a float64
+	if c.tolerance == 0 && c.decimals == 0 {
+		if aInt, ok := integer(a); ok {
+			if bInt, ok := integer(b); ok {
+				return aInt == bInt
+			}
+		}
+	}
+
+	if aNumber, ok := number(a); ok {
+		if bNumber, ok := number(b); ok {
+			return c.equalNumbers(aNumber, bNumber)
+		}
+	}
+
+	aString, aOK := a.(string)
+	bString, bOK := b.(string)
+	if !aOK || !bOK {
+		return false
+	}
+
+	// xml and form values are strings, so numbers are parsed when they are
+	// compared loosely
+	if c.tolerance > 0 || c.decimals > 0 {
+		aNumber, aErr := strconv.ParseFloat(strings.TrimSpace(aString), 64)
+		bNumber, bErr := strconv.ParseFloat(strings.TrimSpace(bString), 64)
+		if aErr == nil && bErr == nil {
+			return c.equalNumbers(aNumber, bNumber)
+		}
+	}
+	return c.equalText(aString, bString)
+}
+
+// number converts the numbers of parsed bodies to float64
+func number(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// integer converts the integers of parsed json bodies to int64
+func integer(v interface{}) (int64, bool) {
+	if n, ok := v.(json.Number); ok {
+		i, err := n.Int64()
+		return i, err == nil
+	}
+	i, ok := v.(int64)
+	return i, ok
+}
+
+// numberEpsilon absorbs the float error of rounding, eg 1.01-1.00 is
+// slightly more than 0.01
+const numberEpsilon = 1e-9
+
+func (c *Comparator) equalNumbers(a, b float64) bool {
+	if c.decimals > 0 {
+		scale := math.Pow(10, float64(c.decimals))
+		a = math.Round(a*scale) / scale
+		b = math.Round(b*scale) / scale
+	}
+	return math.Abs(a-b) <= c.tolerance+numberEpsilon*math.Max(1, math.Max(math.Abs(a), math.Abs(b)))
+}
+
+func (c *Comparator) equalText(a, b string) bool {
+	if c.whitespace {
+		return strings.Join(strings.Fields(a), " ") == strings.Join(strings.Fields(b), " ")
+	}
+	return a == b
+}
+
+// Comparators picks the comparator of a request by its route
+type Comparators struct {
+	rules    []*Comparator
+	fallback *Comparator
+}
+
+// NewComparators returns the comparators configured by configs, requests
+// that match none of them are compared with the defaults
+func NewComparators(configs []CompareConfig) (*Comparators, error) {
+	comparators := &Comparators{fallback: &Comparator{unordered: map[string]string{}}}
+	for i := range configs {
+		if configs[i].Route == "" {
+			return nil, fmt.Errorf("compare[%d] is missing a route", i)
+		}
+
+		comparator, err := NewComparator(&configs[i])
+		if err != nil {
+			return nil, fmt.Errorf("compare[%d]: %s", i, err)
+		}
+		comparators.rules = append(comparators.rules, comparator)
+	}
+	return comparators, nil
+}
+
+// setMaxDecoded sets the most the comparators inflate a body to
+func (c *Comparators) setMaxDecoded(limit int64) {
+	c.fallback.maxDecoded = limit
+	for _, comparator := range c.rules {
+		comparator.maxDecoded = limit
+	}
+}
+
+// For returns the comparator of the first config matching the method and
+// path of a request
+func (c *Comparators) For(method, requestPath string) *Comparator {
+	for _, comparator := range c.rules {
+		if comparator.matches(method, requestPath) {
+			return comparator
+		}
+	}
+	return c.fallback
+}
@@ -0,0 +1,205 @@
+package mirror
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/golang/protobuf/descriptor"
+	"github.com/golang/protobuf/proto"
+	protobuf "github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/stretchr/testify/assert"
+)
+
+func response(code int, contentType, body string) *CapturedResponse {
+	header := http.Header{}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	return &CapturedResponse{StatusCode: code, Header: header, Body: []byte(body)}
+}
+
+func newTestComparator(t *testing.T, c CompareConfig) *Comparator {
+	comparator, err := NewComparator(&c)
+	assert.NoError(t, err)
+	return comparator
+}
+
+func TestCompare(t *testing.T) {
+	c := newTestComparator(t, CompareConfig{})
+
+	assert.Empty(t, c.Compare(response(200, "", `{"a":1}`), response(200, "application/json", `{ "a": 1 }`)))
+	assert.Equal(t, []string{"status"}, c.Compare(response(200, "", ""), response(404, "", "")))
+	assert.Equal(t, []string{"$"}, c.Compare(response(200, "text/plain", "one"), response(200, "text/plain", "two")))
+	assert.Equal(t,
+		[]string{"$.added", "$.items[*].id", "$.nested.time", "$.tags"},
+		c.Compare(
+			response(200, "", `{"items":[{"id":1,"name":"a"},{"id":2,"name":"b"}],"nested":{"time":1},"tags":["a"]}`),
+			response(200, "", `{"items":[{"id":3,"name":"a"},{"id":4,"name":"b"}],"nested":{"time":2},"tags":["a","b"],"added":true}`),
+		),
+	)
+
+	// truncated bodies aren't compared
+	truncated := response(200, "", `{"a":`)
+	truncated.Truncated = true
+	assert.Empty(t, c.Compare(response(200, "", `{"a":1}`), truncated))
+
+	// null values differ from missing keys
+	assert.Equal(t, []string{"$.a"}, c.Compare(response(200, "", `{"a":null}`), response(200, "", `{}`)))
+	assert.Equal(t, []string{"$.b"}, c.Compare(response(200, "", `{"a":null}`), response(200, "", `{"a":null,"b":null}`)))
+
+	// large integers are compared exactly
+	assert.Equal(t, []string{"$.id"}, c.Compare(response(200, "", `{"id":9007199254740993}`), response(200, "", `{"id":9007199254740992}`)))
+}
+
+func TestCompareRules(t *testing.T) {
+	c := newTestComparator(t, CompareConfig{
+		Ignore: []string{"$.time", "status"},
+		Unordered: []UnorderedArray{
+			{Path: "$.items", Key: "id"},
+			{Path: "$.tags"},
+		},
+		Tolerance:           0.01,
+		Decimals:            2,
+		Headers:             []string{"content-language"},
+		NormalizeWhitespace: true,
+	})
+
+	a := response(200, "", `{"time":1,"price":1.004,"title":" a  title","tags":["x","y"],"items":[{"id":1,"n":"a"},{"id":2,"n":"b"}]}`)
+	a.Header.Set("Content-Language", "en")
+	b := response(201, "", `{"time":2,"price":1.011,"title":"a title ","tags":["y","x"],"items":[{"id":2,"n":"b"},{"id":1,"n":"a"}]}`)
+	b.Header.Set("content-language", "en")
+	assert.Empty(t, c.Compare(a, b))
+
+	b = response(200, "", `{"price":2,"title":"a","tags":["y","z"],"items":[{"id":2,"n":"c"},{"id":1,"n":"a"}]}`)
+	b.Header.Set("Content-Language", "de")
+	assert.Equal(t, []string{"$.items[*].n", "$.price", "$.tags", "$.title", "headers.Content-Language"}, c.Compare(a, b))
+}
+
+func TestCompareEncodings(t *testing.T) {
+	c := newTestComparator(t, CompareConfig{})
+	body := `{"a":[1,2,3]}`
+
+	gzipped := &bytes.Buffer{}
+	gz := gzip.NewWriter(gzipped)
+	gz.Write([]byte(body))
+	gz.Close()
+
+	brotlied := &bytes.Buffer{}
+	br := brotli.NewWriter(brotlied)
+	br.Write([]byte(body))
+	br.Close()
+
+	a := response(200, "application/json", gzipped.String())
+	a.Header.Set("Content-Encoding", "gzip")
+	b := response(200, "application/json", brotlied.String())
+	b.Header.Set("Content-Encoding", "br")
+	assert.Empty(t, c.Compare(a, b))
+	assert.Empty(t, c.Compare(a, response(200, "application/json", body)))
+
+	// and so are bodies that inflate past the limit
+	limited := newTestComparator(t, CompareConfig{})
+	limited.maxDecoded = int64(len(body) - 1)
+	assert.Equal(t, []string{"$"}, limited.Compare(a, b))
+	limited.maxDecoded = int64(len(body))
+	assert.Empty(t, limited.Compare(a, b))
+
+	// bodies that can't be decoded are compared as they are
+	b.Header.Set("Content-Encoding", "zstd")
+	assert.Equal(t, []string{"$"}, c.Compare(a, b))
+}
+
+func TestCompareContentTypes(t *testing.T) {
+	c := newTestComparator(t, CompareConfig{Unordered: []UnorderedArray{{Path: "$.items.item", Key: "@id"}}})
+
+	assert.Empty(t, c.Compare(
+		response(200, "application/xml", `<items><item id="1">a</item><item id="2">b</item></items>`),
+		response(200, "text/xml; charset=utf-8", "<?xml version=\"1.0\"?>\n<items>\n  <item id=\"2\">b</item>\n  <item id=\"1\">a</item>\n</items>"),
+	))
+	assert.Equal(t, []string{"$.items.item[*].#text"}, c.Compare(
+		response(200, "application/xml", `<items><item id="1">a</item><item id="2">b</item></items>`),
+		response(200, "application/xml", `<items><item id="1">a</item><item id="2">c</item></items>`),
+	))
+
+	assert.Empty(t, c.Compare(
+		response(200, "application/x-www-form-urlencoded", "a=1&b=2&b=3"),
+		response(200, "application/x-www-form-urlencoded", "b=2&a=1&b=3"),
+	))
+	assert.Equal(t, []string{"$.b"}, c.Compare(
+		response(200, "application/x-www-form-urlencoded", "a=1&b=2"),
+		response(200, "application/x-www-form-urlencoded", "a=1&b=3"),
+	))
+}
+
+func TestCompareProtobuf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomirror-proto")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// descriptor.proto describes itself, so its messages are used as the
+	// bodies
+	file, _ := descriptor.ForMessage(&protobuf.DescriptorProto{})
+	set, err := proto.Marshal(&protobuf.FileDescriptorSet{File: []*protobuf.FileDescriptorProto{file}})
+	assert.NoError(t, err)
+	path := filepath.Join(dir, "descriptor.pb")
+	assert.NoError(t, ioutil.WriteFile(path, set, 0644))
+
+	message := func(fields ...string) *CapturedResponse {
+		msg := &protobuf.DescriptorProto{Name: proto.String("Item")}
+		for i, name := range fields {
+			msg.Field = append(msg.Field, &protobuf.FieldDescriptorProto{
+				Name:   proto.String(name),
+				Number: proto.Int32(int32(i + 1)),
+				Type:   protobuf.FieldDescriptorProto_TYPE_STRING.Enum(),
+			})
+		}
+
+		body, err := proto.Marshal(msg)
+		assert.NoError(t, err)
+		return response(200, "application/x-protobuf", string(body))
+	}
+
+	c := newTestComparator(t, CompareConfig{
+		ProtoDescriptor: path,
+		ProtoMessage:    "google.protobuf.DescriptorProto",
+		Unordered:       []UnorderedArray{{Path: "$.field", Key: "name"}},
+	})
+	assert.Empty(t, c.Compare(message("a", "b"), message("a", "b")))
+	assert.Equal(t, []string{"$.field[*].number"}, c.Compare(message("a", "b"), message("b", "a")))
+	assert.Equal(t, []string{"$.field"}, c.Compare(message("a", "b"), message("a")))
+
+	decoded, err := c.message.decode(message("a").Body)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"name": "Item",
+		"field": []interface{}{
+			map[string]interface{}{"name": "a", "number": int64(1), "type": "TYPE_STRING"},
+		},
+	}, decoded)
+
+	_, err = NewComparator(&CompareConfig{ProtoDescriptor: path, ProtoMessage: "shop.Item"})
+	assert.Error(t, err)
+}
+
+func TestComparators(t *testing.T) {
+	comparators, err := NewComparators([]CompareConfig{
+		{Route: "GET /items/:id", Ignore: []string{"$.time"}},
+		{Route: "/items/*", Ignore: []string{"$"}},
+	})
+	assert.NoError(t, err)
+
+	a, b := response(200, "", `{"time":1}`), response(200, "", `{"time":2}`)
+	assert.Empty(t, comparators.For(http.MethodGet, "/items/42").Compare(a, b))
+	assert.Empty(t, comparators.For(http.MethodPost, "/items/new").Compare(a, b))
+	assert.Equal(t, []string{"$.time"}, comparators.For(http.MethodGet, "/users/42").Compare(a, b))
+
+	_, err = NewComparators([]CompareConfig{{Route: "GET items"}})
+	assert.Error(t, err)
+	_, err = NewComparators([]CompareConfig{{Route: "/items", Tolerance: -1}})
+	assert.Error(t, err)
+}
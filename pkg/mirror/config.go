@@ -1,9 +1,12 @@
 package mirror
 
 import (
+	"encoding/csv"
 	"net/http"
 	"os"
+	"reflect"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
@@ -15,34 +18,275 @@ type Header struct {
 	Value string
 }
 
+// UpstreamTLSConfig configures TLS for connections to an upstream server
+type UpstreamTLSConfig struct {
+	// CAFile is a PEM bundle used instead of the system roots
+	CAFile   string `yaml:"ca-file" toml:"ca-file" mapstructure:"ca-file"`
+	CertFile string `yaml:"cert-file" toml:"cert-file" mapstructure:"cert-file"`
+	KeyFile  string `yaml:"key-file" toml:"key-file" mapstructure:"key-file"`
+	// ServerName overrides the name used to verify the upstream certificate
+	ServerName string `yaml:"server-name" toml:"server-name" mapstructure:"server-name"`
+	// InsecureSkipVerify disables certificate verification, for staging only
+	InsecureSkipVerify bool `yaml:"insecure-skip-verify" toml:"insecure-skip-verify" mapstructure:"insecure-skip-verify"`
+}
+
+// GRPCConfig selects the gRPC methods that are mirrored. Methods are
+// matched against the /package.Service/Method path, and /package.Service/*
+// or * can be used to match every method of a service or every method
+type GRPCConfig struct {
+	// Methods are unary calls, mirrored with the buffered request body
+	Methods []string
+	// StreamMethods are streaming calls, mirrored best-effort as the client
+	// sends messages. The mirror is abandoned if it can't keep up
+	StreamMethods []string `yaml:"stream-methods" toml:"stream-methods" mapstructure:"stream-methods"`
+}
+
 type MirrorConfig struct {
 	URL     string
 	Headers []Header
+	TLS     UpstreamTLSConfig
+	// H2C speaks cleartext HTTP/2 (prior knowledge) to an http:// mirror,
+	// and HTTP/2 over tls with the TLS settings to an https:// one
+	H2C  bool `yaml:"h2c" toml:"h2c" mapstructure:"h2c"`
+	GRPC GRPCConfig
+	// Lookup the mirror host in docker, sharing the resolver of the primary
+	DockerLookup DockerLookupConfig `yaml:"docker-lookup-config" toml:"docker-lookup-config" mapstructure:"docker-lookup-config"`
+	Discovery    DiscoveryConfig
+	// SampleRate is the fraction of requests mirrored, between 0 and 1.
+	// Every request is mirrored when it is 0
+	SampleRate float64 `yaml:"sample-rate" toml:"sample-rate" mapstructure:"sample-rate"`
+	// OutcomeLog is a file recording the primary and mirror responses of
+	// every mirrored request, read by gomirror report. It is rotated like
+	// the file sink
+	OutcomeLog string `yaml:"outcome-log" toml:"outcome-log" mapstructure:"outcome-log"`
+	// MaxCaptureSize is the most of a response body, in bytes, kept in
+	// memory for observers, the outcome log and diffing, and of a request
+	// body written by the file, stdout, unix and exec sinks. Longer bodies
+	// are truncated, and event streams aren't kept. Defaults to 1MiB
+	MaxCaptureSize int64 `yaml:"max-capture-size" toml:"max-capture-size" mapstructure:"max-capture-size"`
+	Diff           DiffConfig
+}
+
+// DefaultMaxCaptureSize is the most of a response body kept in memory,
+// unless MaxCaptureSize is set
+const DefaultMaxCaptureSize = 1 << 20
+
+// captureLimit is MaxCaptureSize, or its default when it isn't set
+func (c *MirrorConfig) captureLimit() int64 {
+	if c.MaxCaptureSize <= 0 {
+		return DefaultMaxCaptureSize
+	}
+	return c.MaxCaptureSize
+}
+
+// DiffConfig compares the mirror responses with the primary ones. Json
+// fields that differ between two instances of the primary, eg timestamps
+// and ids, are learned as noise and ignored
+type DiffConfig struct {
+	Enabled bool
+	// SecondaryURL is a second instance of the primary, sent a copy of
+	// requests to learn the noise
+	SecondaryURL string `yaml:"secondary-url" toml:"secondary-url" mapstructure:"secondary-url"`
+	// SampleRate is the fraction of compared requests also sent to the
+	// secondary, between 0 and 1. Every request is sent when it is 0
+	SampleRate float64 `yaml:"sample-rate" toml:"sample-rate" mapstructure:"sample-rate"`
+	// SecondaryMethods are the request methods sent to the secondary.
+	// Defaults to the safe methods, GET, HEAD and OPTIONS, so that the
+	// secondary isn't written to unless other methods are listed
+	SecondaryMethods []string `yaml:"secondary-methods" toml:"secondary-methods" mapstructure:"secondary-methods"`
+	// NoiseFile keeps the learned noise across restarts
+	NoiseFile string `yaml:"noise-file" toml:"noise-file" mapstructure:"noise-file"`
+	// NoiseSamples is how many secondary responses a field must differ in
+	// before it is learned as noise. Defaults to 3
+	NoiseSamples int `yaml:"noise-samples" toml:"noise-samples" mapstructure:"noise-samples"`
+	// NoiseRatio is the fraction of the secondary responses of a route a
+	// field must differ in before it is learned as noise. Defaults to 0.5
+	NoiseRatio float64 `yaml:"noise-ratio" toml:"noise-ratio" mapstructure:"noise-ratio"`
+	// MaxDecodedSize is the most a gzip, deflate or br body is inflated to
+	// before it is compared, in bytes. Bodies that inflate to more are
+	// compared as they are. Defaults to 10MiB
+	MaxDecodedSize int64 `yaml:"max-decoded-size" toml:"max-decoded-size" mapstructure:"max-decoded-size"`
+	// Compare configures the comparison of the routes it matches, the
+	// first match is used
+	Compare []CompareConfig
 }
 
+// CompareConfig configures how the responses of the routes matching Route
+// are compared
+type CompareConfig struct {
+	// Route is a method and route pattern, eg "GET /items/:id", or
+	// "/items/*" for every method. It is matched against the request path
+	// with ids replaced by :id
+	Route string
+	// Ignore lists the fields that aren't compared, eg $.time, and their
+	// children
+	Ignore []string
+	// Unordered compares arrays as sets instead of lists
+	Unordered []UnorderedArray
+	// Tolerance is the largest difference between numbers that are equal
+	Tolerance float64
+	// Decimals rounds numbers to this many decimals before comparing them,
+	// when it is above 0
+	Decimals int
+	// Headers lists the response headers compared, by case insensitive name
+	Headers []string
+	// NormalizeWhitespace trims strings and text bodies, and collapses
+	// their runs of whitespace, before comparing them
+	NormalizeWhitespace bool `yaml:"normalize-whitespace" toml:"normalize-whitespace" mapstructure:"normalize-whitespace"`
+	// ProtoDescriptor is a file descriptor set, from protoc
+	// --include_imports --descriptor_set_out, used to decode protobuf
+	// bodies as the ProtoMessage message, eg shop.v1.Item. gRPC responses
+	// aren't diffed, so these are http responses of a protobuf content type
+	ProtoDescriptor string `yaml:"proto-descriptor" toml:"proto-descriptor" mapstructure:"proto-descriptor"`
+	ProtoMessage    string `yaml:"proto-message" toml:"proto-message" mapstructure:"proto-message"`
+}
+
+// UnorderedArray is an array compared as a set
+type UnorderedArray struct {
+	// Path of the array, eg $.items
+	Path string
+	// Key is the field identifying the elements, eg id. Elements are
+	// matched whole when it is empty
+	Key string
+}
+
+// DockerLookupConfig finds containers by their <label-prefix>.host label,
+// eg gomirror.host=api.internal, and uses the port in their
+// <label-prefix>.port label when set
 type DockerLookupConfig struct {
+	// HostIdentifier finds containers by the value of this environment
+	// variable instead of labels, which is slower
 	HostIdentifier string `yaml:"host-identifier" toml:"host-identifier" mapstructure:"host-identifier"`
+	// LabelPrefix defaults to gomirror
+	LabelPrefix string `yaml:"label-prefix" toml:"label-prefix" mapstructure:"label-prefix"`
+	// Network is the docker network whose container ip addresses are
+	// preferred, containers that aren't on it use another network
+	Network string
+	// ResyncInterval is how often all containers are looked up again, in
+	// case docker events were missed. Defaults to a minute, negative
+	// disables it
+	ResyncInterval time.Duration `yaml:"resync-interval" toml:"resync-interval" mapstructure:"resync-interval"`
 	Enabled        bool
 }
 
+// Discovery providers, that find the endpoints of an upstream host
+const (
+	// ProviderDocker finds containers with the docker lookup config
+	ProviderDocker = "docker"
+	// ProviderStatic uses a fixed list of endpoints
+	ProviderStatic = "static"
+	// ProviderDNS looks up A and AAAA records, or SRV records for hosts
+	// starting with an underscore, again when they expire. Names that
+	// aren't used for a while stop being looked up. The system dns is used
+	// until the first lookup is done
+	ProviderDNS = "dns"
+	// ProviderFile reads endpoints from a file, reloaded when it changes
+	ProviderFile = "file"
+)
+
+// DiscoveryConfig resolves the host of an upstream url with a discovery
+// provider instead of the system dns
+type DiscoveryConfig struct {
+	// Provider is docker, static, dns or file. Docker is also used when the
+	// docker lookup config is enabled
+	Provider string
+	// Endpoints are the host:port addresses of the static provider
+	Endpoints []string
+	// File lists the endpoints of the file provider, one host followed by
+	// its host:port addresses per line
+	File string
+	// DNSServer is the host:port of the server used by the dns provider,
+	// defaults to the first nameserver in /etc/resolv.conf
+	DNSServer string `yaml:"dns-server" toml:"dns-server" mapstructure:"dns-server"`
+	// Balance picks among the endpoints, either round-robin (the default)
+	// or random
+	Balance string
+}
+
+// provider returns the provider used, taking the docker lookup config into
+// account. It is empty when discovery is disabled
+func (c *DiscoveryConfig) provider(lookup DockerLookupConfig) string {
+	if c.Provider == "" && lookup.Enabled {
+		return ProviderDocker
+	}
+	return c.Provider
+}
+
 type PrimaryConfig struct {
 	URL             string
 	Headers         []Header
 	DoMirrorHeaders bool `yaml:"do-mirror-headers" toml:"do-mirror-headers" mapstructure:"do-mirror-headers"`
 	DoMirrorBody    bool `yaml:"do-mirror-body" toml:"do-mirror-body" mapstructure:"do-mirror-body"`
-	// Lookup the domain in docker based on HostIdentifier
+	// Lookup the domain in docker based on container labels or HostIdentifier
 	DockerLookup DockerLookupConfig `yaml:"docker-lookup-config" toml:"docker-lookup-config" mapstructure:"docker-lookup-config"`
+	TLS          UpstreamTLSConfig
+	// H2C speaks cleartext HTTP/2 (prior knowledge) to an http:// primary,
+	// and HTTP/2 over tls with the TLS settings to an https:// one
+	H2C       bool `yaml:"h2c" toml:"h2c" mapstructure:"h2c"`
+	Discovery DiscoveryConfig
+}
+
+// TLSConfig configures TLS termination on the gomirror listener
+type TLSConfig struct {
+	Enabled  bool
+	CertFile string `yaml:"cert-file" toml:"cert-file" mapstructure:"cert-file"`
+	KeyFile  string `yaml:"key-file" toml:"key-file" mapstructure:"key-file"`
+	// MinVersion is one of 1.0, 1.1, 1.2 or 1.3
+	MinVersion   string   `yaml:"min-version" toml:"min-version" mapstructure:"min-version"`
+	CipherSuites []string `yaml:"cipher-suites" toml:"cipher-suites" mapstructure:"cipher-suites"`
+	// ClientCAFile enables client certificate verification (mTLS) when set
+	ClientCAFile string `yaml:"client-ca-file" toml:"client-ca-file" mapstructure:"client-ca-file"`
+	// ClientAuth is one of none, request, require, verify-if-given or
+	// require-and-verify. Defaults to require-and-verify when ClientCAFile is set
+	ClientAuth string `yaml:"client-auth" toml:"client-auth" mapstructure:"client-auth"`
+}
+
+// Modes gomirror can run in
+const (
+	// ModeHTTP proxies and mirrors http requests
+	ModeHTTP = "http"
+	// ModeTCP proxies raw tcp connections to Primary.URL and copies the
+	// client stream to Mirror.URL, both in the form tcp://host:port
+	ModeTCP = "tcp"
+)
+
+// HealthConfig configures the /healthz and /readyz endpoints of gomirror
+// itself
+type HealthConfig struct {
+	// AdminPort serves the endpoints, and the learned diff noise, on their
+	// own port. Without it the paths are reserved on the proxy port, which
+	// isn't possible in tcp mode
+	AdminPort int `yaml:"admin-port" toml:"admin-port" mapstructure:"admin-port"`
+	// PrimaryPath is requested on the primary by readiness checks, which
+	// fail when it errors or responds with a 5xx. Defaults to /
+	PrimaryPath string `yaml:"primary-path" toml:"primary-path" mapstructure:"primary-path"`
+	// MaxSyncAge is how long the docker resolver may fail to look up
+	// containers before readiness fails. Defaults to 3 minutes
+	MaxSyncAge time.Duration `yaml:"max-sync-age" toml:"max-sync-age" mapstructure:"max-sync-age"`
 }
 
 // Config represents all the config for gomirror
 type Config struct {
 	ConfigFile string `yaml:"file" toml:"file" mapstructure:"file"`
 	Port       int
-	Mirror     MirrorConfig
-	Primary    PrimaryConfig
-	LogLevel   string `yaml:"log-level" toml:"log-level" mapstructure:"log-level"`
-	LogFile    string `yaml:"log-file" toml:"log-file" mapstructure:"log-file"`
-	viper      *viper.Viper
+	// Mode is either http (the default) or tcp
+	Mode string
+	TLS  TLSConfig
+	// H2C accepts cleartext HTTP/2 on the listener, HTTP/2 is always
+	// negotiated when TLS is enabled
+	H2C      bool `yaml:"h2c" toml:"h2c" mapstructure:"h2c"`
+	Mirror   MirrorConfig
+	Primary  PrimaryConfig
+	LogLevel string `yaml:"log-level" toml:"log-level" mapstructure:"log-level"`
+	LogFile  string `yaml:"log-file" toml:"log-file" mapstructure:"log-file"`
+	Health   HealthConfig
+	viper    *viper.Viper
+	etcd     *etcdSource
+	// interpolationErrs are references that couldn't be resolved, reported
+	// by Validate
+	interpolationErrs ValidationError
+	// secretPaths are fields that were expanded from a secret
+	secretPaths map[string]bool
 }
 
 func parsedHTTPHeaders(headers []Header) http.Header {
@@ -65,6 +309,162 @@ func (c *PrimaryConfig) HTTPHeaders() http.Header {
 	return parsedHTTPHeaders(c.Headers)
 }
 
+// copy returns a copy of c that shares none of its lists or maps, so that
+// options changing the copy leave c as it is. The viper instance and the
+// etcd source are shared, so the copy reports the reload errors of a Watch
+// on c
+func (c *Config) copy() *Config {
+	copied := *c
+	copied.TLS.CipherSuites = copyStrings(c.TLS.CipherSuites)
+	copied.Primary.Headers = copyHeaders(c.Primary.Headers)
+	copied.Primary.Discovery.Endpoints = copyStrings(c.Primary.Discovery.Endpoints)
+	copied.Mirror.Headers = copyHeaders(c.Mirror.Headers)
+	copied.Mirror.Discovery.Endpoints = copyStrings(c.Mirror.Discovery.Endpoints)
+	copied.Mirror.GRPC.Methods = copyStrings(c.Mirror.GRPC.Methods)
+	copied.Mirror.GRPC.StreamMethods = copyStrings(c.Mirror.GRPC.StreamMethods)
+	copied.Mirror.Diff.SecondaryMethods = copyStrings(c.Mirror.Diff.SecondaryMethods)
+
+	if c.secretPaths != nil {
+		copied.secretPaths = make(map[string]bool, len(c.secretPaths))
+		for path, secret := range c.secretPaths {
+			copied.secretPaths[path] = secret
+		}
+	}
+
+	if c.Mirror.Diff.Compare != nil {
+		copied.Mirror.Diff.Compare = make([]CompareConfig, len(c.Mirror.Diff.Compare))
+		for i, compare := range c.Mirror.Diff.Compare {
+			compare.Ignore = copyStrings(compare.Ignore)
+			compare.Headers = copyStrings(compare.Headers)
+			if compare.Unordered != nil {
+				compare.Unordered = append([]UnorderedArray{}, compare.Unordered...)
+			}
+			copied.Mirror.Diff.Compare[i] = compare
+		}
+	}
+	return &copied
+}
+
+func copyStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append([]string{}, s...)
+}
+
+func copyHeaders(headers []Header) []Header {
+	if headers == nil {
+		return nil
+	}
+	return append([]Header{}, headers...)
+}
+
+// EnvPrefix is the prefix of the environment variables that set config
+// fields, eg GOMIRROR_MIRROR_URL sets mirror.url
+const EnvPrefix = "GOMIRROR"
+
+var envNameReplacer = strings.NewReplacer(".", "_", "-", "_")
+
+// EnvName returns the environment variable that sets the config field at
+// path, eg primary.do-mirror-body is set by GOMIRROR_PRIMARY_DO_MIRROR_BODY
+func EnvName(path string) string {
+	return EnvPrefix + "_" + strings.ToUpper(envNameReplacer.Replace(path))
+}
+
+// headerPaths are lists of key=value pairs in the environment and flags,
+// they are merged with the config file by InitConfig instead of replacing it
+var headerPaths = map[string]bool{
+	"primary.headers": true,
+	"mirror.headers":  true,
+}
+
+// bindEnv binds every config field, other than headers, to its environment
+// variable. Values in the environment override the config file and etcd,
+// and are overridden by flags. Lists are comma separated and replace the
+// list in the config file
+func bindEnv(v *viper.Viper) {
+	fields := []DescribedValue{}
+	leafValues(reflect.ValueOf(Config{}), "", &fields)
+
+	for _, field := range fields {
+		if !headerPaths[field.Path] {
+			v.BindEnv(field.Path, EnvName(field.Path))
+		}
+	}
+}
+
+// splitHeaderList splits the headers set in the environment, one per line
+// as header values can't contain newlines but can contain commas
+func splitHeaderList(value string) []string {
+	list := []string{}
+	for _, line := range strings.Split(value, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			list = append(list, line)
+		}
+	}
+	return list
+}
+
+// flagList returns the values of a string array flag. Viper returns those
+// flags as their string, the values quoted as csv in brackets, eg
+// [a=b,"c=d,e"]
+func flagList(v *viper.Viper, key string) []string {
+	switch value := v.Get(key).(type) {
+	case []string:
+		return value
+	case string:
+		if !strings.HasPrefix(value, "[") || !strings.HasSuffix(value, "]") {
+			return splitHeaderList(value)
+		}
+
+		value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+		if value == "" {
+			return nil
+		}
+		list, err := csv.NewReader(strings.NewReader(value)).Read()
+		if err != nil {
+			return []string{value}
+		}
+		return list
+	}
+	return nil
+}
+
+// parseHeaderPairs parses headers in the form key=value, skipping anything
+// else
+func parseHeaderPairs(pairs []string) []Header {
+	headers := []Header{}
+	for _, kvPair := range pairs {
+		pair := strings.SplitN(strings.TrimSpace(kvPair), "=", 2)
+		if len(pair) < 2 {
+			continue
+		}
+		headers = append(headers, Header{
+			Key:   pair[0],
+			Value: pair[1],
+		})
+	}
+	return headers
+}
+
+// mergeHeaders overrides the headers in base with the headers in layer that
+// have the same key, and appends the rest
+func mergeHeaders(base []Header, layer []Header) []Header {
+	for _, header := range layer {
+		replaced := false
+		for i := range base {
+			if http.CanonicalHeaderKey(base[i].Key) == http.CanonicalHeaderKey(header.Key) {
+				base[i].Value = header.Value
+				replaced = true
+			}
+		}
+		if !replaced {
+			base = append(base, header)
+		}
+	}
+	return base
+}
+
 // Option configures the configuration struct
 type Option func(opt *Config) error
 
@@ -100,6 +500,8 @@ func InitConfig(opts ...Option) (*Config, error) {
 	}
 
 	viper := cfg.viper
+	bindEnv(viper)
+
 	if cfg.ConfigFile != "" {
 		viper.SetConfigFile(cfg.ConfigFile)
 		if err := viper.ReadInConfig(); err != nil {
@@ -107,40 +509,61 @@ func InitConfig(opts ...Option) (*Config, error) {
 		}
 	}
 
+	if cfg.etcd != nil {
+		if err := cfg.etcd.merge(viper, cfg.ConfigFile != ""); err != nil {
+			return cfg, err
+		}
+	}
+
+	configFile := cfg.ConfigFile
 	if err := viper.Unmarshal(cfg); err != nil {
 		return cfg, err
 	}
+	// keep the file that was read, the file flag may be unset
+	cfg.ConfigFile = configFile
 
-	if viper.ConfigFileUsed() == "" {
-		//try and parse headers
-		for _, kvPair := range viper.GetStringSlice("primary-headers") {
-			pair := strings.SplitN(kvPair, "=", 2)
-			if len(pair) < 2 {
-				continue
-			}
-			key := pair[0]
-			value := pair[1]
-			cfg.Primary.Headers = append(cfg.Primary.Headers, Header{
-				Key:   key,
-				Value: value,
-			})
-		}
+	// headers set in the environment, then with flags, are merged with the
+	// headers from the config file
+	for _, layer := range [][]string{
+		splitHeaderList(os.Getenv(EnvName("primary.headers"))),
+		flagList(viper, "primary-headers"),
+	} {
+		cfg.Primary.Headers = mergeHeaders(cfg.Primary.Headers, parseHeaderPairs(layer))
+	}
 
-		for _, kvPair := range viper.GetStringSlice("mirror-headers") {
-			pair := strings.SplitN(kvPair, "=", 2)
-			if len(pair) < 2 {
-				continue
-			}
-			key := pair[0]
-			value := pair[1]
-			cfg.Mirror.Headers = append(cfg.Mirror.Headers, Header{
-				Key:   key,
-				Value: value,
-			})
-		}
+	for _, layer := range [][]string{
+		splitHeaderList(os.Getenv(EnvName("mirror.headers"))),
+		flagList(viper, "mirror-headers"),
+	} {
+		cfg.Mirror.Headers = mergeHeaders(cfg.Mirror.Headers, parseHeaderPairs(layer))
+	}
+
+	// expand ${ENV_VAR}, ${ENV_VAR:-default} and ${file:/path} references
+	interpolated := interpolateFields(cfg)
+	cfg.interpolationErrs = interpolated.errs
+	cfg.secretPaths = interpolated.secrets
+
+	if cfg.Port == 0 {
+		cfg.Port = 80
+	}
+
+	if cfg.Mode == "" {
+		cfg.Mode = ModeHTTP
+	}
+
+	// a cert and key enable tls, unless it is disabled explicitly
+	if cfg.TLS.CertFile != "" && cfg.TLS.KeyFile != "" && !viper.IsSet("tls.enabled") {
+		cfg.TLS.Enabled = true
 	}
 
-	switch strings.ToLower(cfg.LogLevel) {
+	return cfg, nil
+}
+
+// SetupLogging sets the level and output of the standard logger from the
+// config. It is called once at startup, the log file is kept open for the
+// life of the process and changes need a restart
+func (c *Config) SetupLogging() error {
+	switch strings.ToLower(c.LogLevel) {
 	case "debug":
 		logrus.SetLevel(logrus.DebugLevel)
 	case "warn":
@@ -149,19 +572,15 @@ func InitConfig(opts ...Option) (*Config, error) {
 		logrus.SetLevel(logrus.ErrorLevel)
 	}
 
-	if cfg.Port == 0 {
-		cfg.Port = 80
+	if c.LogFile == "" {
+		return nil
 	}
 
-	if cfg.LogFile != "" {
-		f, err := os.OpenFile(cfg.LogFile, os.O_WRONLY|os.O_CREATE, 0755)
-		if err != nil {
-			logrus.WithError(err).
-				Errorln("error opening log file")
-		}
-		logrus.SetOutput(f)
-		logrus.WithField("file", cfg.LogFile).Infoln("using file output")
+	f, err := os.OpenFile(c.LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
 	}
-
-	return cfg, nil
+	logrus.SetOutput(f)
+	logrus.WithField("file", c.LogFile).Infoln("using file output")
+	return nil
 }
@@ -1,11 +1,16 @@
 package mirror
 
 import (
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
@@ -85,3 +90,179 @@ func TestConfigFlags(t *testing.T) {
 	primaryHeaders := cfg.Primary.HTTPHeaders()
 	assert.Equal(t, testPrimaryHeaders, primaryHeaders)
 }
+
+func TestConfigHeaderFlags(t *testing.T) {
+	flags := pflag.NewFlagSet("gomirror", pflag.ContinueOnError)
+	flags.StringArray("mirror-headers", []string{}, "")
+	assert.NoError(t, flags.Parse([]string{
+		"--mirror-headers", "Accept=text/html,application/json",
+		"--mirror-headers", "X-Mirror-Header=example-header",
+	}))
+
+	v := viper.New()
+	v.BindPFlag("mirror-headers", flags.Lookup("mirror-headers"))
+
+	// headers in the environment are one per line, values can have commas
+	os.Setenv("GOMIRROR_PRIMARY_HEADERS", "X-Primary-Header=example-header\nX-Forwarded-For=10.0.0.1, 10.0.0.2\n")
+	defer os.Unsetenv("GOMIRROR_PRIMARY_HEADERS")
+
+	cfg, err := InitConfig(WithViper(v))
+	assert.NoError(t, err)
+
+	assert.Equal(t, []Header{
+		{Key: "Accept", Value: "text/html,application/json"},
+		{Key: "X-Mirror-Header", Value: "example-header"},
+	}, cfg.Mirror.Headers)
+	assert.Equal(t, []Header{
+		{Key: "X-Primary-Header", Value: "example-header"},
+		{Key: "X-Forwarded-For", Value: "10.0.0.1, 10.0.0.2"},
+	}, cfg.Primary.Headers)
+}
+
+var testInterpolatedConfig = `
+mirror:
+  url: ${GOMIRROR_TEST_MIRROR_URL:-http://mirror.internal}
+  headers:
+    - key: Authorization
+      value: Bearer ${file:%s}
+primary:
+  url: http://${GOMIRROR_TEST_PRIMARY_HOST}:8002
+  headers:
+    - key: X-Literal
+      value: $${NOT_EXPANDED}
+`
+
+func TestConfigInterpolation(t *testing.T) {
+	secretFile := "/tmp/gomirror_secret"
+	assert.NoError(t, ioutil.WriteFile(secretFile, []byte("s3cr3t\n"), 0600))
+	defer os.Remove(secretFile)
+
+	cfgFile := "/tmp/gomirror_interpolated.yaml"
+	err := ioutil.WriteFile(cfgFile, []byte(fmt.Sprintf(testInterpolatedConfig, secretFile)), 0644)
+	assert.NoError(t, err)
+	defer os.Remove(cfgFile)
+
+	os.Setenv("GOMIRROR_TEST_PRIMARY_HOST", "primary.internal")
+	defer os.Unsetenv("GOMIRROR_TEST_PRIMARY_HOST")
+
+	cfg, err := InitConfig(WithViper(viper.New()), WithConfigFile(cfgFile))
+	assert.NoError(t, err)
+	assert.NoError(t, cfg.Validate())
+
+	assert.Equal(t, "http://mirror.internal", cfg.Mirror.URL)
+	assert.Equal(t, "Bearer s3cr3t", cfg.Mirror.Headers[0].Value)
+	assert.Equal(t, "http://primary.internal:8002", cfg.Primary.URL)
+	assert.Equal(t, "${NOT_EXPANDED}", cfg.Primary.Headers[0].Value)
+
+	// unresolved references are reported by Validate
+	os.Unsetenv("GOMIRROR_TEST_PRIMARY_HOST")
+	os.Remove(secretFile)
+
+	cfg, err = InitConfig(WithViper(viper.New()), WithConfigFile(cfgFile))
+	assert.NoError(t, err)
+
+	err = cfg.Validate()
+	assert.Error(t, err)
+	assert.Equal(t, "mirror.headers[0].value", err.(ValidationError)[0].Field)
+	assert.Equal(t, "primary.url", err.(ValidationError)[1].Field)
+	assert.Contains(t, err.Error(), "GOMIRROR_TEST_PRIMARY_HOST is not set")
+}
+
+var testLayeredConfig = `
+port: 8080
+log-level: info
+mirror:
+  url: http://mirror.internal
+  headers:
+    - key: X-Mirror-Header
+      value: from-file
+    - key: X-Env-Header
+      value: from-file
+primary:
+  url: http://127.0.0.1:8002
+  do-mirror-body: true
+`
+
+func TestConfigLayers(t *testing.T) {
+	cfgFile := "/tmp/gomirror_layered.yaml"
+	assert.NoError(t, ioutil.WriteFile(cfgFile, []byte(testLayeredConfig), 0644))
+	defer os.Remove(cfgFile)
+
+	env := map[string]string{
+		"GOMIRROR_PORT":                   "9000",
+		"GOMIRROR_LOG_LEVEL":              "warn",
+		"GOMIRROR_PRIMARY_DO_MIRROR_BODY": "false",
+		"GOMIRROR_MIRROR_GRPC_METHODS":    "/svc.A/Get,/svc.B/*",
+		"GOMIRROR_MIRROR_HEADERS":         "X-Env-Header=from-env\nX-Added=from-env",
+
+		"GOMIRROR_PRIMARY_DOCKER_LOOKUP_CONFIG_RESYNC_INTERVAL": "30s",
+	}
+	for key, value := range env {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+
+	v := viper.New()
+	v.Set("log-level", "debug")
+	v.Set("mirror-headers", []string{"X-Mirror-Header=from-flag"})
+
+	cfg, err := InitConfig(WithViper(v), WithConfigFile(cfgFile))
+	assert.NoError(t, err)
+
+	// env overrides the file, flags override env
+	assert.Equal(t, 9000, cfg.Port)
+	assert.Equal(t, "debug", cfg.LogLevel)
+	assert.False(t, cfg.Primary.DoMirrorBody)
+	assert.Equal(t, "http://mirror.internal", cfg.Mirror.URL)
+	assert.Equal(t, []string{"/svc.A/Get", "/svc.B/*"}, cfg.Mirror.GRPC.Methods)
+	assert.Equal(t, 30*time.Second, cfg.Primary.DockerLookup.ResyncInterval)
+
+	// headers are merged by key
+	assert.Equal(t, []Header{
+		{Key: "X-Mirror-Header", Value: "from-flag"},
+		{Key: "X-Env-Header", Value: "from-env"},
+		{Key: "X-Added", Value: "from-env"},
+	}, cfg.Mirror.Headers)
+}
+
+func TestConfigTLS(t *testing.T) {
+	v := viper.New()
+	v.Set("tls.cert-file", "/etc/gomirror/cert.pem")
+	v.Set("tls.key-file", "/etc/gomirror/key.pem")
+
+	// a cert and key enable tls
+	cfg, err := InitConfig(WithViper(v))
+	assert.NoError(t, err)
+	assert.True(t, cfg.TLS.Enabled)
+
+	// unless it is disabled
+	v.Set("tls.enabled", false)
+	cfg, err = InitConfig(WithViper(v))
+	assert.NoError(t, err)
+	assert.False(t, cfg.TLS.Enabled)
+}
+
+func TestSetupLogging(t *testing.T) {
+	f, err := ioutil.TempFile("", "gomirror-log")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString("previous line\n")
+	f.Close()
+
+	defer logrus.SetOutput(os.Stderr)
+	defer logrus.SetLevel(logrus.GetLevel())
+
+	cfg := &Config{LogLevel: "warn", LogFile: f.Name()}
+	assert.NoError(t, cfg.SetupLogging())
+	assert.Equal(t, logrus.WarnLevel, logrus.GetLevel())
+	logrus.Warnln("logged to the file")
+
+	// the log file is appended to
+	data, err := ioutil.ReadFile(f.Name())
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(data), "previous line\n"))
+	assert.Contains(t, string(data), "logged to the file")
+
+	cfg.LogFile = "/nonexistent/gomirror.log"
+	assert.Error(t, cfg.SetupLogging())
+}
@@ -0,0 +1,189 @@
+package mirror
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// DefaultMaxDecodedSize is the most a body is inflated to before it is
+// compared, unless DiffConfig.MaxDecodedSize is set
+const DefaultMaxDecodedSize = 10 << 20
+
+// decodeContent removes the content encodings of a body, applied in the
+// order of the Content-Encoding header. It fails when the body inflates
+// to more than limit bytes
+func decodeContent(header http.Header, body []byte, limit int64) ([]byte, error) {
+	encodings := strings.Split(header.Get("Content-Encoding"), ",")
+	for i := len(encodings) - 1; i >= 0; i-- {
+		var r io.Reader
+		var err error
+
+		switch encoding := strings.ToLower(strings.TrimSpace(encodings[i])); encoding {
+		case "", "identity":
+			continue
+		case "gzip", "x-gzip":
+			r, err = gzip.NewReader(bytes.NewReader(body))
+		case "deflate":
+			r, err = zlib.NewReader(bytes.NewReader(body))
+		case "br":
+			r = brotli.NewReader(bytes.NewReader(body))
+		default:
+			return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if body, err = ioutil.ReadAll(io.LimitReader(r, limit+1)); err != nil {
+			return nil, err
+		}
+		if int64(len(body)) > limit {
+			return nil, fmt.Errorf("decoded body is longer than %d bytes", limit)
+		}
+	}
+	return body, nil
+}
+
+// protobufTypes are the content types of protobuf bodies
+var protobufTypes = map[string]bool{
+	"application/protobuf":            true,
+	"application/x-protobuf":          true,
+	"application/vnd.google.protobuf": true,
+	"application/octet-stream":        true,
+}
+
+// body decodes the body of res, and parses it by its content type into
+// values compared like json: maps, arrays, strings, numbers, bools and nil.
+// ok is false when the body is compared as text, as it is when it can't
+// be decoded
+func (c *Comparator) body(res *CapturedResponse) (tree interface{}, text []byte, ok bool) {
+	text, err := decodeContent(res.Header, res.Body, c.decodeLimit())
+	if err != nil {
+		return nil, res.Body, false
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	switch {
+	case c.message != nil && (mediaType == "" || protobufTypes[mediaType]):
+		tree, err = c.message.decode(text)
+	case mediaType == "" || mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		tree, err = parseJSON(text)
+	case mediaType == "application/xml" || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml"):
+		tree, err = parseXML(text)
+	case mediaType == "application/x-www-form-urlencoded":
+		tree, err = parseForm(text)
+	default:
+		return nil, text, false
+	}
+	return tree, text, err == nil
+}
+
+func parseJSON(body []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	var tree interface{}
+	if err := decoder.Decode(&tree); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after json value")
+	}
+	return tree, nil
+}
+
+// parseForm parses a form body, values are strings unless a field is
+// repeated
+func parseForm(body []byte) (interface{}, error) {
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+
+	tree := map[string]interface{}{}
+	for key, value := range values {
+		if len(value) == 1 {
+			tree[key] = value[0]
+			continue
+		}
+
+		list := []interface{}{}
+		for _, v := range value {
+			list = append(list, v)
+		}
+		tree[key] = list
+	}
+	return tree, nil
+}
+
+// parseXML parses an xml body. Elements are maps of their attributes, as
+// @name, their child elements, which are arrays when repeated, and their
+// text, as #text
+func parseXML(body []byte) (interface{}, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+
+	root := map[string]interface{}{}
+	stack := []map[string]interface{}{root}
+	text := []*strings.Builder{{}}
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch token := token.(type) {
+		case xml.StartElement:
+			element := map[string]interface{}{}
+			for _, attr := range token.Attr {
+				element["@"+attr.Name.Local] = attr.Value
+			}
+
+			addXMLChild(stack[len(stack)-1], token.Name.Local, element)
+			stack = append(stack, element)
+			text = append(text, &strings.Builder{})
+		case xml.EndElement:
+			if len(stack) == 1 {
+				return nil, fmt.Errorf("unexpected end element %s", token.Name.Local)
+			}
+
+			if s := strings.TrimSpace(text[len(text)-1].String()); s != "" {
+				stack[len(stack)-1]["#text"] = s
+			}
+			stack, text = stack[:len(stack)-1], text[:len(text)-1]
+		case xml.CharData:
+			text[len(text)-1].Write(token)
+		}
+	}
+
+	if len(stack) != 1 || len(root) == 0 {
+		return nil, fmt.Errorf("invalid xml document")
+	}
+	return root, nil
+}
+
+// addXMLChild adds a child element, turning repeated elements into arrays
+func addXMLChild(parent map[string]interface{}, name string, child map[string]interface{}) {
+	switch existing := parent[name].(type) {
+	case nil:
+		parent[name] = child
+	case []interface{}:
+		parent[name] = append(existing, child)
+	default:
+		parent[name] = []interface{}{existing, child}
+	}
+}
@@ -0,0 +1,168 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// Sources of a config value, as reported by Describe
+const (
+	SourceDefault = "default"
+	SourceFile    = "file"
+	SourceEtcd    = "etcd"
+	SourceEnv     = "env"
+	SourceFlag    = "flag"
+)
+
+const maskedValue = "******"
+
+// DescribedValue is a resolved config value and the source that set it
+type DescribedValue struct {
+	Path   string      `json:"path"`
+	Value  interface{} `json:"value"`
+	Source string      `json:"source"`
+	// Note explains surprising resolutions, eg headers merged from several
+	// sources
+	Note string `json:"note,omitempty"`
+}
+
+// Bindings maps config paths (eg mirror.url) to the flags, and environment
+// variables other than the GOMIRROR_ ones, that can set them
+type Bindings struct {
+	Flags map[string]*pflag.Flag
+	Env   map[string]string
+}
+
+func hasSetting(settings map[string]interface{}, path string) bool {
+	keys := strings.Split(path, ".")
+	for i, key := range keys {
+		value, ok := settings[key]
+		if !ok {
+			return false
+		}
+		if i == len(keys)-1 {
+			return true
+		}
+		if settings, ok = value.(map[string]interface{}); !ok {
+			return false
+		}
+	}
+	return false
+}
+
+// leafValues lists the fields of v that aren't structs, in declaration order
+func leafValues(v reflect.Value, path string, values *[]DescribedValue) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		fieldPath := fieldName(field)
+		if path != "" {
+			fieldPath = path + "." + fieldPath
+		}
+
+		if field.Type.Kind() == reflect.Struct {
+			leafValues(v.Field(i), fieldPath, values)
+			continue
+		}
+
+		*values = append(*values, DescribedValue{Path: fieldPath, Value: v.Field(i).Interface()})
+	}
+}
+
+func (c *Config) maskHeaders(path string, headers []Header) []map[string]string {
+	masked := make([]map[string]string, len(headers))
+	for i, header := range headers {
+		value := header.Value
+		if isSensitiveName(header.Key) || c.secretPaths[fmt.Sprintf("%s[%d].value", path, i)] {
+			value = maskedValue
+		}
+		masked[i] = map[string]string{"key": header.Key, "value": value}
+	}
+	return masked
+}
+
+// Describe lists every config value with the source that set it: a flag,
+// an environment variable, etcd, the config file or the default, in order
+// of precedence. Secrets
+// such as sensitive header values and values read from secret files are
+// masked
+func (c *Config) Describe(bindings Bindings) ([]DescribedValue, error) {
+	fileSettings := map[string]interface{}{}
+	if c.ConfigFile != "" {
+		fileViper := viper.New()
+		fileViper.SetConfigFile(c.ConfigFile)
+		if err := fileViper.ReadInConfig(); err != nil {
+			return nil, err
+		}
+		fileSettings = fileViper.AllSettings()
+	}
+
+	etcdSettings := map[string]interface{}{}
+	if c.etcd != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+		defer cancel()
+
+		settings, err := c.etcd.load(ctx)
+		if err != nil {
+			return nil, err
+		}
+		etcdSettings = settings
+	}
+
+	values := []DescribedValue{}
+	leafValues(reflect.ValueOf(*c), "", &values)
+
+	for i := range values {
+		value := &values[i]
+
+		flag, hasFlag := bindings.Flags[value.Path]
+		flagSet := hasFlag && flag.Changed
+
+		envSet := os.Getenv(EnvName(value.Path)) != ""
+		if name := bindings.Env[value.Path]; name != "" && os.Getenv(name) != "" {
+			envSet = true
+		}
+
+		// headers are merged from every layer, so every source is listed
+		sources := []string{}
+		for _, layer := range []struct {
+			source string
+			set    bool
+		}{
+			{SourceFlag, flagSet},
+			{SourceEnv, envSet},
+			{SourceEtcd, hasSetting(etcdSettings, value.Path)},
+			{SourceFile, hasSetting(fileSettings, value.Path)},
+		} {
+			if layer.set {
+				sources = append(sources, layer.source)
+			}
+		}
+
+		value.Source = SourceDefault
+		if len(sources) > 0 {
+			value.Source = sources[0]
+		}
+
+		if headerPaths[value.Path] && len(sources) > 1 {
+			value.Note = "merged from " + strings.Join(sources, ", ")
+		}
+
+		if headers, ok := value.Value.([]Header); ok {
+			value.Value = c.maskHeaders(value.Path, headers)
+		} else if c.secretPaths[value.Path] {
+			value.Value = maskedValue
+		}
+	}
+
+	return values, nil
+}
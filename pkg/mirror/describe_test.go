@@ -0,0 +1,80 @@
+package mirror
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+var testDescribeConfig = `
+port: 8080
+mirror:
+  url: http://mirror.internal
+  headers:
+    - key: Authorization
+      value: Bearer abc
+    - key: X-Env
+      value: ${GOMIRROR_TEST_TOKEN}
+primary:
+  url: http://127.0.0.1:8002
+`
+
+func describedValues(values []DescribedValue) map[string]DescribedValue {
+	m := make(map[string]DescribedValue, len(values))
+	for _, value := range values {
+		m[value.Path] = value
+	}
+	return m
+}
+
+func TestDescribe(t *testing.T) {
+	cfgFile := "/tmp/gomirror_describe.yaml"
+	assert.NoError(t, ioutil.WriteFile(cfgFile, []byte(testDescribeConfig), 0644))
+	defer os.Remove(cfgFile)
+
+	os.Setenv("GOMIRROR_TEST_TOKEN", "t0ken")
+	defer os.Unsetenv("GOMIRROR_TEST_TOKEN")
+
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.IntP("port", "P", 80, "")
+	flags.StringP("mirror-headers", "x", "", "")
+	flags.StringP("log-level", "l", "info", "")
+	assert.NoError(t, flags.Parse([]string{"--port", "9000", "--mirror-headers", "a=b"}))
+
+	v := viper.New()
+	v.BindPFlag("port", flags.Lookup("port"))
+	v.BindPFlag("mirror-headers", flags.Lookup("mirror-headers"))
+
+	cfg, err := InitConfig(WithViper(v), WithConfigFile(cfgFile))
+	assert.NoError(t, err)
+
+	values, err := cfg.Describe(Bindings{
+		Flags: map[string]*pflag.Flag{
+			"port":           flags.Lookup("port"),
+			"mirror.headers": flags.Lookup("mirror-headers"),
+			"log-level":      flags.Lookup("log-level"),
+		},
+	})
+	assert.NoError(t, err)
+
+	described := describedValues(values)
+	assert.Equal(t, "file", values[0].Path)
+
+	assert.Equal(t, 9000, described["port"].Value)
+	assert.Equal(t, SourceFlag, described["port"].Source)
+	assert.Equal(t, SourceFile, described["mirror.url"].Source)
+	assert.Equal(t, SourceDefault, described["log-level"].Source)
+
+	headers := described["mirror.headers"]
+	assert.Equal(t, SourceFlag, headers.Source)
+	assert.Equal(t, "merged from flag, file", headers.Note)
+	assert.Equal(t, []map[string]string{
+		{"key": "Authorization", "value": maskedValue},
+		{"key": "X-Env", "value": maskedValue},
+		{"key": "a", "value": "b"},
+	}, headers.Value)
+}
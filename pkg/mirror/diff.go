@@ -0,0 +1,442 @@
+package mirror
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// NoisePath serves the json fields learned as noise. It's only reserved on
+// the proxy port while diffing
+const NoisePath = "/gomirror/noise"
+
+const (
+	// diffStatus is the field reported when the status codes differ
+	diffStatus = "status"
+	// diffRoot is the path of the whole body, reported for bodies that
+	// can't be parsed
+	diffRoot = "$"
+)
+
+func sortedFields(fields map[string]bool) []string {
+	sorted := []string{}
+	for field := range fields {
+		sorted = append(sorted, field)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// covers reports whether the noise field covers field, either because it
+// is the same or one of its parents
+func covers(noise, field string) bool {
+	return noise == field ||
+		(noise != diffStatus && (strings.HasPrefix(field, noise+".") || strings.HasPrefix(field, noise+"[")))
+}
+
+// Defaults of the noise thresholds, used when they aren't set
+const (
+	DefaultNoiseSamples = 3
+	DefaultNoiseRatio   = 0.5
+)
+
+// noiseSet is the fields that differ between instances of the primary, by
+// route, saved to a file when it is set. Fields are only learned once they
+// differed in enough responses, counted in memory
+type noiseSet struct {
+	path string
+
+	mux     sync.RWMutex
+	routes  map[string]map[string]bool
+	samples map[string]*noiseSamples
+}
+
+// noiseSamples counts the secondary responses of a route, and the ones
+// each field that isn't learned yet differed in
+type noiseSamples struct {
+	total  int
+	fields map[string]int
+}
+
+// loadNoise returns the noise saved to path, which is empty when path
+// doesn't exist yet
+func loadNoise(path string) (*noiseSet, error) {
+	n := &noiseSet{
+		path:    path,
+		routes:  map[string]map[string]bool{},
+		samples: map[string]*noiseSamples{},
+	}
+	if path == "" {
+		return n, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return n, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	saved := map[string][]string{}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, err
+	}
+	for route, fields := range saved {
+		n.routes[route] = map[string]bool{}
+		for _, field := range fields {
+			n.routes[route][field] = true
+		}
+	}
+	return n, nil
+}
+
+// learnable reports whether a field can be learned as noise. The status
+// and the whole body are never noise, they would hide every difference
+func learnable(field string) bool {
+	return field != diffStatus && field != diffRoot
+}
+
+// learn counts a secondary response of route that differed from the
+// primary in fields, and learns the fields that differed in at least
+// samples responses and ratio of them. It returns the fields that are new,
+// the noise is saved when it changed
+func (n *noiseSet) learn(route string, fields []string, samples int, ratio float64) ([]string, error) {
+	if samples <= 0 {
+		samples = DefaultNoiseSamples
+	}
+	if ratio <= 0 {
+		ratio = DefaultNoiseRatio
+	}
+
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	seen := n.samples[route]
+	if seen == nil {
+		seen = &noiseSamples{fields: map[string]int{}}
+		n.samples[route] = seen
+	}
+	seen.total++
+
+	learned := []string{}
+	for _, field := range fields {
+		if !learnable(field) || n.routes[route][field] {
+			continue
+		}
+
+		seen.fields[field]++
+		count := seen.fields[field]
+		if count < samples || float64(count) < ratio*float64(seen.total) {
+			continue
+		}
+
+		if n.routes[route] == nil {
+			n.routes[route] = map[string]bool{}
+		}
+		n.routes[route][field] = true
+		delete(seen.fields, field)
+		learned = append(learned, field)
+	}
+
+	if len(learned) == 0 || n.path == "" {
+		return learned, nil
+	}
+	return learned, n.save()
+}
+
+// reset forgets the noise of route, or of every route when it is empty
+func (n *noiseSet) reset(route string) error {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	if route == "" {
+		n.routes = map[string]map[string]bool{}
+		n.samples = map[string]*noiseSamples{}
+	} else {
+		delete(n.routes, route)
+		delete(n.samples, route)
+	}
+
+	if n.path == "" {
+		return nil
+	}
+	return n.save()
+}
+
+// save writes the noise to the file, replacing it so that it is never
+// left half written. n.mux must be held
+func (n *noiseSet) save() error {
+	data, err := json.MarshalIndent(n.dumpLocked(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(n.path), filepath.Base(n.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), n.path)
+}
+
+// filter returns the fields that aren't covered by the noise of route
+func (n *noiseSet) filter(route string, fields []string) []string {
+	n.mux.RLock()
+	defer n.mux.RUnlock()
+
+	filtered := []string{}
+	for _, field := range fields {
+		noisy := false
+		for noise := range n.routes[route] {
+			if covers(noise, field) {
+				noisy = true
+				break
+			}
+		}
+		if !noisy {
+			filtered = append(filtered, field)
+		}
+	}
+	return filtered
+}
+
+func (n *noiseSet) dump() map[string][]string {
+	n.mux.RLock()
+	defer n.mux.RUnlock()
+	return n.dumpLocked()
+}
+
+func (n *noiseSet) dumpLocked() map[string][]string {
+	dump := map[string][]string{}
+	for route, fields := range n.routes {
+		dump[route] = sortedFields(fields)
+	}
+	return dump
+}
+
+// noiseSet returns the learned noise, loading it from path the first time.
+// Later paths are ignored, the noise is kept across config updates
+func (m *Mirror) noiseSet(path string) (*noiseSet, error) {
+	m.noiseMux.Lock()
+	defer m.noiseMux.Unlock()
+
+	if m.noise != nil {
+		return m.noise, nil
+	}
+
+	noise, err := loadNoise(path)
+	if err != nil {
+		return nil, err
+	}
+	m.noise = noise
+	return m.noise, nil
+}
+
+// Noise returns the json fields learned as noise, by method and route, eg
+// GET /items/:id
+func (m *Mirror) Noise() map[string][]string {
+	m.noiseMux.Lock()
+	noise := m.noise
+	m.noiseMux.Unlock()
+
+	if noise == nil {
+		return map[string][]string{}
+	}
+	return noise.dump()
+}
+
+// ResetNoise forgets the noise learned for route, eg GET /items/:id, or
+// for every route when it is empty
+func (m *Mirror) ResetNoise(route string) error {
+	m.noiseMux.Lock()
+	noise := m.noise
+	m.noiseMux.Unlock()
+
+	if noise == nil {
+		return nil
+	}
+	return noise.reset(route)
+}
+
+// NoiseHandler serves the noise learned for comparing responses as json.
+// DELETE resets the noise of the route query parameter, or of every route
+// without it
+func (m *Mirror) NoiseHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+		case http.MethodDelete:
+			if err := m.ResetNoise(r.URL.Query().Get("route")); err != nil {
+				m.log.WithError(err).Warnln("error saving noise")
+				http.Error(w, "error saving noise", http.StatusInternalServerError)
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, HEAD, DELETE")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(m.Noise())
+	})
+}
+
+// differ compares the mirror responses with the primary, ignoring the
+// noise learned from the secondary
+type differ struct {
+	cfg         *Config
+	client      *http.Client
+	comparators *Comparators
+	noise       *noiseSet
+	log         logrus.FieldLogger
+}
+
+func (m *Mirror) newDiffer(cfg *Config) (*differ, error) {
+	comparators, err := NewComparators(cfg.Mirror.Diff.Compare)
+	if err != nil {
+		return nil, err
+	}
+	comparators.setMaxDecoded(cfg.Mirror.Diff.MaxDecodedSize)
+
+	noise, err := m.noiseSet(cfg.Mirror.Diff.NoiseFile)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := upstreamTransport(&cfg.Primary.TLS, cfg.Primary.H2C, m.log)
+	if err != nil {
+		return nil, err
+	}
+
+	return &differ{
+		cfg: cfg,
+		client: &http.Client{
+			Timeout:   time.Minute * 1,
+			Transport: transport,
+		},
+		comparators: comparators,
+		noise:       noise,
+		log:         m.log,
+	}, nil
+}
+
+// defaultSecondaryMethods are the methods sent to the secondary unless
+// others are configured, the ones that don't change its data
+var defaultSecondaryMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+
+// sampled decides whether a compared request is also sent to the
+// secondary, by its method and the sample rate
+func (d *differ) sampled(method string) bool {
+	methods := d.cfg.Mirror.Diff.SecondaryMethods
+	if len(methods) == 0 {
+		methods = defaultSecondaryMethods
+	}
+
+	allowed := false
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			allowed = true
+			break
+		}
+	}
+
+	rate := d.cfg.Mirror.Diff.SampleRate
+	return allowed && (rate <= 0 || rate >= 1 || rand.Float64() < rate)
+}
+
+// secondaryRequest copies r, as it is sent to the primary, with the
+// primary headers, for the secondary. The body is copied from the buffered
+// body of proxyReq
+func (d *differ) secondaryRequest(r *http.Request, proxyReq *http.Request) (*http.Request, error) {
+	u := strings.TrimSuffix(d.cfg.Mirror.Diff.SecondaryURL, "/") + r.URL.EscapedPath()
+	if r.URL.RawQuery != "" {
+		u += "?" + r.URL.RawQuery
+	}
+
+	req, err := http.NewRequest(r.Method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header = r.Header.Clone()
+	for _, header := range d.cfg.Primary.Headers {
+		req.Header.Set(header.Key, header.Value)
+	}
+	if proxyReq.GetBody != nil {
+		if req.Body, err = proxyReq.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+// send sends a request to the secondary, the response is nil when it
+// failed
+func (d *differ) send(req *http.Request) *CapturedResponse {
+	entry := d.log.WithField("secondary_url", req.URL.String())
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		entry.WithError(err).Warnln("error in secondary request")
+		return nil
+	}
+	defer res.Body.Close()
+
+	body, truncated, err := readCaptured(res.Body, d.cfg.Mirror.captureLimit())
+	if err != nil {
+		entry.WithError(err).Warnln("error reading secondary response")
+		return nil
+	}
+
+	return &CapturedResponse{StatusCode: res.StatusCode, Header: res.Header, Body: body, Truncated: truncated}
+}
+
+// compare learns the noise from the secondary response, when there is one,
+// and logs the fields of the mirror response that differ from the primary
+// and aren't noise, with the comparator of the route
+func (d *differ) compare(method, path string, primary, mirror, secondary *CapturedResponse) {
+	route := method + " " + RouteOf(path)
+	entry := d.log.WithField("route", route)
+	comparator := d.comparators.For(method, path)
+
+	if secondary != nil {
+		diff := &d.cfg.Mirror.Diff
+		learned, err := d.noise.learn(route, comparator.Compare(primary, secondary), diff.NoiseSamples, diff.NoiseRatio)
+		if len(learned) > 0 {
+			entry.WithField("fields", learned).Infoln("learned noise")
+		}
+		if err != nil {
+			entry.WithError(err).Warnln("error saving noise")
+		}
+	}
+
+	if mirror == nil {
+		return
+	}
+
+	if fields := d.noise.filter(route, comparator.Compare(primary, mirror)); len(fields) > 0 {
+		entry.WithField("fields", fields).Warnln("mirror response differs from the primary")
+	}
+}
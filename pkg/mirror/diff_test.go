@@ -0,0 +1,218 @@
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNoiseSet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomirror-noise")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "noise.json")
+	noise, err := loadNoise(path)
+	assert.NoError(t, err)
+
+	// fields are learned once they differed in enough responses, the status
+	// and whole body never are
+	learned, err := noise.learn("GET /items", []string{"$.items", "$.time", "status", "$"}, 2, 0.5)
+	assert.NoError(t, err)
+	assert.Empty(t, learned)
+
+	learned, err = noise.learn("GET /items", []string{"$.items", "$.time", "status", "$"}, 2, 0.5)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"$.items", "$.time"}, learned)
+
+	learned, err = noise.learn("GET /items", []string{"$.time"}, 2, 0.5)
+	assert.NoError(t, err)
+	assert.Empty(t, learned)
+
+	// rare differences stay below the ratio
+	for i := 0; i < 3; i++ {
+		learned, err = noise.learn("GET /items", nil, 2, 0.5)
+		assert.NoError(t, err)
+	}
+	for i := 0; i < 2; i++ {
+		learned, err = noise.learn("GET /items", []string{"$.name"}, 2, 0.5)
+		assert.NoError(t, err)
+		assert.Empty(t, learned)
+	}
+
+	// parents cover their fields, and the noise only applies to its route
+	assert.Equal(t,
+		[]string{"$.name", "status"},
+		noise.filter("GET /items", []string{"$.items[*].id", "$.name", "$.time", "status"}),
+	)
+	assert.Equal(t, []string{"$.time"}, noise.filter("GET /users", []string{"$.time"}))
+
+	// the noise is kept across restarts
+	reloaded, err := loadNoise(path)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"GET /items": {"$.items", "$.time"}}, reloaded.dump())
+
+	assert.NoError(t, reloaded.reset("GET /users"))
+	assert.Equal(t, map[string][]string{"GET /items": {"$.items", "$.time"}}, reloaded.dump())
+	assert.NoError(t, reloaded.reset("GET /items"))
+	assert.Empty(t, reloaded.dump())
+	reloaded, err = loadNoise(path)
+	assert.NoError(t, err)
+	assert.Empty(t, reloaded.dump())
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("not json"), 0644))
+	_, err = loadNoise(path)
+	assert.Error(t, err)
+}
+
+// jsonItem responds with an item with a changing id and time
+func jsonItem(name string, ids *int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id":%d,"name":%q,"time":%q}`, atomic.AddInt32(ids, 1), name, time.Now().Format(time.RFC3339Nano))
+	})
+}
+
+func TestMirrorDiff(t *testing.T) {
+	ids := int32(0)
+	primary := httptest.NewServer(jsonItem("primary", &ids))
+	defer primary.Close()
+	secondaryRequests := make(chan *http.Request, 10)
+	secondaryItem := jsonItem("primary", &ids)
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secondaryRequests <- r
+		secondaryItem.ServeHTTP(w, r)
+	}))
+	defer secondary.Close()
+	mirrored := httptest.NewServer(jsonItem("mirror", &ids))
+	defer mirrored.Close()
+
+	logger, hook := test.NewNullLogger()
+	responses := make(chan struct{}, 1)
+	m, err := NewMirror(
+		WithConfig(&Config{
+			Primary: PrimaryConfig{
+				DoMirrorBody: true,
+				Headers:      []Header{{Key: "X-Env", Value: "primary"}},
+			},
+			Mirror: MirrorConfig{
+				Headers: []Header{{Key: "X-Env", Value: "mirror"}},
+				Diff:    DiffConfig{Enabled: true, SecondaryURL: secondary.URL, NoiseSamples: 1},
+			},
+		}),
+		WithPrimary(primary.URL),
+		WithMirrorTarget(mirrored.URL),
+		WithLogger(logger),
+		WithObserver(&ObserverFuncs{
+			MirrorResponse: func(req *http.Request, primary, mirror *CapturedResponse, err error, latency time.Duration) {
+				responses <- struct{}{}
+			},
+		}),
+	)
+	assert.NoError(t, err)
+
+	proxy := httptest.NewServer(m.withHealth(m))
+	defer proxy.Close()
+
+	// unsafe methods aren't sent to the secondary by default
+	res, err := http.Post(proxy.URL+"/items/1", "application/json", strings.NewReader(`{"name":"primary"}`))
+	assert.NoError(t, err)
+	res.Body.Close()
+
+	select {
+	case <-time.After(5 * time.Second):
+		panic("timed out waiting for mirror")
+	case <-responses:
+	}
+	assert.Empty(t, secondaryRequests)
+	assert.Empty(t, m.Noise())
+
+	res, err = http.Get(proxy.URL + "/items/1")
+	assert.NoError(t, err)
+	res.Body.Close()
+
+	select {
+	case <-time.After(5 * time.Second):
+		panic("timed out waiting for mirror")
+	case <-responses:
+	}
+
+	// the secondary gets the request as it is sent to the primary
+	secondaryReq := <-secondaryRequests
+	assert.Equal(t, "primary", secondaryReq.Header.Get("X-Env"))
+	assert.Equal(t, map[string][]string{"GET /items/:id": {"$.id", "$.time"}}, m.Noise())
+
+	var differs *logrus.Entry
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "mirror response differs from the primary" {
+			differs = entry
+		}
+	}
+	if assert.NotNil(t, differs) {
+		assert.Equal(t, []string{"$.name"}, differs.Data["fields"])
+	}
+
+	res, err = http.Get(proxy.URL + NoisePath)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	noise := map[string][]string{}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&noise))
+	assert.Equal(t, m.Noise(), noise)
+
+	req, err := http.NewRequest(http.MethodDelete, proxy.URL+NoisePath+"?route=GET+/items/:id", nil)
+	assert.NoError(t, err)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Empty(t, m.Noise())
+}
+
+func TestValidateDiff(t *testing.T) {
+	cfg := &Config{
+		Primary: PrimaryConfig{URL: "http://primary.internal", DoMirrorBody: true},
+		Mirror: MirrorConfig{
+			URL:  "http://mirror.internal",
+			Diff: DiffConfig{Enabled: true, SecondaryURL: "http://primary-2.internal", SampleRate: 0.5},
+		},
+	}
+	assert.NoError(t, cfg.Validate())
+
+	cfg.Primary.DoMirrorBody = false
+	cfg.Mirror.Diff.SecondaryURL = ""
+	cfg.Mirror.Diff.SampleRate = 2
+	cfg.Mirror.Diff.SecondaryMethods = []string{"GET", "NOT A METHOD"}
+	cfg.Mirror.Diff.NoiseRatio = 1.5
+	cfg.Mirror.Diff.Compare = []CompareConfig{
+		{Ignore: []string{"$.time"}},
+		{Route: "GET /items/:id", Tolerance: -1},
+	}
+	err := cfg.Validate()
+	assert.Error(t, err)
+
+	fields := []string{}
+	for _, fieldErr := range err.(ValidationError) {
+		fields = append(fields, fieldErr.Field)
+	}
+	assert.Equal(t, []string{
+		"mirror.diff.enabled",
+		"mirror.diff.secondary-url",
+		"mirror.diff.sample-rate",
+		"mirror.diff.secondary-methods[1]",
+		"mirror.diff.noise-ratio",
+		"mirror.diff.compare[0].route",
+		"mirror.diff.compare[1]",
+	}, fields)
+}
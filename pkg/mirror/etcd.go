@@ -0,0 +1,260 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+const etcdTimeout = 10 * time.Second
+
+// etcdRewatchDelay is the time waited before watching again after the
+// watch channel closes
+var etcdRewatchDelay = time.Second
+
+// etcdClient is the part of *clientv3.Client used to load and watch config
+type etcdClient interface {
+	Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error)
+	Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan
+}
+
+// etcdSource loads config from every key under prefix. The value of the
+// prefix key itself is a whole config document, and keys below it set a
+// single field, eg <prefix>/mirror/url. Values are yaml (or json). The
+// configs reloaded by Watch, and their copies, share the source of the
+// config that was loaded first
+type etcdSource struct {
+	client   etcdClient
+	prefix   string
+	revision int64
+	// log is where Watch logs, set by WithEtcdLogger
+	log logrus.FieldLogger
+
+	// reloadErr is the error of the last reload by Watch
+	mux       sync.Mutex
+	reloadErr error
+}
+
+func (s *etcdSource) logger() logrus.FieldLogger {
+	if s.log == nil {
+		return logrus.StandardLogger()
+	}
+	return s.log
+}
+
+// WithEtcd loads config stored under prefix in etcd, on top of the config
+// file and flags. Use Config.Watch to follow changes
+var WithEtcd = func(endpoints []string, prefix string) Option {
+	return func(cfg *Config) error {
+		client, err := clientv3.New(clientv3.Config{
+			Endpoints:   endpoints,
+			DialTimeout: etcdTimeout,
+		})
+		if err != nil {
+			return err
+		}
+
+		cfg.etcd = &etcdSource{client: client, prefix: strings.TrimSuffix(prefix, "/")}
+		return nil
+	}
+}
+
+// WithEtcdLogger logs the reloads of Config.Watch to log instead of the
+// standard logrus logger. It must come after WithEtcd
+var WithEtcdLogger = func(log logrus.FieldLogger) Option {
+	return func(cfg *Config) error {
+		if cfg.etcd == nil {
+			return errors.New("WithEtcdLogger needs WithEtcd first")
+		}
+		if log == nil {
+			return errors.New("nil logger")
+		}
+		cfg.etcd.log = log
+		return nil
+	}
+}
+
+var withEtcdSource = func(source *etcdSource) Option {
+	return func(cfg *Config) error {
+		cfg.etcd = source
+		return nil
+	}
+}
+
+// stringMaps converts the map[interface{}]interface{} values decoded by
+// yaml into map[string]interface{} for viper
+func stringMaps(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			m[fmt.Sprint(key)] = stringMaps(val)
+		}
+		return m
+	case []interface{}:
+		for i, val := range v {
+			v[i] = stringMaps(val)
+		}
+	}
+	return value
+}
+
+func mergeSettings(dst, src map[string]interface{}) {
+	for key, value := range src {
+		srcMap, srcOk := value.(map[string]interface{})
+		dstMap, dstOk := dst[key].(map[string]interface{})
+		if srcOk && dstOk {
+			mergeSettings(dstMap, srcMap)
+			continue
+		}
+		dst[key] = value
+	}
+}
+
+func (s *etcdSource) load(ctx context.Context) (map[string]interface{}, error) {
+	res, err := s.client.Get(ctx, s.prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	if res.Header != nil {
+		s.revision = res.Header.Revision
+	}
+
+	settings := make(map[string]interface{})
+	for _, kv := range res.Kvs {
+		key := string(kv.Key)
+		if key != s.prefix && !strings.HasPrefix(key, s.prefix+"/") {
+			// eg /gomirror-staging when the prefix is /gomirror
+			continue
+		}
+
+		var value interface{}
+		if err := yaml.Unmarshal(kv.Value, &value); err != nil {
+			return nil, fmt.Errorf("etcd key %s: %s", kv.Key, err)
+		}
+		value = stringMaps(value)
+
+		path := strings.Trim(strings.TrimPrefix(key, s.prefix), "/")
+		if path == "" {
+			document, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("etcd key %s: expected a config document", kv.Key)
+			}
+			mergeSettings(settings, document)
+			continue
+		}
+
+		// nest the value under its path, eg mirror/url
+		keys := strings.Split(path, "/")
+		for i := len(keys) - 1; i >= 0; i-- {
+			value = map[string]interface{}{keys[i]: value}
+		}
+		mergeSettings(settings, value.(map[string]interface{}))
+	}
+
+	return settings, nil
+}
+
+// merge loads the config from etcd into v. Without a config file the
+// config layer of v only holds etcd values, so it is reset first to drop
+// deleted keys
+func (s *etcdSource) merge(v *viper.Viper, hasConfigFile bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+
+	settings, err := s.load(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !hasConfigFile {
+		v.SetConfigType("yaml")
+		if err := v.ReadConfig(bytes.NewReader(nil)); err != nil {
+			return err
+		}
+	}
+
+	return v.MergeConfigMap(settings)
+}
+
+func (c *Config) reload() (*Config, error) {
+	cfg, err := InitConfig(WithViper(c.viper), WithConfigFile(c.ConfigFile), withEtcdSource(c.etcd))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// ReloadError returns the error of the last reload from etcd, nil when it
+// succeeded or the config isn't loaded from etcd
+func (c *Config) ReloadError() error {
+	if c.etcd == nil {
+		return nil
+	}
+
+	c.etcd.mux.Lock()
+	defer c.etcd.mux.Unlock()
+	return c.etcd.reloadErr
+}
+
+// Watch calls onChange with the reloaded Config whenever the config stored
+// in etcd changes, until ctx is done. Changes that fail to load or validate
+// are logged and skipped
+func (c *Config) Watch(ctx context.Context, onChange func(*Config)) error {
+	if c.etcd == nil {
+		return errors.New("config is not loaded from etcd")
+	}
+
+	apply := func() {
+		cfg, err := c.reload()
+
+		c.etcd.mux.Lock()
+		c.etcd.reloadErr = err
+		c.etcd.mux.Unlock()
+
+		if err != nil {
+			c.etcd.logger().WithError(err).Errorln("error reloading config from etcd")
+			return
+		}
+		onChange(cfg)
+	}
+
+	for {
+		watch := c.etcd.client.Watch(
+			ctx, c.etcd.prefix, clientv3.WithPrefix(), clientv3.WithRev(c.etcd.revision+1),
+		)
+
+		for res := range watch {
+			if err := res.Err(); err != nil {
+				// eg the revision was compacted, catch up and watch again
+				c.etcd.logger().WithError(err).Warnln("etcd watch failed")
+				apply()
+				break
+			}
+
+			c.etcd.logger().WithField("prefix", c.etcd.prefix).Infoln("config changed in etcd")
+			apply()
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(etcdRewatchDelay):
+		}
+	}
+}
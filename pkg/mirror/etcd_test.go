@@ -0,0 +1,305 @@
+package mirror
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeEtcd is an in memory etcdClient. Gets and watches honour WithPrefix,
+// and watches WithRev: they replay the puts since that revision, or fail
+// like etcd when it was compacted
+type fakeEtcd struct {
+	mux       sync.Mutex
+	kvs       map[string]string
+	revision  int64
+	compacted int64
+	events    []*clientv3.Event
+	watchers  []*fakeWatcher
+}
+
+type fakeWatcher struct {
+	op clientv3.Op
+	c  chan clientv3.WatchResponse
+}
+
+func newFakeEtcd(kvs map[string]string) *fakeEtcd {
+	return &fakeEtcd{kvs: kvs, revision: 1}
+}
+
+// matches reports whether key is in the range of op
+func matches(op clientv3.Op, key string) bool {
+	end := string(op.RangeBytes())
+	if end == "" {
+		return key == string(op.KeyBytes())
+	}
+	return key >= string(op.KeyBytes()) && key < end
+}
+
+func (f *fakeEtcd) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	op := clientv3.OpGet(key, opts...)
+	keys := []string{}
+	for k := range f.kvs {
+		if matches(op, k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	res := &clientv3.GetResponse{Header: &etcdserverpb.ResponseHeader{Revision: f.revision}}
+	for _, k := range keys {
+		res.Kvs = append(res.Kvs, &mvccpb.KeyValue{Key: []byte(k), Value: []byte(f.kvs[k])})
+	}
+	return res, nil
+}
+
+func (f *fakeEtcd) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	op := clientv3.OpGet(key, opts...)
+	watch := make(chan clientv3.WatchResponse, 100)
+	if op.Rev() != 0 && op.Rev() < f.compacted {
+		watch <- clientv3.WatchResponse{
+			Header:          etcdserverpb.ResponseHeader{Revision: f.revision},
+			CompactRevision: f.compacted,
+			Canceled:        true,
+		}
+		close(watch)
+		return watch
+	}
+
+	if op.Rev() != 0 {
+		for _, event := range f.events {
+			if event.Kv.ModRevision >= op.Rev() && matches(op, string(event.Kv.Key)) {
+				watch <- eventResponse(event)
+			}
+		}
+	}
+
+	f.watchers = append(f.watchers, &fakeWatcher{op: op, c: watch})
+	return watch
+}
+
+func eventResponse(event *clientv3.Event) clientv3.WatchResponse {
+	return clientv3.WatchResponse{
+		Header: etcdserverpb.ResponseHeader{Revision: event.Kv.ModRevision},
+		Events: []*clientv3.Event{event},
+	}
+}
+
+func (f *fakeEtcd) put(key, value string) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.kvs[key] = value
+	f.revision++
+
+	event := &clientv3.Event{
+		Type: mvccpb.PUT,
+		Kv:   &mvccpb.KeyValue{Key: []byte(key), Value: []byte(value), ModRevision: f.revision},
+	}
+	f.events = append(f.events, event)
+	for _, watcher := range f.watchers {
+		if matches(watcher.op, key) {
+			watcher.c <- eventResponse(event)
+		}
+	}
+}
+
+// compact forgets the puts before the current revision
+func (f *fakeEtcd) compact() {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.compacted = f.revision
+	f.events = nil
+}
+
+// waitWatching waits for n watches to be registered
+func (f *fakeEtcd) waitWatching(n int) {
+	for i := 0; i < 500; i++ {
+		f.mux.Lock()
+		watching := len(f.watchers) >= n
+		f.mux.Unlock()
+		if watching {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	panic("timed out waiting for the etcd watch")
+}
+
+var testEtcdConfig = `
+port: 8080
+primary:
+  url: http://127.0.0.1:8002
+mirror:
+  url: http://mirror.internal
+  headers:
+    - key: X-Mirror-Header
+      value: example-header
+`
+
+func TestEtcdConfig(t *testing.T) {
+	etcd := newFakeEtcd(map[string]string{
+		"/gomirror":                        testEtcdConfig,
+		"/gomirror/primary/do-mirror-body": "true",
+		"/gomirror/mirror/url":             "http://mirror-v2.internal",
+		"/gomirror-other/mirror/url":       "http://someone-elses.internal",
+	})
+
+	source := &etcdSource{client: etcd, prefix: "/gomirror"}
+	cfg, err := InitConfig(WithViper(viper.New()), withEtcdSource(source))
+	assert.NoError(t, err)
+
+	assert.Equal(t, 8080, cfg.Port)
+	assert.Equal(t, "http://127.0.0.1:8002", cfg.Primary.URL)
+	assert.True(t, cfg.Primary.DoMirrorBody)
+	assert.Equal(t, "http://mirror-v2.internal", cfg.Mirror.URL)
+	assert.Equal(t, testMirrorHeaders, cfg.Mirror.HTTPHeaders())
+
+	mirror, err := New(cfg)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	updated := make(chan *Config, 1)
+	go cfg.Watch(ctx, func(next *Config) {
+		assert.NoError(t, mirror.UpdateConfig(next))
+		updated <- next
+	})
+
+	etcd.waitWatching(1)
+
+	// keys outside the prefix are ignored
+	etcd.put("/other/mirror/url", "http://other.internal")
+	etcd.put("/gomirror/mirror/url", "http://mirror-v3.internal")
+
+	select {
+	case <-time.After(5 * time.Second):
+		panic("timed out waiting for config update")
+	case next := <-updated:
+		assert.Equal(t, "http://mirror-v3.internal", next.Mirror.URL)
+		assert.Equal(t, testMirrorHeaders, next.Mirror.HTTPHeaders())
+	}
+	assert.Equal(t, "http://mirror-v3.internal", mirror.current().cfg.Mirror.URL)
+
+	// invalid config is never applied
+	etcd.put("/gomirror/mirror/url", `""`)
+	select {
+	case next := <-updated:
+		t.Fatalf("unexpected config update %+v", next)
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.Equal(t, "http://mirror-v3.internal", mirror.current().cfg.Mirror.URL)
+}
+
+func TestEtcdConfigResume(t *testing.T) {
+	etcdRewatchDelay = 10 * time.Millisecond
+	defer func() { etcdRewatchDelay = time.Second }()
+
+	etcd := newFakeEtcd(map[string]string{"/gomirror": testEtcdConfig})
+	cfg, err := InitConfig(WithViper(viper.New()), withEtcdSource(&etcdSource{client: etcd, prefix: "/gomirror"}))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// changed after the config was loaded, before it is watched
+	etcd.put("/gomirror/mirror/url", "http://mirror-v2.internal")
+
+	updated := make(chan *Config, 10)
+	go cfg.Watch(ctx, func(next *Config) {
+		updated <- next
+	})
+
+	select {
+	case <-time.After(5 * time.Second):
+		panic("timed out waiting for config update")
+	case next := <-updated:
+		assert.Equal(t, "http://mirror-v2.internal", next.Mirror.URL)
+	}
+}
+
+func TestEtcdConfigCompacted(t *testing.T) {
+	etcdRewatchDelay = 10 * time.Millisecond
+	defer func() { etcdRewatchDelay = time.Second }()
+
+	etcd := newFakeEtcd(map[string]string{"/gomirror": testEtcdConfig})
+	cfg, err := InitConfig(WithViper(viper.New()), withEtcdSource(&etcdSource{client: etcd, prefix: "/gomirror"}))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the revision the config was loaded at is gone by the time it is
+	// watched, so the config is loaded again and watched from there
+	etcd.put("/gomirror/mirror/url", "http://mirror-v2.internal")
+	etcd.put("/gomirror/mirror/url", "http://mirror-v3.internal")
+	etcd.compact()
+
+	updated := make(chan *Config, 10)
+	go cfg.Watch(ctx, func(next *Config) {
+		updated <- next
+	})
+
+	select {
+	case <-time.After(5 * time.Second):
+		panic("timed out waiting for config update")
+	case next := <-updated:
+		assert.Equal(t, "http://mirror-v3.internal", next.Mirror.URL)
+	}
+
+	etcd.waitWatching(1)
+	etcd.put("/gomirror/mirror/url", "http://mirror-v4.internal")
+	select {
+	case <-time.After(5 * time.Second):
+		panic("timed out waiting for config update")
+	case next := <-updated:
+		assert.Equal(t, "http://mirror-v4.internal", next.Mirror.URL)
+	}
+}
+
+func TestEtcdConfigErrors(t *testing.T) {
+	etcd := newFakeEtcd(map[string]string{"/gomirror": "just a string"})
+
+	_, err := InitConfig(WithViper(viper.New()), withEtcdSource(&etcdSource{client: etcd, prefix: "/gomirror"}))
+	assert.Error(t, err)
+
+	cfg, err := InitConfig(WithViper(viper.New()))
+	assert.NoError(t, err)
+	assert.Error(t, cfg.Watch(context.Background(), func(*Config) {}))
+}
+
+func TestEtcdLogger(t *testing.T) {
+	_, err := InitConfig(WithViper(viper.New()), WithEtcdLogger(logrus.New()))
+	assert.Error(t, err)
+
+	log := logrus.New()
+	etcd := newFakeEtcd(map[string]string{"/gomirror": testEtcdConfig})
+	cfg, err := InitConfig(
+		WithViper(viper.New()),
+		withEtcdSource(&etcdSource{client: etcd, prefix: "/gomirror"}),
+		WithEtcdLogger(log),
+	)
+	assert.NoError(t, err)
+
+	// the mirror logger is left out of the watch of the config it is given
+	_, err = NewMirror(WithConfig(cfg), WithLogger(logrus.New()))
+	assert.NoError(t, err)
+	assert.True(t, cfg.etcd.logger() == log)
+}
@@ -0,0 +1,189 @@
+package mirror
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/http2"
+)
+
+// grpcStreamBuffer is the number of reads from a streaming call that can be
+// queued for the mirror before the mirrored stream is abandoned
+const grpcStreamBuffer = 256
+
+var errMirrorStreamOverflow = errors.New("mirror could not keep up with the grpc stream")
+
+type grpcMethodMode int
+
+const (
+	grpcMethodIgnored grpcMethodMode = iota
+	grpcMethodUnary
+	grpcMethodStream
+)
+
+func isGRPCRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+func matchGRPCMethod(patterns []string, method string) bool {
+	for _, pattern := range patterns {
+		switch {
+		case pattern == "*" || pattern == method:
+			return true
+		case strings.HasSuffix(pattern, "/*") &&
+			strings.HasPrefix(method, strings.TrimSuffix(pattern, "*")):
+			return true
+		}
+	}
+	return false
+}
+
+func (c *GRPCConfig) methodMode(method string) grpcMethodMode {
+	switch {
+	case matchGRPCMethod(c.Methods, method):
+		return grpcMethodUnary
+	case matchGRPCMethod(c.StreamMethods, method):
+		return grpcMethodStream
+	}
+	return grpcMethodIgnored
+}
+
+// copyGRPCHeaders copies the headers a grpc server needs to accept the
+// mirrored call, even when DoMirrorHeaders is disabled
+func copyGRPCHeaders(proxyReq, r *http.Request) {
+	for key, value := range r.Header {
+		lower := strings.ToLower(key)
+		if lower == "content-type" || lower == "te" || strings.HasPrefix(lower, "grpc-") {
+			proxyReq.Header[key] = value
+		}
+	}
+}
+
+// h2cTransport speaks HTTP/2 with prior knowledge, over cleartext
+// connections for http urls and over tls with tlsConfig for https urls
+func h2cTransport(tlsConfig *tls.Config) http.RoundTripper {
+	dial := (&net.Dialer{}).DialContext
+
+	return &h2cRoundTripper{
+		cleartext: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(context.Background(), network, addr)
+			},
+		},
+		tls: &http2.Transport{
+			TLSClientConfig: tlsConfig,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				conn, err := dial(context.Background(), network, addr)
+				if err != nil {
+					return nil, err
+				}
+
+				tlsConn := tls.Client(conn, cfg)
+				if err := tlsConn.Handshake(); err != nil {
+					conn.Close()
+					return nil, err
+				}
+				return tlsConn, nil
+			},
+		},
+	}
+}
+
+// h2cRoundTripper sends requests with the transport of their scheme, the
+// http2 transport dials both the same way so it can't tell them apart
+type h2cRoundTripper struct {
+	cleartext *http2.Transport
+	tls       *http2.Transport
+}
+
+func (t *h2cRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "https" {
+		return t.tls.RoundTrip(req)
+	}
+	return t.cleartext.RoundTrip(req)
+}
+
+// streamTee copies a request body to the mirror as it is read by the
+// primary. Copies are queued, and the mirror body fails rather than
+// blocking the primary when the queue is full
+type streamTee struct {
+	io.ReadCloser
+	pw     *io.PipeWriter
+	chunks chan []byte
+
+	mux  sync.Mutex
+	done bool
+}
+
+func newStreamTee(body io.ReadCloser) (*streamTee, io.ReadCloser) {
+	pr, pw := io.Pipe()
+	t := &streamTee{
+		ReadCloser: body,
+		pw:         pw,
+		chunks:     make(chan []byte, grpcStreamBuffer),
+	}
+
+	go t.run()
+	return t, pr
+}
+
+func (t *streamTee) run() {
+	for chunk := range t.chunks {
+		if _, err := t.pw.Write(chunk); err != nil {
+			for range t.chunks {
+			}
+			return
+		}
+	}
+	t.pw.Close()
+}
+
+func (t *streamTee) finish(err error) {
+	if t.done {
+		return
+	}
+	t.done = true
+	close(t.chunks)
+	if err != nil {
+		t.pw.CloseWithError(err)
+	}
+}
+
+func (t *streamTee) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	if n > 0 && !t.done {
+		chunk := make([]byte, n)
+		copy(chunk, p[:n])
+
+		select {
+		case t.chunks <- chunk:
+		default:
+			t.finish(errMirrorStreamOverflow)
+		}
+	}
+
+	if err != nil {
+		t.finish(nil)
+	}
+
+	return n, err
+}
+
+func (t *streamTee) Close() error {
+	t.mux.Lock()
+	t.finish(nil)
+	t.mux.Unlock()
+
+	return t.ReadCloser.Close()
+}
@@ -0,0 +1,161 @@
+package mirror
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// grpcFrame wraps a message in the grpc length prefixed framing
+func grpcFrame(msg string) []byte {
+	frame := []byte{0, 0, 0, 0, byte(len(msg))}
+	return append(frame, msg...)
+}
+
+// grpcEchoHandler answers calls like a grpc server, echoing the request
+// messages and sending the status in the trailers
+func grpcEchoHandler(t *testing.T, name string, received chan<- string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "HTTP/2.0", r.Proto)
+		assert.Equal(t, "application/grpc", r.Header.Get("Content-Type"))
+		assert.Equal(t, "trailers", r.Header.Get("Te"))
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.WriteHeader(http.StatusOK)
+
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		w.Write(body)
+
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", name)
+
+		if received != nil {
+			received <- r.URL.Path + " " + string(body)
+		}
+	})
+}
+
+func newH2CServer(handler http.Handler) *httptest.Server {
+	return httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+}
+
+func TestMirrorGRPC(t *testing.T) {
+	backendServer := newH2CServer(grpcEchoHandler(t, "primary", nil))
+	defer backendServer.Close()
+
+	received := make(chan string, 10)
+	mirroredServer := newH2CServer(grpcEchoHandler(t, "mirror", received))
+	defer mirroredServer.Close()
+
+	cfg := &Config{
+		H2C: true,
+		Primary: PrimaryConfig{
+			URL: backendServer.URL,
+			H2C: true,
+		},
+		Mirror: MirrorConfig{
+			URL: mirroredServer.URL,
+			H2C: true,
+			GRPC: GRPCConfig{
+				Methods:       []string{"/test.Echo/Unary"},
+				StreamMethods: []string{"/test.Stream/*"},
+			},
+		},
+	}
+	mirror, err := New(cfg)
+	assert.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	address := listener.Addr().String()
+	listener.Close()
+
+	go mirror.Serve(address)
+
+	client := &http.Client{Transport: h2cTransport(nil)}
+
+	call := func(method string, body io.Reader) (*http.Response, []byte) {
+		req, err := http.NewRequest(http.MethodPost, "http://"+address+method, body)
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("Te", "trailers")
+
+		var res *http.Response
+		for i := 0; i < 50; i++ {
+			if res, err = client.Do(req); err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		assert.NoError(t, err)
+
+		resBody, err := ioutil.ReadAll(res.Body)
+		assert.NoError(t, err)
+		return res, resBody
+	}
+
+	expectMirror := func(expected string) {
+		select {
+		case <-time.After(5 * time.Second):
+			panic("timed out waiting for mirror")
+		case mirrored := <-received:
+			assert.Equal(t, expected, mirrored)
+		}
+	}
+
+	// allowed unary call
+	res, body := call("/test.Echo/Unary", bytes.NewReader(grpcFrame("hello")))
+	assert.Equal(t, "HTTP/2.0", res.Proto)
+	assert.Equal(t, grpcFrame("hello"), body)
+	assert.Equal(t, "0", res.Trailer.Get("Grpc-Status"))
+	assert.Equal(t, "primary", res.Trailer.Get("Grpc-Message"))
+	expectMirror("/test.Echo/Unary " + string(grpcFrame("hello")))
+
+	// methods that are not allowed are only proxied
+	res, body = call("/test.Echo/Other", bytes.NewReader(grpcFrame("other")))
+	assert.Equal(t, grpcFrame("other"), body)
+	assert.Equal(t, "0", res.Trailer.Get("Grpc-Status"))
+
+	// streaming calls are teed to the mirror as the client sends them
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write(grpcFrame("one"))
+		pw.Write(grpcFrame("two"))
+		pw.Close()
+	}()
+	res, body = call("/test.Stream/Chat", pr)
+	stream := string(grpcFrame("one")) + string(grpcFrame("two"))
+	assert.Equal(t, stream, string(body))
+	assert.Equal(t, "0", res.Trailer.Get("Grpc-Status"))
+	expectMirror("/test.Stream/Chat " + stream)
+
+	select {
+	case mirrored := <-received:
+		t.Fatalf("unexpected mirrored call %s", mirrored)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestGRPCMethodMode(t *testing.T) {
+	cfg := GRPCConfig{
+		Methods:       []string{"/pkg.Users/Get", "/pkg.Orders/*"},
+		StreamMethods: []string{"*"},
+	}
+
+	assert.Equal(t, grpcMethodUnary, cfg.methodMode("/pkg.Users/Get"))
+	assert.Equal(t, grpcMethodUnary, cfg.methodMode("/pkg.Orders/List"))
+	assert.Equal(t, grpcMethodStream, cfg.methodMode("/pkg.Users/Watch"))
+	assert.Equal(t, grpcMethodIgnored, (&GRPCConfig{}).methodMode("/pkg.Users/Get"))
+	assert.Equal(t, grpcMethodIgnored, (&GRPCConfig{Methods: []string{"/pkg.Orders/*"}}).methodMode("/pkg.OrdersV2/List"))
+}
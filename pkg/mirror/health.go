@@ -0,0 +1,244 @@
+package mirror
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Paths of the health endpoints, reserved on the proxy port unless the
+// health admin port is set
+const (
+	LivenessPath  = "/healthz"
+	ReadinessPath = "/readyz"
+)
+
+// healthCheckTimeout bounds the time spent checking the primary
+var healthCheckTimeout = 5 * time.Second
+
+// defaultMaxSyncAge is the default HealthConfig.MaxSyncAge
+const defaultMaxSyncAge = 3 * time.Minute
+
+// HealthCheck is the result of one readiness check
+type HealthCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// healthReport is the body of the health endpoints
+type healthReport struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks,omitempty"`
+}
+
+// Ready checks the primary responds, the config loaded and, when docker
+// lookup is enabled, that the docker resolver has synced recently. ok is
+// false when any check failed
+func (m *Mirror) Ready(ctx context.Context) (checks []HealthCheck, ok bool) {
+	ok = true
+	add := func(name string, err error) {
+		check := HealthCheck{Name: name, OK: err == nil}
+		if err != nil {
+			check.Error = err.Error()
+			ok = false
+		}
+		checks = append(checks, check)
+	}
+
+	add("config", m.configError())
+	add("primary", m.checkPrimary(ctx))
+
+	m.dockerMux.Lock()
+	resolver := m.docker
+	m.dockerMux.Unlock()
+	if resolver != nil {
+		add("docker", m.checkDocker())
+	}
+
+	return checks, ok
+}
+
+// configError returns the error of the last config reload or update
+func (m *Mirror) configError() error {
+	if err := m.current().cfg.ReloadError(); err != nil {
+		return fmt.Errorf("error reloading config: %s", err)
+	}
+
+	m.updateMux.Lock()
+	defer m.updateMux.Unlock()
+	if m.updateErr != nil {
+		return fmt.Errorf("error applying config: %s", m.updateErr)
+	}
+	return nil
+}
+
+// checkPrimary connects to a tcp primary, or requests the health primary
+// path from an http one through the primary proxy
+func (m *Mirror) checkPrimary(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	cfg := m.current().cfg
+	if cfg.Mode == ModeTCP {
+		address, err := tcpAddress(cfg.Primary.URL)
+		if err != nil {
+			return err
+		}
+
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	path := cfg.Health.PrimaryPath
+	if path == "" {
+		path = "/"
+	}
+
+	req, err := http.NewRequest(http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	for _, header := range cfg.Primary.Headers {
+		req.Header.Set(header.Key, header.Value)
+	}
+
+	// the director points the request at the primary, picking an endpoint
+	// when discovery is enabled
+	m.ReverseProxy.Director(req)
+	res, err := m.ReverseProxy.Transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("primary responded %s", res.Status)
+	}
+	return nil
+}
+
+// checkDocker fails when the docker resolver never looked up containers,
+// or its lookups have failed for longer than the max sync age
+func (m *Mirror) checkDocker() error {
+	maxAge := m.current().cfg.Health.MaxSyncAge
+	if maxAge <= 0 {
+		maxAge = defaultMaxSyncAge
+	}
+
+	status := m.docker.Status()
+	if status.LastSync.IsZero() {
+		if status.LastError != nil {
+			return fmt.Errorf("docker containers were never looked up: %s", status.LastError)
+		}
+		return errors.New("docker containers were never looked up")
+	}
+
+	if status.LastError != nil && time.Since(status.LastSync) > maxAge {
+		return fmt.Errorf("docker containers were last looked up %s ago: %s",
+			time.Since(status.LastSync).Round(time.Second), status.LastError)
+	}
+	return nil
+}
+
+// HealthHandler serves the liveness and readiness endpoints. Liveness only
+// confirms gomirror is serving, readiness responds 503 unless every check
+// of Ready passes
+func (m *Mirror) HealthHandler() http.Handler {
+	return m.healthHandler(true)
+}
+
+// healthHandler serves the health endpoints, leaving the check errors out
+// of the readiness response unless detailed is set. They're only logged
+// when the endpoints share the proxy port
+func (m *Mirror) healthHandler(detailed bool) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc(LivenessPath, func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, http.StatusOK, healthReport{Status: "ok"})
+	})
+
+	mux.HandleFunc(ReadinessPath, func(w http.ResponseWriter, r *http.Request) {
+		checks, ok := m.Ready(r.Context())
+		if !ok {
+			m.log.WithField("checks", checks).Warnln("not ready")
+		}
+		if !detailed {
+			checks = withoutErrors(checks)
+		}
+		if !ok {
+			writeHealth(w, http.StatusServiceUnavailable, healthReport{Status: "unavailable", Checks: checks})
+			return
+		}
+		writeHealth(w, http.StatusOK, healthReport{Status: "ok", Checks: checks})
+	})
+
+	return mux
+}
+
+// withoutErrors returns a copy of checks without their errors
+func withoutErrors(checks []HealthCheck) []HealthCheck {
+	stripped := make([]HealthCheck, len(checks))
+	for i, check := range checks {
+		stripped[i] = HealthCheck{Name: check.Name, OK: check.OK}
+	}
+	return stripped
+}
+
+func writeHealth(w http.ResponseWriter, code int, report healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(report)
+}
+
+// adminHandler serves the health and noise endpoints
+func (m *Mirror) adminHandler(detailed bool) http.Handler {
+	health := m.healthHandler(detailed)
+
+	mux := http.NewServeMux()
+	mux.Handle(LivenessPath, health)
+	mux.Handle(ReadinessPath, health)
+	mux.Handle(NoisePath, m.NoiseHandler())
+	return mux
+}
+
+// withHealth serves the health endpoints, and the noise endpoint while
+// diffing, on their reserved paths and everything else with next
+func (m *Mirror) withHealth(next http.Handler) http.Handler {
+	admin := m.adminHandler(false)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case LivenessPath, ReadinessPath:
+			admin.ServeHTTP(w, r)
+		case NoisePath:
+			if !m.current().cfg.Mirror.Diff.Enabled {
+				next.ServeHTTP(w, r)
+				return
+			}
+			admin.ServeHTTP(w, r)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// serveAdmin serves the health and noise endpoints on the admin port
+func (m *Mirror) serveAdmin(port int) {
+	address := fmt.Sprintf(":%d", port)
+	m.log.WithField("address", address).Infoln("serving admin endpoints")
+
+	if err := http.ListenAndServe(address, m.adminHandler(true)); err != nil {
+		m.log.WithError(err).Errorln("error serving admin endpoints")
+	}
+}
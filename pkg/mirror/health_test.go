@@ -0,0 +1,119 @@
+package mirror
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func getHealth(t *testing.T, url string) (int, healthReport) {
+	res, err := http.Get(url)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+
+	var report healthReport
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&report))
+	return res.StatusCode, report
+}
+
+func TestHealth(t *testing.T) {
+	primaryCode := http.StatusOK
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ping" {
+			w.WriteHeader(primaryCode)
+			return
+		}
+		w.Write([]byte("primary"))
+	}))
+	defer backendServer.Close()
+
+	cfg := &Config{
+		Primary: PrimaryConfig{URL: backendServer.URL},
+		Health:  HealthConfig{PrimaryPath: "/ping"},
+	}
+	mirror, err := New(cfg)
+	assert.NoError(t, err)
+
+	mirrorProxy := httptest.NewServer(mirror.handler(cfg))
+	defer mirrorProxy.Close()
+
+	code, report := getHealth(t, mirrorProxy.URL+LivenessPath)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", report.Status)
+
+	code, report = getHealth(t, mirrorProxy.URL+ReadinessPath)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []HealthCheck{{Name: "config", OK: true}, {Name: "primary", OK: true}}, report.Checks)
+
+	// other paths are still proxied, as is the noise path without diffing
+	for _, path := range []string{"/healthz/deep", NoisePath} {
+		res, err := http.Get(mirrorProxy.URL + path)
+		assert.NoError(t, err)
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.NoError(t, err)
+		assert.Equal(t, "primary", string(body))
+	}
+
+	// readiness fails while the primary is unhealthy, liveness doesn't
+	primaryCode = http.StatusBadGateway
+	code, report = getHealth(t, mirrorProxy.URL+ReadinessPath)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "unavailable", report.Status)
+	assert.False(t, report.Checks[1].OK)
+	// the errors are left out on the proxy port
+	assert.Empty(t, report.Checks[1].Error)
+
+	admin := httptest.NewServer(mirror.HealthHandler())
+	defer admin.Close()
+	code, report = getHealth(t, admin.URL+ReadinessPath)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, report.Checks[1].Error, "502")
+
+	code, _ = getHealth(t, mirrorProxy.URL+LivenessPath)
+	assert.Equal(t, http.StatusOK, code)
+
+	// and while the config can't be applied
+	primaryCode = http.StatusOK
+	assert.Error(t, mirror.UpdateConfig(&Config{
+		Primary: cfg.Primary,
+		Mirror:  MirrorConfig{URL: "http://mirror.internal", TLS: UpstreamTLSConfig{CAFile: "testdata/missing-ca.pem"}},
+	}))
+	code, report = getHealth(t, mirrorProxy.URL+ReadinessPath)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.False(t, report.Checks[0].OK)
+}
+
+func TestHealthAdminPort(t *testing.T) {
+	backendServer := httptest.NewServer(returnBody("primary", http.StatusOK))
+	defer backendServer.Close()
+
+	cfg := &Config{
+		Primary: PrimaryConfig{URL: backendServer.URL},
+		Health:  HealthConfig{AdminPort: 9999},
+	}
+	mirror, err := New(cfg)
+	assert.NoError(t, err)
+
+	// the paths go to the primary when the admin port is set
+	mirrorProxy := httptest.NewServer(mirror.handler(cfg))
+	defer mirrorProxy.Close()
+
+	res, err := http.Get(mirrorProxy.URL + LivenessPath)
+	assert.NoError(t, err)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "primary", string(body))
+
+	admin := httptest.NewServer(mirror.HealthHandler())
+	defer admin.Close()
+
+	code, report := getHealth(t, admin.URL+ReadinessPath)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", report.Status)
+}
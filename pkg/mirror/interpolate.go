@@ -0,0 +1,167 @@
+package mirror
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// sensitiveNames are parts of header and environment variable names that
+// hold secrets
+var sensitiveNames = []string{
+	"auth", "cookie", "credential", "key", "passw", "secret", "token",
+}
+
+func isSensitiveName(name string) bool {
+	name = strings.ToLower(name)
+	for _, sensitive := range sensitiveNames {
+		if strings.Contains(name, sensitive) {
+			return true
+		}
+	}
+	return false
+}
+
+// interpolate expands ${ENV_VAR}, ${ENV_VAR:-default} and ${file:/path}
+// references in s. $${ is written as a literal ${. Problems with references
+// that can't be resolved are returned, and the reference is left as is.
+// secret is set when a value was read from a file or a sensitive variable
+func interpolate(s string) (value string, problems []string, secret bool) {
+	if !strings.Contains(s, "${") {
+		return s, nil, false
+	}
+
+	var out strings.Builder
+
+	for {
+		start := strings.Index(s, "${")
+		if start < 0 {
+			out.WriteString(s)
+			break
+		}
+
+		if start > 0 && s[start-1] == '$' {
+			out.WriteString(s[:start-1] + "${")
+			s = s[start+2:]
+			continue
+		}
+
+		end := strings.Index(s[start:], "}")
+		if end < 0 {
+			problems = append(problems, fmt.Sprintf("unterminated reference %q", s[start:]))
+			out.WriteString(s)
+			break
+		}
+		end += start
+
+		out.WriteString(s[:start])
+
+		expr := s[start+2 : end]
+		resolved, err := resolveReference(expr)
+		if err != nil {
+			problems = append(problems, err.Error())
+			resolved = s[start : end+1]
+		}
+		out.WriteString(resolved)
+
+		if strings.HasPrefix(expr, "file:") || isSensitiveName(strings.Split(expr, ":-")[0]) {
+			secret = true
+		}
+
+		s = s[end+1:]
+	}
+
+	return out.String(), problems, secret
+}
+
+func resolveReference(expr string) (string, error) {
+	if strings.HasPrefix(expr, "file:") {
+		file := strings.TrimPrefix(expr, "file:")
+		contents, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("can't read secret file: %s", err)
+		}
+		// secret files usually end with a newline that isn't part of the value
+		return strings.TrimRight(string(contents), "\r\n"), nil
+	}
+
+	name := expr
+	def, hasDefault := "", false
+	if i := strings.Index(expr, ":-"); i >= 0 {
+		name, def, hasDefault = expr[:i], expr[i+2:], true
+	}
+
+	value, ok := os.LookupEnv(name)
+	switch {
+	case hasDefault && value == "":
+		return def, nil
+	case !ok:
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+
+	return value, nil
+}
+
+// fieldName returns the name of a config field as written in a config file
+func fieldName(field reflect.StructField) string {
+	if tag := field.Tag.Get("mapstructure"); tag != "" {
+		return strings.Split(tag, ",")[0]
+	}
+	return strings.ToLower(field.Name)
+}
+
+// interpolator expands references in every string field of a config
+type interpolator struct {
+	errs ValidationError
+	// secrets are the paths of fields that hold a secret after expansion
+	secrets map[string]bool
+}
+
+func interpolateFields(cfg *Config) *interpolator {
+	i := &interpolator{secrets: make(map[string]bool)}
+	i.walk(reflect.ValueOf(cfg), "")
+	return i
+}
+
+func (i *interpolator) walk(v reflect.Value, path string) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			i.walk(v.Elem(), path)
+		}
+
+	case reflect.Struct:
+		for n := 0; n < v.NumField(); n++ {
+			field := v.Type().Field(n)
+			if field.PkgPath != "" {
+				// unexported
+				continue
+			}
+
+			fieldPath := fieldName(field)
+			if path != "" {
+				fieldPath = path + "." + fieldPath
+			}
+			i.walk(v.Field(n), fieldPath)
+		}
+
+	case reflect.Slice:
+		for n := 0; n < v.Len(); n++ {
+			i.walk(v.Index(n), fmt.Sprintf("%s[%d]", path, n))
+		}
+
+	case reflect.String:
+		value, problems, secret := interpolate(v.String())
+		for _, problem := range problems {
+			i.errs = append(i.errs, FieldError{Field: path, Message: problem})
+		}
+		if secret {
+			i.secrets[path] = true
+		}
+		if v.CanSet() {
+			v.SetString(value)
+		}
+	}
+}
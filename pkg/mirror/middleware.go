@@ -0,0 +1,201 @@
+package mirror
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Exchange is a mirrored request with the response of the wrapped handler
+// and of the mirror, passed to the WithResponseCapture callback
+type Exchange struct {
+	// Request is the request sent to the mirror, its body has been read
+	Request *http.Request
+	// Primary is the response written by the wrapped handler
+	Primary *CapturedResponse
+	// Mirror is the response of the mirror, nil when MirrorErr is set
+	Mirror    *CapturedResponse
+	MirrorErr error
+	// Latency is the time the mirror took to respond
+	Latency time.Duration
+}
+
+// MiddlewareOption configures a mirroring middleware
+type MiddlewareOption func(m *middleware) error
+
+// middleware mirrors the requests of an in process handler
+type middleware struct {
+	cfg *Config
+	// the responses of the handler are only recorded when there are
+	// observers
+	observers []Observer
+	log       logrus.FieldLogger
+}
+
+// WithMiddlewareConfig mirrors requests with the mirror config of cfg: the
+// target, headers, tls, discovery, grpc methods and sample rate, and the
+// primary directives to mirror headers and bodies. The primary url is
+// unused, the wrapped handler is the primary
+var WithMiddlewareConfig = func(cfg *Config) MiddlewareOption {
+	return func(m *middleware) error {
+		if cfg == nil {
+			return errors.New("nil config")
+		}
+
+		// later options don't change cfg
+		m.cfg = cfg.copy()
+		return nil
+	}
+}
+
+// WithMirrorURL mirrors requests to url, with the request path and query
+var WithMirrorURL = func(url string) MiddlewareOption {
+	return func(m *middleware) error {
+		m.cfg.Mirror.URL = url
+		return nil
+	}
+}
+
+// WithMirrorHeaders sets headers on the mirrored requests
+var WithMirrorHeaders = func(headers ...Header) MiddlewareOption {
+	return func(m *middleware) error {
+		m.cfg.Mirror.Headers = append(m.cfg.Mirror.Headers, headers...)
+		return nil
+	}
+}
+
+// WithSampleRate mirrors this fraction of requests, between 0 and 1
+var WithSampleRate = func(rate float64) MiddlewareOption {
+	return func(m *middleware) error {
+		m.cfg.Mirror.SampleRate = rate
+		return nil
+	}
+}
+
+// WithResponseCapture records the responses of the wrapped handler, and
+// calls capture with them and the mirror response once the mirrored
+// request is done. Responses are buffered in memory, and hijacked
+// connections (eg websockets) can't be recorded
+var WithResponseCapture = func(capture func(*Exchange)) MiddlewareOption {
+	return WithMiddlewareObserver(&ObserverFuncs{
+		MirrorResponse: func(req *http.Request, primary, mirror *CapturedResponse, err error, latency time.Duration) {
+			capture(&Exchange{Request: req, Primary: primary, Mirror: mirror, MirrorErr: err, Latency: latency})
+		},
+	})
+}
+
+// WithMiddlewareObserver registers observer to be notified of mirrored
+// requests, like Mirror.AddObserver
+var WithMiddlewareObserver = func(observer Observer) MiddlewareOption {
+	return func(m *middleware) error {
+		if observer == nil {
+			return errors.New("nil observer")
+		}
+		m.observers = append(m.observers, observer)
+		return nil
+	}
+}
+
+// WithMiddlewareLogger logs to logger instead of the standard logrus
+// logger, like WithLogger
+var WithMiddlewareLogger = func(logger logrus.FieldLogger) MiddlewareOption {
+	return func(m *middleware) error {
+		if logger == nil {
+			return errors.New("nil logger")
+		}
+		m.log = logger
+		return nil
+	}
+}
+
+// MirrorMiddleware mirrors the requests of the handlers it wraps
+type MirrorMiddleware struct {
+	mirror *Mirror
+	target *mirrorTarget
+	closed int32
+}
+
+// Middleware returns a middleware mirroring the requests of the handlers
+// it wraps, as the proxy mirrors the requests to its primary. Mirrored
+// requests are sent in the background, and never change the response of
+// the handler. Headers and bodies are mirrored unless a config without
+// those directives is given with WithMiddlewareConfig
+func Middleware(opts ...MiddlewareOption) (*MirrorMiddleware, error) {
+	m := &middleware{
+		cfg: &Config{
+			Primary: PrimaryConfig{DoMirrorHeaders: true, DoMirrorBody: true},
+		},
+		log: logrus.StandardLogger(),
+	}
+
+	for _, opt := range opts {
+		if err := opt(m); err != nil {
+			return nil, err
+		}
+	}
+
+	// the mode only applies to the proxy, and there is no primary url
+	cfg := *m.cfg
+	cfg.Mode = ModeHTTP
+	cfg.Primary.URL = "http://middleware"
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	mirror := &Mirror{log: m.log, observers: &observerList{}}
+	mirror.AddObserver(m.observers...)
+	target, err := mirror.newMirrorTarget(&cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MirrorMiddleware{mirror: mirror, target: target}, nil
+}
+
+// Handler wraps next, mirroring its requests. It can be passed to routers
+// as a func(http.Handler) http.Handler
+func (m *MirrorMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&m.closed) != 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		proxyReq, doMirror, err := m.target.mirrorRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if !doMirror {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if isWebSocketUpgrade(r) {
+			// the frames of the session never pass through the middleware,
+			// so the mirror can't be sent them
+			m.target.observers.dropped(r, DropUnsupported)
+			next.ServeHTTP(w, r)
+			return
+		}
+		m.target.serve(w, r, proxyReq, next)
+	})
+}
+
+// Close stops the discovery of the mirror and closes its sink, once the
+// requests being mirrored are done. Requests are only served by the wrapped
+// handlers after it
+func (m *MirrorMiddleware) Close() {
+	if !atomic.CompareAndSwapInt32(&m.closed, 0, 1) {
+		return
+	}
+
+	m.target.close()
+	if m.mirror.docker != nil {
+		// the docker resolver is only shared with this middleware
+		m.mirror.docker.Close()
+	}
+}
@@ -0,0 +1,164 @@
+package mirror
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+)
+
+func TestMiddleware(t *testing.T) {
+	mirrorHeaders := []Header{{Key: "X-Mirrored", Value: "true"}}
+
+	mirroredServer := httptest.NewServer(
+		assertHeaders(t, mirrorHeaders, assertBody(t, "hello", returnBody("mirror", http.StatusAccepted))),
+	)
+	defer mirroredServer.Close()
+
+	exchanges := make(chan *Exchange, 1)
+	middleware, err := Middleware(
+		WithMirrorURL(mirroredServer.URL),
+		WithMirrorHeaders(mirrorHeaders...),
+		WithResponseCapture(func(exchange *Exchange) { exchanges <- exchange }),
+	)
+	assert.NoError(t, err)
+
+	defer middleware.Close()
+
+	handler := middleware.Handler(assertBody(t, "hello", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Handler", "true")
+		w.Write([]byte("primary"))
+	})))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	res, err := http.Post(server.URL+"/items?id=1", "text/plain", strings.NewReader("hello"))
+	assert.NoError(t, err)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "primary", string(body))
+
+	var exchange *Exchange
+	select {
+	case <-time.After(5 * time.Second):
+		panic("timed out waiting for mirror")
+	case exchange = <-exchanges:
+	}
+
+	assert.Equal(t, "/items", exchange.Request.URL.Path)
+	assert.Equal(t, "id=1", exchange.Request.URL.RawQuery)
+	assert.Equal(t, http.StatusOK, exchange.Primary.StatusCode)
+	assert.Equal(t, "true", exchange.Primary.Header.Get("X-Handler"))
+	assert.Equal(t, "primary", string(exchange.Primary.Body))
+	assert.NoError(t, exchange.MirrorErr)
+	assert.Equal(t, http.StatusAccepted, exchange.Mirror.StatusCode)
+	assert.Equal(t, "mirror", string(exchange.Mirror.Body))
+}
+
+func TestMiddlewareConfig(t *testing.T) {
+	cfg := &Config{Mirror: MirrorConfig{URL: "http://mirror.internal"}}
+
+	_, err := Middleware(WithMiddlewareConfig(cfg), WithSampleRate(2))
+	assert.Error(t, err)
+	assert.Equal(t, "mirror.sample-rate", err.(ValidationError)[0].Field)
+	assert.Zero(t, cfg.Mirror.SampleRate)
+
+	// requests that aren't sampled only reach the handler
+	_, err = Middleware(WithMiddlewareConfig(cfg), WithSampleRate(0.5))
+	assert.NoError(t, err)
+
+	target := &mirrorTarget{
+		cfg: &Config{
+			Primary: PrimaryConfig{DoMirrorBody: true},
+			Mirror:  MirrorConfig{URL: "http://mirror.internal", SampleRate: 0.0001},
+		},
+		log: logrus.StandardLogger(),
+	}
+	mirrored := 0
+	for i := 0; i < 100; i++ {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+		body := r.Body
+		if _, ok, _ := target.mirrorRequest(r); ok {
+			mirrored++
+		} else {
+			// the body of requests that aren't mirrored isn't buffered
+			assert.Equal(t, body, r.Body)
+		}
+	}
+	assert.True(t, mirrored < 5)
+}
+
+func TestMiddlewareClose(t *testing.T) {
+	mirrored := make(chan struct{}, 10)
+	mirroredServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored <- struct{}{}
+	}))
+	defer mirroredServer.Close()
+
+	middleware, err := Middleware(WithMirrorURL(mirroredServer.URL))
+	assert.NoError(t, err)
+	handler := middleware.Handler(returnBody("primary", http.StatusOK))
+
+	middleware.Close()
+	middleware.Close()
+
+	// requests only reach the handler once the middleware is closed
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, "primary", recorder.Body.String())
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, mirrored)
+}
+
+func TestMiddlewareWebSocket(t *testing.T) {
+	mirrored := make(chan struct{}, 10)
+	mirroredServer := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		mirrored <- struct{}{}
+		io.Copy(ws, ws)
+	}))
+	defer mirroredServer.Close()
+
+	dropped := make(chan DropReason, 1)
+	middleware, err := Middleware(
+		WithMirrorURL(mirroredServer.URL),
+		WithMiddlewareObserver(&ObserverFuncs{
+			MirrorDropped: func(req *http.Request, reason DropReason) { dropped <- reason },
+		}),
+	)
+	assert.NoError(t, err)
+	defer middleware.Close()
+
+	server := httptest.NewServer(middleware.Handler(websocket.Handler(func(ws *websocket.Conn) {
+		io.Copy(ws, ws)
+	})))
+	defer server.Close()
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http"), "", server.URL)
+	assert.NoError(t, err)
+	defer ws.Close()
+
+	assert.NoError(t, websocket.Message.Send(ws, "hello"))
+	var reply string
+	assert.NoError(t, websocket.Message.Receive(ws, &reply))
+	assert.Equal(t, "hello", reply)
+
+	select {
+	case <-time.After(5 * time.Second):
+		panic("timed out waiting for mirror")
+	case reason := <-dropped:
+		assert.Equal(t, DropUnsupported, reason)
+	}
+
+	// upgrades through the middleware never reach the mirror
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, mirrored)
+}
@@ -1,137 +1,573 @@
 package mirror
 
 import (
-	"log"
-
+	"github.com/petereps/gomirror/pkg/discovery"
 	"github.com/petereps/gomirror/pkg/docker"
 
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/docker/docker/client"
 
 	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 // Mirror proxies requests to an upstream server, and
 // mirrors request to a mirror server
 type Mirror struct {
 	*httputil.ReverseProxy
-	client *http.Client
-	cfg    *Config
+	// target holds the current *mirrorTarget, swapped by UpdateConfig
+	target atomic.Value
+
+	// docker is the resolver shared by the primary and mirror, created
+	// when docker lookup is first enabled
+	docker    *docker.DNSResolver
+	dockerMux sync.Mutex
+
+	// noise is the learned noise shared by the mirror targets, loaded when
+	// diffing is first enabled
+	noise    *noiseSet
+	noiseMux sync.Mutex
+
+	// updateErr is the error of the last UpdateConfig, reported by the
+	// readiness check
+	updateMux sync.Mutex
+	updateErr error
+
+	log logrus.FieldLogger
+	// client sends the mirrored requests instead of a client built from
+	// the mirror config, when it is set
+	client    *http.Client
+	observers *observerList
+}
+
+// mirrorTarget is the config and client used for mirrored requests
+type mirrorTarget struct {
+	cfg       *Config
+	client    *http.Client
+	log       logrus.FieldLogger
+	observers *observerList
+	// resolver finds the mirror endpoints, it is nil without discovery and
+	// closed when the target is replaced unless it is the shared docker one
+	resolver discovery.Resolver
+	// balancer picks the mirror endpoints from resolver, it is nil without
+	// discovery
+	balancer *discovery.Balancer
+	// sink is where mirrored requests are sent, closed when the target is
+	// replaced
+	sink Sink
+	// outcomes records the responses of mirrored requests, it is nil
+	// without an outcome log
+	outcomes *outcomeLog
+	// differ compares the mirror responses with the primary, it is nil
+	// unless diffing is enabled
+	differ *differ
+
+	// inflight counts the requests still being mirrored, waited for before
+	// the target is closed
+	inflight  sync.WaitGroup
+	closeMux  sync.RWMutex
+	isClosing bool
+}
+
+func (m *Mirror) newMirrorTarget(cfg *Config) (*mirrorTarget, error) {
+	mirrorURL, err := url.Parse(cfg.Mirror.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	target := &mirrorTarget{
+		cfg:       cfg,
+		log:       m.log,
+		observers: m.observers,
+	}
+	if cfg.Mirror.OutcomeLog != "" {
+		target.outcomes = newOutcomeLog(cfg.Mirror.OutcomeLog)
+	}
+
+	if isSinkScheme(mirrorURL.Scheme) {
+		target.sink, err = newSink(mirrorURL, cfg.Mirror.captureLimit(), m.log)
+		if err != nil {
+			return nil, err
+		}
+		return target, nil
+	}
+
+	if cfg.Mirror.Diff.Enabled {
+		if target.differ, err = m.newDiffer(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	target.resolver, err = m.newResolver(&cfg.Mirror.Discovery, cfg.Mirror.DockerLookup, mirrorURL.Hostname())
+	if err != nil {
+		return nil, err
+	}
+
+	target.client = m.client
+	if target.client != nil {
+		target.sink = &httpSink{client: target.client, log: m.log, limit: cfg.Mirror.captureLimit()}
+		return target, nil
+	}
+
+	mirrorTLS := cfg.Mirror.TLS
+	if target.resolver != nil && mirrorTLS.ServerName == "" {
+		// the balancer swaps the host for an endpoint, so verify against the
+		// configured host name instead
+		mirrorTLS.ServerName = mirrorURL.Hostname()
+	}
+
+	var mirrorTransport http.RoundTripper
+	mirrorTransport, err = upstreamTransport(&mirrorTLS, cfg.Mirror.H2C, m.log)
+	if err != nil {
+		return nil, err
+	}
+	if target.resolver != nil {
+		// an endpoint is picked for every request, as for the primary
+		target.balancer = discovery.NewBalancer(target.resolver, cfg.Mirror.Discovery.Balance, m.log)
+		mirrorTransport = target.balancer.Transport(mirrorTransport)
+	}
+
+	target.client = &http.Client{
+		Timeout:   time.Minute * 1,
+		Transport: mirrorTransport,
+	}
+	target.sink = &httpSink{client: target.client, log: m.log, limit: cfg.Mirror.captureLimit()}
+	return target, nil
+}
+
+// newResolver returns the resolver of the discovery provider for host, or
+// nil when discovery is disabled
+func (m *Mirror) newResolver(c *DiscoveryConfig, lookup DockerLookupConfig, host string) (discovery.Resolver, error) {
+	switch c.provider(lookup) {
+	case "":
+		return nil, nil
+	case ProviderDocker:
+		resolver, err := m.dockerResolver(lookup)
+		if err != nil {
+			return nil, err
+		}
+		return resolver, nil
+	case ProviderStatic:
+		endpoints := []discovery.Endpoint{}
+		for _, s := range c.Endpoints {
+			endpoint, err := discovery.ParseEndpoint(s)
+			if err != nil {
+				return nil, err
+			}
+			endpoints = append(endpoints, endpoint)
+		}
+		return discovery.NewStatic(map[string][]discovery.Endpoint{host: endpoints}), nil
+	case ProviderDNS:
+		resolver, err := discovery.NewDNS(c.DNSServer, m.log)
+		if err != nil {
+			return nil, err
+		}
+		// start looking up host before the first request
+		resolver.Resolve(host)
+		return resolver, nil
+	case ProviderFile:
+		return discovery.NewFile(c.File, m.log)
+	default:
+		return nil, fmt.Errorf("unknown discovery provider %q", c.Provider)
+	}
+}
+
+// acquire counts a request being mirrored, and reports false once t is
+// closing
+func (t *mirrorTarget) acquire() bool {
+	t.closeMux.RLock()
+	defer t.closeMux.RUnlock()
+	if t.isClosing {
+		return false
+	}
+	t.inflight.Add(1)
+	return true
+}
+
+// close waits for the requests being mirrored, then closes the sink,
+// outcome log and resolver of t. The shared docker resolver is kept for the
+// primary and later targets
+func (t *mirrorTarget) close() {
+	t.closeMux.Lock()
+	t.isClosing = true
+	t.closeMux.Unlock()
+	t.inflight.Wait()
+
+	if err := t.sink.Close(); err != nil {
+		t.log.WithError(err).Warnln("error closing mirror sink")
+	}
+	if err := t.outcomes.close(); err != nil {
+		t.log.WithError(err).Warnln("error closing outcome log")
+	}
+
+	if t.resolver == nil {
+		return
+	}
+	if _, ok := t.resolver.(*docker.DNSResolver); ok {
+		return
+	}
+	t.resolver.Close()
+}
+
+// recordsRequests reports whether t writes records of the requests to a
+// sink, instead of sending them to an http mirror
+func (t *mirrorTarget) recordsRequests() bool {
+	_, ok := t.sink.(*httpSink)
+	return t.sink != nil && !ok
+}
+
+// dockerResolver returns the docker resolver, creating it with lookup the
+// first time. Later lookup settings are ignored, validation ensures the
+// primary and mirror use the same settings
+func (m *Mirror) dockerResolver(lookup DockerLookupConfig) (*docker.DNSResolver, error) {
+	m.dockerMux.Lock()
+	defer m.dockerMux.Unlock()
+
+	if m.docker != nil {
+		return m.docker, nil
+	}
+
+	cli, err := client.NewEnvClient()
+	if err != nil {
+		return nil, fmt.Errorf("could not get docker client: %s", err)
+	}
+
+	if lookup.HostIdentifier != "" {
+		m.docker = docker.NewDNSResolverWithOptions(cli, lookup.HostIdentifier, lookup.Network, lookup.ResyncInterval, m.log)
+	} else {
+		m.docker = docker.NewLabelDNSResolver(cli, lookup.LabelPrefix, lookup.Network, lookup.ResyncInterval, m.log)
+	}
+	return m.docker, nil
+}
+
+func (m *Mirror) current() *mirrorTarget {
+	return m.target.Load().(*mirrorTarget)
 }
 
 // New returns an initialized Mirror instance
 func New(cfg *Config) (*Mirror, error) {
+	return newMirror(cfg, &mirrorBuilder{log: logrus.StandardLogger()})
+}
+
+func newMirror(cfg *Config, b *mirrorBuilder) (*Mirror, error) {
 	primaryServerURL, err := url.Parse(cfg.Primary.URL)
 	if err != nil {
 		return nil, err
 	}
 
-	proxy := httputil.NewSingleHostReverseProxy(primaryServerURL)
-	if cfg.Primary.DockerLookup.Enabled {
-		cli, err := client.NewEnvClient()
+	m := &Mirror{log: b.log, client: b.client, observers: &observerList{}}
+	m.AddObserver(b.observers...)
+
+	resolver, err := m.newResolver(&cfg.Primary.Discovery, cfg.Primary.DockerLookup, primaryServerURL.Hostname())
+	if err != nil {
+		return nil, err
+	}
+
+	primaryTLS := cfg.Primary.TLS
+	if resolver != nil && primaryTLS.ServerName == "" {
+		// the resolver swaps the host for an endpoint, so verify against the
+		// configured host name instead
+		primaryTLS.ServerName = primaryServerURL.Hostname()
+	}
+
+	primaryTransport := b.transport
+	if primaryTransport == nil {
+		primaryTransport, err = upstreamTransport(&primaryTLS, cfg.Primary.H2C, m.log)
 		if err != nil {
-			log.Fatalf("could not get docker client: %+v", err)
+			return nil, err
 		}
+	}
 
-		dockerDNS := docker.NewDNSResolver(cli, cfg.Primary.DockerLookup.HostIdentifier)
-		proxy = dockerDNS.ReverseProxy(primaryServerURL)
+	target, err := m.newMirrorTarget(cfg)
+	if err != nil {
+		return nil, err
 	}
 
-	return &Mirror{
-		proxy,
-		&http.Client{
-			Timeout: time.Minute * 1,
-		},
-		cfg,
-	}, nil
+	proxy := httputil.NewSingleHostReverseProxy(primaryServerURL)
+	if resolver != nil {
+		proxy = discovery.NewBalancer(resolver, cfg.Primary.Discovery.Balance, m.log).ReverseProxy(primaryServerURL)
+	}
+	proxy.Transport = &upgradeTransport{primaryTransport}
+
+	m.ReverseProxy = proxy
+	m.target.Store(target)
+	return m, nil
 }
 
-func (m *Mirror) mirror(proxyReq *http.Request) {
-	entry := logrus.WithField("mirror_url", proxyReq.URL.String())
-	entry.Debugln("mirroring")
-	response, err := m.client.Do(proxyReq)
+// UpdateConfig swaps the mirror target, headers and mirroring directives
+// for new requests. The primary url, listener and mode are fixed when the
+// Mirror is created
+func (m *Mirror) UpdateConfig(cfg *Config) error {
+	target, err := m.newMirrorTarget(cfg)
+
+	m.updateMux.Lock()
+	m.updateErr = err
+	m.updateMux.Unlock()
+
 	if err != nil {
-		entry.WithError(err).
-			Debugln("error in mirrored request")
-		return
+		return err
 	}
 
-	body, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		entry.WithError(err).
-			Debugln("error reading mirrored request")
-		return
+	previous := m.current()
+	current := previous.cfg
+	if cfg.Primary.URL != current.Primary.URL || cfg.Mode != current.Mode ||
+		cfg.Port != current.Port || cfg.TLS.Enabled != current.TLS.Enabled ||
+		cfg.Primary.DockerLookup != current.Primary.DockerLookup ||
+		!reflect.DeepEqual(cfg.Primary.Discovery, current.Primary.Discovery) {
+		m.log.Warnln("primary url, mode, port, tls, docker lookup and discovery changes need a restart to take effect")
+	}
+	if cfg.LogLevel != current.LogLevel || cfg.LogFile != current.LogFile {
+		m.log.Warnln("log level and log file changes need a restart to take effect")
+	}
+	if cfg.Mirror.Diff.NoiseFile != current.Mirror.Diff.NoiseFile {
+		m.log.Warnln("mirror noise file changes need a restart to take effect")
 	}
 
-	entry.WithField("response", string(body)).
-		Debugln("mirrored response")
+	if previous.outcomes != nil && previous.outcomes.path == cfg.Mirror.OutcomeLog {
+		// both targets write to the log while the previous one drains,
+		// instead of rotating the same file
+		target.outcomes.close()
+		target.outcomes = previous.outcomes.share()
+	}
+
+	m.target.Store(target)
+	// the previous target is closed once the requests it mirrors are done,
+	// without holding up the caller
+	go previous.close()
+	m.log.WithField("mirror_url", cfg.Mirror.URL).Infoln("updated mirror config")
+	return nil
 }
 
-func (m *Mirror) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+// CapturedResponse is a response of the mirror or primary, read in full
+// unless it is truncated
+type CapturedResponse struct {
+	StatusCode int
+	Header     http.Header
+	Trailer    http.Header
+	Body       []byte
+	// Truncated is set when Body only holds the start of the body, because
+	// it was longer than the max capture size, or nothing of it, because
+	// it was streamed
+	Truncated bool
+	// Latency is the time the response took, it is only set on the
+	// responses reported to observers
+	Latency time.Duration
+}
+
+// readCaptured reads a response body, up to limit bytes
+func readCaptured(r io.Reader, limit int64) (body []byte, truncated bool, err error) {
+	body, err = ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if int64(len(body)) > limit {
+		return body[:limit], true, err
+	}
+	return body, false, err
+}
+
+// do sends the mirrored request to the sink and reads the response, it
+// is nil for sinks without responses
+func (t *mirrorTarget) do(proxyReq *http.Request) (*CapturedResponse, error) {
+	response, err := t.sink.Send(proxyReq)
+	if err == errSinkFull {
+		t.log.Debugln("sink queue is full, dropping mirrored request")
+		t.observers.dropped(proxyReq, DropSinkFull)
+	} else if err != nil && t.recordsRequests() {
+		t.log.WithError(err).Warnln("error writing mirrored request to sink")
+	}
+	return response, err
+}
+
+func (t *mirrorTarget) mirror(proxyReq *http.Request) {
+	t.do(proxyReq)
+}
+
+// sampled decides whether a request is mirrored, with the sample rate of
+// the mirror
+func (t *mirrorTarget) sampled() bool {
+	rate := t.cfg.Mirror.SampleRate
+	return rate <= 0 || rate >= 1 || rand.Float64() < rate
+}
+
+// mirrorRequest builds the copy of r sent to the mirror, with the mirror
+// headers, and sets the primary headers on r. The body of r is buffered,
+// or teed for streaming grpc calls, when it is mirrored. ok is false when
+// r isn't mirrored, err is set when the body of r couldn't be read
+func (t *mirrorTarget) mirrorRequest(r *http.Request) (proxyReq *http.Request, ok bool, err error) {
+	cfg := t.cfg
+
 	// add path and query string (doing this manually so things like localhost work to mirror)
 	path := r.URL.EscapedPath()
 	query := r.URL.RawQuery
-	proxyReqURL := m.cfg.Mirror.URL
-	lastChar := proxyReqURL[len(proxyReqURL)-1]
-	if lastChar == '/' {
-		proxyReqURL = proxyReqURL[:len(proxyReqURL)-2]
+	proxyReqURL := strings.TrimSuffix(cfg.Mirror.URL, "/")
+	if t.recordsRequests() {
+		// sinks record the request as it was received
+		proxyReqURL = ""
 	}
 	if query != "" {
 		query = "?" + query
 	}
 	proxyReqURL = fmt.Sprintf("%s%s%s", proxyReqURL, path, query)
 
-	logrus.WithField("mirror_url", proxyReqURL).Debugln()
+	t.log.WithField("mirror_url", proxyReqURL).Debugln()
 
 	proxyReq, proxyReqErr := http.NewRequest(
 		r.Method, proxyReqURL, nil,
 	)
 	if proxyReqErr != nil {
-		logrus.WithError(proxyReqErr).
+		t.log.WithError(proxyReqErr).
 			Errorln("error creating mirroring request")
+		// keep proxying to the primary with a request that is never sent
+		proxyReq = &http.Request{Header: make(http.Header)}
+	} else if t.recordsRequests() {
+		proxyReq.Host = r.Host
 	}
 
-	if m.cfg.Primary.DoMirrorBody {
+	doMirror := cfg.Mirror.URL != ""
+	switch {
+	case !doMirror:
+	case proxyReqErr != nil:
+		doMirror = false
+		t.observers.dropped(r, DropInvalidRequest)
+	case !t.sampled():
+		doMirror = false
+		t.observers.dropped(r, DropSampledOut)
+	}
+
+	// the body is only buffered when the request is mirrored
+	doMirrorBody := doMirror && cfg.Primary.DoMirrorBody
+	if isGRPCRequest(r) {
+		// grpc messages are framed in the body, so calls are only mirrored
+		// when the method has been allowed
+		mode := cfg.Mirror.GRPC.methodMode(r.URL.Path)
+		if doMirror && mode == grpcMethodIgnored {
+			t.observers.dropped(r, DropGRPCMethod)
+		}
+		doMirror = doMirror && mode != grpcMethodIgnored
+		doMirrorBody = doMirror && mode == grpcMethodUnary
+
+		if doMirror {
+			copyGRPCHeaders(proxyReq, r)
+		}
+
+		if doMirror && mode == grpcMethodStream {
+			r.Body, proxyReq.Body = newStreamTee(r.Body)
+		}
+	}
+
+	if doMirrorBody {
 		// we need to buffer the body in order to send to both upstream
 		// requests
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return nil, false, err
 		}
 
 		r.Body = ioutil.NopCloser(bytes.NewReader(body))
 		proxyReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+		proxyReq.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
 	}
 
-	if m.cfg.Primary.DoMirrorHeaders {
+	if cfg.Primary.DoMirrorHeaders {
 		for key, value := range r.Header {
 			proxyReq.Header.Set(key, value[0])
 		}
 	}
 
-	for _, header := range m.cfg.Mirror.Headers {
+	for _, header := range cfg.Mirror.Headers {
 		proxyReq.Header.Set(header.Key, header.Value)
 	}
 
-	for _, header := range m.cfg.Primary.Headers {
+	for _, header := range cfg.Primary.Headers {
 		r.Header.Set(header.Key, header.Value)
 	}
 
-	if proxyReqErr == nil {
-		go m.mirror(proxyReq)
+	return proxyReq, doMirror, nil
+}
+
+func (m *Mirror) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target := m.current()
+
+	proxyReq, doMirror, err := target.mirrorRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if doMirror && isWebSocketUpgrade(r) && target.recordsRequests() {
+		// a sink can't take part in the websocket session
+		target.observers.dropped(r, DropUnsupported)
+	} else if doMirror && isWebSocketUpgrade(r) {
+		// the mirror gets its own websocket session, fed with the client
+		// frames sent to the primary
+		target.observers.request(proxyReq)
+		session := target.startWebSocketMirror(proxyReq, r)
+		defer session.Close()
+		r = r.WithContext(context.WithValue(r.Context(), websocketSessionKey{}, session))
+	} else if doMirror {
+		target.serve(w, r, proxyReq, m.ReverseProxy)
+		return
 	}
 	m.ReverseProxy.ServeHTTP(w, r)
 }
 
-// Serve serves the mirror
+// handler is the mirror with the health endpoints, unless they are served
+// on the admin port
+func (m *Mirror) handler(cfg *Config) http.Handler {
+	var handler http.Handler = m
+	if cfg.Health.AdminPort == 0 {
+		handler = m.withHealth(handler)
+	}
+
+	if cfg.H2C {
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+	return handler
+}
+
+// Serve serves the mirror, terminating TLS when it is enabled in the config
 func (m *Mirror) Serve(address string) error {
-	return http.ListenAndServe(address, m)
+	cfg := m.current().cfg
+	if cfg.Health.AdminPort != 0 {
+		go m.serveAdmin(cfg.Health.AdminPort)
+	}
+
+	if cfg.Mode == ModeTCP {
+		return m.listenTCP(address)
+	}
+
+	handler := m.handler(cfg)
+
+	if !cfg.TLS.Enabled {
+		return http.ListenAndServe(address, handler)
+	}
+
+	tlsConfig, err := cfg.TLS.serverConfig(m.log)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Addr:      address,
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+	}
+
+	// certificates are served by tlsConfig.GetCertificate
+	return server.ListenAndServeTLS("", "")
 }
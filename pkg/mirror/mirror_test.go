@@ -325,6 +325,55 @@ func TestPaths(t *testing.T) {
 	}
 }
 
+func TestStaticDiscovery(t *testing.T) {
+	backendServer := httptest.NewServer(returnBody("primary", http.StatusOK))
+	defer backendServer.Close()
+
+	done := make(chan struct{})
+	mirroredServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "api-shadow.internal", r.Host)
+		close(done)
+	}))
+	defer mirroredServer.Close()
+
+	cfg := &Config{
+		Primary: PrimaryConfig{
+			URL: "http://api.internal",
+			Discovery: DiscoveryConfig{
+				Provider:  ProviderStatic,
+				Endpoints: []string{strings.TrimPrefix(backendServer.URL, "http://")},
+			},
+		},
+		Mirror: MirrorConfig{
+			URL: "http://api-shadow.internal",
+			Discovery: DiscoveryConfig{
+				Provider:  ProviderStatic,
+				Endpoints: []string{strings.TrimPrefix(mirroredServer.URL, "http://")},
+			},
+		},
+	}
+	assert.NoError(t, cfg.Validate())
+
+	mirror, err := New(cfg)
+	assert.NoError(t, err)
+
+	mirrorProxy := httptest.NewServer(mirror)
+	defer mirrorProxy.Close()
+
+	response, err := http.Get(mirrorProxy.URL)
+	assert.NoError(t, err)
+
+	body, err := ioutil.ReadAll(response.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "primary", string(body))
+
+	select {
+	case <-time.After(5 * time.Second):
+		panic("timed out waiting for mirror")
+	case <-done:
+	}
+}
+
 func TestDockerProxy(t *testing.T) {
 	r := testutils.GetServerContainer()
 	r.Expire(30)
@@ -416,3 +465,31 @@ func TestDockerProxy(t *testing.T) {
 	case <-done:
 	}
 }
+
+func TestDockerMirror(t *testing.T) {
+	r := testutils.GetServerContainer()
+	defer r.Close()
+	r.Expire(30)
+
+	backendServer := httptest.NewServer(returnBody("primary", http.StatusOK))
+	defer backendServer.Close()
+
+	cfg := &Config{
+		Primary: PrimaryConfig{URL: backendServer.URL},
+		Mirror: MirrorConfig{
+			// the port comes from the gomirror.port label
+			URL:          "http://testing-app.com:8080",
+			DockerLookup: DockerLookupConfig{Enabled: true},
+		},
+	}
+	mirror, err := New(cfg)
+	assert.NoError(t, err)
+
+	// the mirror client dials the container found by its labels
+	response, err := mirror.current().client.Get(cfg.Mirror.URL)
+	assert.NoError(t, err)
+
+	resStr, err := ioutil.ReadAll(response.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world", string(resStr))
+}
@@ -0,0 +1,313 @@
+package mirror
+
+import (
+	"bufio"
+	"bytes"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DropReason is why a request wasn't mirrored
+type DropReason string
+
+// Reasons requests are dropped instead of mirrored
+const (
+	// DropSampledOut requests weren't picked by the mirror sample rate
+	DropSampledOut DropReason = "sampled-out"
+	// DropGRPCMethod grpc calls are for a method that isn't mirrored
+	DropGRPCMethod DropReason = "grpc-method"
+	// DropInvalidRequest requests couldn't be copied for the mirror
+	DropInvalidRequest DropReason = "invalid-request"
+	// DropUnsupported requests can't be sent to the sink, eg websocket
+	// upgrades to a file sink or through the middleware
+	DropUnsupported DropReason = "unsupported"
+	// DropSinkFull requests didn't fit in the queue of a sink command that
+	// isn't keeping up
+	DropSinkFull DropReason = "sink-full"
+)
+
+// Observer is notified of mirrored requests, eg to assert on the mirror
+// responses in tests. Callbacks are called from the goroutines serving and
+// mirroring requests, concurrently, and should return quickly
+type Observer interface {
+	// OnMirrorRequest is called before a mirrored request is sent
+	OnMirrorRequest(req *http.Request)
+	// OnMirrorResponse is called once both the primary and the mirror
+	// responded, with the mirrored request and the time the mirror took.
+	// mirror is nil when err is set, or when the mirror is a sink without
+	// responses, eg a file. Websocket upgrades, whose responses aren't
+	// recorded, are not reported
+	OnMirrorResponse(req *http.Request, primary, mirror *CapturedResponse, err error, latency time.Duration)
+	// OnMirrorDropped is called with the incoming request when it isn't
+	// mirrored
+	OnMirrorDropped(req *http.Request, reason DropReason)
+}
+
+// ObserverFuncs is an Observer calling the funcs that are set
+type ObserverFuncs struct {
+	MirrorRequest  func(req *http.Request)
+	MirrorResponse func(req *http.Request, primary, mirror *CapturedResponse, err error, latency time.Duration)
+	MirrorDropped  func(req *http.Request, reason DropReason)
+}
+
+// OnMirrorRequest calls f.MirrorRequest
+func (f *ObserverFuncs) OnMirrorRequest(req *http.Request) {
+	if f.MirrorRequest != nil {
+		f.MirrorRequest(req)
+	}
+}
+
+// OnMirrorResponse calls f.MirrorResponse
+func (f *ObserverFuncs) OnMirrorResponse(req *http.Request, primary, mirror *CapturedResponse, err error, latency time.Duration) {
+	if f.MirrorResponse != nil {
+		f.MirrorResponse(req, primary, mirror, err, latency)
+	}
+}
+
+// OnMirrorDropped calls f.MirrorDropped
+func (f *ObserverFuncs) OnMirrorDropped(req *http.Request, reason DropReason) {
+	if f.MirrorDropped != nil {
+		f.MirrorDropped(req, reason)
+	}
+}
+
+// observerList is the observers registered on a Mirror, shared by its
+// mirror targets
+type observerList struct {
+	mux  sync.RWMutex
+	list []Observer
+}
+
+func (o *observerList) add(observers ...Observer) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+
+	// copied so that get can be ranged over without the lock
+	o.list = append(append([]Observer{}, o.list...), observers...)
+}
+
+func (o *observerList) get() []Observer {
+	if o == nil {
+		return nil
+	}
+
+	o.mux.RLock()
+	defer o.mux.RUnlock()
+	return o.list
+}
+
+func (o *observerList) request(req *http.Request) {
+	for _, observer := range o.get() {
+		observer.OnMirrorRequest(req)
+	}
+}
+
+func (o *observerList) response(req *http.Request, primary, mirror *CapturedResponse, err error, latency time.Duration) {
+	for _, observer := range o.get() {
+		observer.OnMirrorResponse(req, primary, mirror, err, latency)
+	}
+}
+
+func (o *observerList) dropped(req *http.Request, reason DropReason) {
+	for _, observer := range o.get() {
+		observer.OnMirrorDropped(req, reason)
+	}
+}
+
+// AddObserver registers observers to be notified of mirrored requests
+func (m *Mirror) AddObserver(observers ...Observer) {
+	m.observers.add(observers...)
+}
+
+// serve serves r with next and sends the mirrored request in the
+// background. When observers, an outcome log or diffing are enabled the
+// response of next is recorded, and reported with the mirror response
+func (t *mirrorTarget) serve(w http.ResponseWriter, r *http.Request, proxyReq *http.Request, next http.Handler) {
+	if !t.acquire() {
+		// the target was replaced since the request came in
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	diffed := t.differ != nil && !isGRPCRequest(r)
+	if len(t.observers.get()) == 0 && t.outcomes == nil && !diffed {
+		go func() {
+			defer t.inflight.Done()
+			t.observers.request(proxyReq)
+			t.mirror(proxyReq)
+		}()
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	var secondaryReq *http.Request
+	if diffed && t.differ.sampled(r.Method) {
+		var err error
+		if secondaryReq, err = t.differ.secondaryRequest(r, proxyReq); err != nil {
+			t.log.WithError(err).Warnln("error creating secondary request")
+		}
+	}
+
+	var mirror, secondary *CapturedResponse
+	var mirrorErr error
+	var latency time.Duration
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		t.observers.request(proxyReq)
+		start := time.Now()
+		mirror, mirrorErr = t.do(proxyReq)
+		latency = time.Since(start)
+
+		if secondaryReq != nil {
+			secondary = t.differ.send(secondaryReq)
+		}
+	}()
+
+	served := false
+	defer func() {
+		if !served {
+			// next panicked, eg to abort the response
+			go func() {
+				<-done
+				t.inflight.Done()
+			}()
+		}
+	}()
+
+	method, path := r.Method, r.URL.Path
+	recorder := &responseRecorder{ResponseWriter: w, limit: t.cfg.Mirror.captureLimit()}
+	start := time.Now()
+	next.ServeHTTP(recorder, r)
+	served = true
+	primary := recorder.response()
+	primary.Latency = time.Since(start)
+
+	go func() {
+		defer t.inflight.Done()
+		<-done
+		if mirror != nil {
+			mirror.Latency = latency
+		}
+		if err := t.outcomes.record(method, path, primary, mirror, mirrorErr); err != nil {
+			t.log.WithError(err).Warnln("error writing outcome log")
+		}
+		if diffed {
+			t.differ.compare(method, path, primary, mirror, secondary)
+		}
+		t.observers.response(proxyReq, primary, mirror, mirrorErr, latency)
+	}()
+}
+
+// responseRecorder copies the response written by a handler, up to limit
+// bytes of its body. Event streams and hijacked connections aren't copied
+type responseRecorder struct {
+	http.ResponseWriter
+	limit int64
+
+	code int
+	// header is the header as it was sent, trailers are set on the header
+	// of the ResponseWriter after it
+	header    http.Header
+	body      bytes.Buffer
+	truncated bool
+}
+
+// start records the status and header when the response is sent
+func (r *responseRecorder) start(code int) {
+	if r.code != 0 {
+		return
+	}
+
+	r.code = code
+	r.header = r.Header().Clone()
+	if mediaType, _, _ := mime.ParseMediaType(r.header.Get("Content-Type")); mediaType == "text/event-stream" {
+		r.discard()
+	}
+}
+
+// discard stops copying the body, it is streamed
+func (r *responseRecorder) discard() {
+	r.truncated = true
+	r.body = bytes.Buffer{}
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	r.start(code)
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	r.start(http.StatusOK)
+	if !r.truncated {
+		if room := r.limit - int64(r.body.Len()); int64(len(p)) > room {
+			r.body.Write(p[:room])
+			r.truncated = true
+		} else {
+			r.body.Write(p)
+		}
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+func (r *responseRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack hijacks the connection of the ResponseWriter, what is written to
+// it isn't copied
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+
+	r.start(http.StatusSwitchingProtocols)
+	r.discard()
+	return hijacker.Hijack()
+}
+
+// Unwrap returns the ResponseWriter, for http.ResponseController
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *responseRecorder) response() *CapturedResponse {
+	r.start(http.StatusOK)
+
+	// trailers are declared in the Trailer header, or set with the trailer
+	// prefix once the body is written
+	header := r.Header()
+	trailer := http.Header{}
+	for _, declared := range r.header.Values("Trailer") {
+		for _, key := range strings.Split(declared, ",") {
+			key = http.CanonicalHeaderKey(strings.TrimSpace(key))
+			if values, ok := header[key]; ok && key != "" {
+				trailer[key] = append([]string{}, values...)
+			}
+		}
+	}
+	for key, values := range header {
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			trailer[http.CanonicalHeaderKey(strings.TrimPrefix(key, http.TrailerPrefix))] = append([]string{}, values...)
+		}
+	}
+
+	captured := &CapturedResponse{
+		StatusCode: r.code,
+		Header:     r.header,
+		Body:       r.body.Bytes(),
+		Truncated:  r.truncated,
+	}
+	if len(trailer) > 0 {
+		captured.Trailer = trailer
+	}
+	return captured
+}
@@ -0,0 +1,198 @@
+package mirror
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingObserver records the callbacks it gets
+type recordingObserver struct {
+	mux       sync.Mutex
+	requests  []string
+	responses chan *Exchange
+	dropped   []DropReason
+}
+
+func newRecordingObserver() *recordingObserver {
+	return &recordingObserver{responses: make(chan *Exchange, 10)}
+}
+
+func (o *recordingObserver) OnMirrorRequest(req *http.Request) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.requests = append(o.requests, req.URL.Path)
+}
+
+func (o *recordingObserver) OnMirrorResponse(req *http.Request, primary, mirror *CapturedResponse, err error, latency time.Duration) {
+	o.responses <- &Exchange{Request: req, Primary: primary, Mirror: mirror, MirrorErr: err, Latency: latency}
+}
+
+func (o *recordingObserver) OnMirrorDropped(req *http.Request, reason DropReason) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.dropped = append(o.dropped, reason)
+}
+
+func (o *recordingObserver) response() *Exchange {
+	select {
+	case <-time.After(5 * time.Second):
+		panic("timed out waiting for mirror")
+	case exchange := <-o.responses:
+		return exchange
+	}
+}
+
+func TestObservers(t *testing.T) {
+	backendServer := httptest.NewServer(returnBody("primary", http.StatusOK))
+	defer backendServer.Close()
+
+	mirroredServer := httptest.NewServer(returnBody("mirror", http.StatusNotFound))
+	defer mirroredServer.Close()
+
+	first := newRecordingObserver()
+	second := newRecordingObserver()
+
+	mirror, err := NewMirror(
+		WithPrimary(backendServer.URL),
+		WithMirrorTarget(mirroredServer.URL),
+		WithObserver(first),
+	)
+	assert.NoError(t, err)
+	mirror.AddObserver(second)
+
+	mirrorProxy := httptest.NewServer(mirror)
+	defer mirrorProxy.Close()
+
+	res, err := http.Get(mirrorProxy.URL + "/items")
+	assert.NoError(t, err)
+	res.Body.Close()
+
+	for _, observer := range []*recordingObserver{first, second} {
+		exchange := observer.response()
+		assert.Equal(t, "/items", exchange.Request.URL.Path)
+		assert.Equal(t, http.StatusOK, exchange.Primary.StatusCode)
+		assert.Equal(t, "primary", string(exchange.Primary.Body))
+		assert.NoError(t, exchange.MirrorErr)
+		assert.Equal(t, http.StatusNotFound, exchange.Mirror.StatusCode)
+		assert.Equal(t, "mirror", string(exchange.Mirror.Body))
+		assert.True(t, exchange.Latency > 0)
+
+		observer.mux.Lock()
+		assert.Equal(t, []string{"/items"}, observer.requests)
+		observer.mux.Unlock()
+	}
+
+	// mirror errors are reported with the primary response
+	mirroredServer.Close()
+	res, err = http.Get(mirrorProxy.URL + "/gone")
+	assert.NoError(t, err)
+	res.Body.Close()
+
+	exchange := first.response()
+	assert.Error(t, exchange.MirrorErr)
+	assert.Nil(t, exchange.Mirror)
+	assert.Equal(t, "primary", string(exchange.Primary.Body))
+}
+
+func TestObserverDropped(t *testing.T) {
+	backendServer := httptest.NewServer(returnBody("primary", http.StatusOK))
+	defer backendServer.Close()
+
+	observer := newRecordingObserver()
+	mirror, err := NewMirror(
+		WithConfig(&Config{
+			Mirror: MirrorConfig{
+				SampleRate: 0.0001,
+				GRPC:       GRPCConfig{Methods: []string{"/svc.A/Get"}},
+			},
+		}),
+		WithPrimary(backendServer.URL),
+		WithMirrorTarget("http://mirror.internal"),
+		WithObserver(observer),
+	)
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	mirror.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// grpc methods that aren't allowed are dropped, whatever the sample rate
+	mirror.current().cfg.Mirror.SampleRate = 0
+	req := httptest.NewRequest(http.MethodPost, "/svc.B/List", nil)
+	req.Header.Set("Content-Type", "application/grpc")
+	target := mirror.current()
+	_, ok, err := target.mirrorRequest(req)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	observer.mux.Lock()
+	defer observer.mux.Unlock()
+	assert.Equal(t, []DropReason{DropSampledOut, DropGRPCMethod}, observer.dropped)
+	assert.Empty(t, observer.requests)
+}
+
+func TestResponseRecorder(t *testing.T) {
+	// bodies are copied up to the limit
+	recorder := &responseRecorder{ResponseWriter: httptest.NewRecorder(), limit: 4}
+	recorder.Write([]byte("abc"))
+	recorder.Write([]byte("def"))
+	res := recorder.response()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "abcd", string(res.Body))
+	assert.True(t, res.Truncated)
+	assert.Equal(t, "abcdef", recorder.ResponseWriter.(*httptest.ResponseRecorder).Body.String())
+
+	// event streams aren't copied
+	recorder = &responseRecorder{ResponseWriter: httptest.NewRecorder(), limit: 1024}
+	recorder.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	recorder.WriteHeader(http.StatusOK)
+	recorder.Write([]byte("data: 1\n\n"))
+	recorder.Flush()
+	res = recorder.response()
+	assert.Empty(t, res.Body)
+	assert.True(t, res.Truncated)
+
+	// trailers are split from the header
+	recorder = &responseRecorder{ResponseWriter: httptest.NewRecorder(), limit: 1024}
+	recorder.Header().Set("Trailer", "Grpc-Status")
+	recorder.Write([]byte("body"))
+	recorder.Header().Set("Grpc-Status", "0")
+	recorder.Header().Set(http.TrailerPrefix+"Grpc-Message", "ok")
+	res = recorder.response()
+	assert.Equal(t, "body", string(res.Body))
+	assert.False(t, res.Truncated)
+	assert.Empty(t, res.Header.Get("Grpc-Status"))
+	assert.Equal(t, http.Header{"Grpc-Status": {"0"}, "Grpc-Message": {"ok"}}, res.Trailer)
+
+	// the ResponseWriter is reachable by http.ResponseController
+	recorder = &responseRecorder{ResponseWriter: httptest.NewRecorder(), limit: 1024}
+	assert.NoError(t, http.NewResponseController(recorder).Flush())
+	_, _, err := http.NewResponseController(recorder).Hijack()
+	assert.Error(t, err)
+
+	hijacked := make(chan *CapturedResponse, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &responseRecorder{ResponseWriter: w, limit: 1024}
+		conn, buf, err := recorder.Hijack()
+		assert.NoError(t, err)
+		buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok")
+		buf.Flush()
+		conn.Close()
+		hijacked <- recorder.response()
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	assert.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", string(body))
+	assert.True(t, (<-hijacked).Truncated)
+}
@@ -0,0 +1,130 @@
+package mirror
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+// MirrorOption configures a Mirror built by NewMirror
+type MirrorOption func(b *mirrorBuilder) error
+
+// mirrorBuilder is what NewMirror builds a Mirror from
+type mirrorBuilder struct {
+	cfg Config
+	// transport sends the requests to the primary, built from the primary
+	// config when it is nil
+	transport http.RoundTripper
+	// client sends the requests to the mirror, built from the mirror config
+	// when it is nil
+	client    *http.Client
+	log       logrus.FieldLogger
+	observers []Observer
+}
+
+// WithConfig starts from the settings of cfg, eg loaded by InitConfig.
+// Later options override them, and leave cfg as it is
+var WithConfig = func(cfg *Config) MirrorOption {
+	return func(b *mirrorBuilder) error {
+		if cfg == nil {
+			return errors.New("nil config")
+		}
+
+		b.cfg = *cfg.copy()
+		return nil
+	}
+}
+
+// WithPrimary proxies requests to url, adding headers to them
+var WithPrimary = func(url string, headers ...Header) MirrorOption {
+	return func(b *mirrorBuilder) error {
+		b.cfg.Primary.URL = url
+		b.cfg.Primary.Headers = append(b.cfg.Primary.Headers, headers...)
+		return nil
+	}
+}
+
+// WithMirrorTarget mirrors requests to url, adding headers to them
+var WithMirrorTarget = func(url string, headers ...Header) MirrorOption {
+	return func(b *mirrorBuilder) error {
+		b.cfg.Mirror.URL = url
+		b.cfg.Mirror.Headers = append(b.cfg.Mirror.Headers, headers...)
+		return nil
+	}
+}
+
+// WithTransport sends the requests to the primary with transport, instead
+// of a transport built from the primary tls and h2c settings
+var WithTransport = func(transport http.RoundTripper) MirrorOption {
+	return func(b *mirrorBuilder) error {
+		if transport == nil {
+			return errors.New("nil transport")
+		}
+		b.transport = transport
+		return nil
+	}
+}
+
+// WithHTTPClient sends the mirrored requests with client, instead of a
+// client built from the mirror tls, h2c and discovery settings
+var WithHTTPClient = func(client *http.Client) MirrorOption {
+	return func(b *mirrorBuilder) error {
+		if client == nil {
+			return errors.New("nil http client")
+		}
+		b.client = client
+		return nil
+	}
+}
+
+// WithLogger logs to logger instead of the standard logrus logger, also
+// from the discovery and docker lookups. The etcd watch of a config given
+// with WithConfig logs where WithEtcdLogger set
+var WithLogger = func(logger logrus.FieldLogger) MirrorOption {
+	return func(b *mirrorBuilder) error {
+		if logger == nil {
+			return errors.New("nil logger")
+		}
+		b.log = logger
+		return nil
+	}
+}
+
+// WithObserver registers observer to be notified of mirrored requests,
+// like Mirror.AddObserver
+var WithObserver = func(observer Observer) MirrorOption {
+	return func(b *mirrorBuilder) error {
+		if observer == nil {
+			return errors.New("nil observer")
+		}
+		b.observers = append(b.observers, observer)
+		return nil
+	}
+}
+
+// NewMirror returns a Mirror built from opts, without viper, config files
+// or the environment. Unlike InitConfig it doesn't change global state,
+// so several mirrors can run in one process. Headers and bodies are
+// mirrored unless a config without those directives is given with
+// WithConfig
+func NewMirror(opts ...MirrorOption) (*Mirror, error) {
+	b := &mirrorBuilder{
+		cfg: Config{
+			Primary: PrimaryConfig{DoMirrorHeaders: true, DoMirrorBody: true},
+		},
+		log: logrus.StandardLogger(),
+	}
+
+	for _, opt := range opts {
+		if err := opt(b); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := b.cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return newMirror(&b.cfg, b)
+}
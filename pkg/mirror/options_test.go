@@ -0,0 +1,178 @@
+package mirror
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingTransport counts the requests it sends
+type countingTransport struct {
+	count int32
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&t.count, 1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestNewMirror(t *testing.T) {
+	level := logrus.GetLevel()
+
+	servers := []*httptest.Server{}
+	mirrored := make(chan string, 2)
+	for _, name := range []string{"a", "b"} {
+		name := name
+		primary := httptest.NewServer(assertHeaders(t, []Header{{Key: "X-Primary", Value: name}}, returnBody("primary "+name, http.StatusOK)))
+		defer primary.Close()
+
+		mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mirrored <- name + " " + r.Header.Get("X-Mirror")
+		}))
+		defer mirror.Close()
+
+		servers = append(servers, primary, mirror)
+	}
+
+	// two mirrors in one process, with their own transports and loggers
+	transport := &countingTransport{}
+	client := &countingTransport{}
+	logger, hook := test.NewNullLogger()
+	logger.SetLevel(logrus.DebugLevel)
+
+	a, err := NewMirror(
+		WithPrimary(servers[0].URL, Header{Key: "X-Primary", Value: "a"}),
+		WithMirrorTarget(servers[1].URL, Header{Key: "X-Mirror", Value: "a"}),
+		WithTransport(transport),
+		WithHTTPClient(&http.Client{Transport: client}),
+		WithLogger(logger),
+	)
+	assert.NoError(t, err)
+
+	b, err := NewMirror(
+		WithConfig(&Config{Primary: PrimaryConfig{URL: servers[2].URL}}),
+		WithPrimary(servers[2].URL, Header{Key: "X-Primary", Value: "b"}),
+		WithMirrorTarget(servers[3].URL, Header{Key: "X-Mirror", Value: "b"}),
+	)
+	assert.NoError(t, err)
+
+	for _, m := range []*Mirror{a, b} {
+		proxy := httptest.NewServer(m)
+		defer proxy.Close()
+
+		res, err := http.Get(proxy.URL)
+		assert.NoError(t, err)
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.NoError(t, err)
+		assert.Contains(t, string(body), "primary")
+
+		select {
+		case <-time.After(5 * time.Second):
+			panic("timed out waiting for mirror")
+		case name := <-mirrored:
+			assert.Contains(t, []string{"a a", "b b"}, name)
+		}
+	}
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&transport.count))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&client.count))
+	assert.NotEmpty(t, hook.AllEntries())
+	assert.Equal(t, level, logrus.GetLevel())
+}
+
+func TestNewMirrorValidates(t *testing.T) {
+	_, err := NewMirror(WithMirrorTarget("http://mirror.internal"))
+	assert.Error(t, err)
+	assert.Equal(t, "primary.url", err.(ValidationError)[0].Field)
+
+	_, err = NewMirror(WithPrimary("http://primary.internal"), WithTransport(nil))
+	assert.Error(t, err)
+}
+
+func TestNewMirrorLoggerDiscovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomirror-discovery")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	primary := httptest.NewServer(returnBody("primary", http.StatusOK))
+	defer primary.Close()
+	mirrored := make(chan struct{}, 1)
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored <- struct{}{}
+	}))
+	defer mirror.Close()
+
+	// the mirror host isn't in the file, so the balancer logs it and dials
+	// it as is
+	path := filepath.Join(dir, "endpoints")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("other.internal 10.0.0.1:80\n"), 0644))
+
+	cfg := &Config{}
+	cfg.Mirror.Discovery = DiscoveryConfig{Provider: ProviderFile, File: path}
+	logger, hook := test.NewNullLogger()
+	m, err := NewMirror(
+		WithConfig(cfg),
+		WithPrimary(primary.URL),
+		WithMirrorTarget(mirror.URL),
+		WithLogger(logger),
+	)
+	assert.NoError(t, err)
+
+	proxy := httptest.NewServer(m)
+	defer proxy.Close()
+
+	res, err := http.Get(proxy.URL)
+	assert.NoError(t, err)
+	res.Body.Close()
+
+	select {
+	case <-time.After(5 * time.Second):
+		panic("timed out waiting for mirror")
+	case <-mirrored:
+	}
+
+	found := false
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "no endpoints found for host 127.0.0.1. Defering to system dns" {
+			found = true
+		}
+	}
+	assert.True(t, found)
+}
+
+func TestWithConfigCopies(t *testing.T) {
+	cfg := &Config{}
+	cfg.Mirror.Headers = []Header{{Key: "X-Mirror", Value: "true"}}
+	cfg.Mirror.Discovery.Endpoints = []string{"10.0.0.1:80"}
+	cfg.Mirror.Diff.Compare = []CompareConfig{{
+		Ignore:    []string{"$.time"},
+		Unordered: []UnorderedArray{{Path: "$.items"}},
+	}}
+	cfg.secretPaths = map[string]bool{"mirror.url": true}
+
+	b := &mirrorBuilder{}
+	assert.NoError(t, WithConfig(cfg)(b))
+	assert.Equal(t, *cfg, b.cfg)
+
+	cfg.Mirror.Headers[0].Value = "false"
+	cfg.Mirror.Discovery.Endpoints[0] = "10.0.0.2:80"
+	cfg.Mirror.Diff.Compare[0].Ignore[0] = "$.id"
+	cfg.Mirror.Diff.Compare[0].Unordered[0].Key = "id"
+	cfg.secretPaths["primary.url"] = true
+
+	assert.Equal(t, "true", b.cfg.Mirror.Headers[0].Value)
+	assert.Equal(t, "10.0.0.1:80", b.cfg.Mirror.Discovery.Endpoints[0])
+	assert.Equal(t, "$.time", b.cfg.Mirror.Diff.Compare[0].Ignore[0])
+	assert.Empty(t, b.cfg.Mirror.Diff.Compare[0].Unordered[0].Key)
+	assert.Equal(t, map[string]bool{"mirror.url": true}, b.cfg.secretPaths)
+}
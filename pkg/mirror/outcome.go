@@ -0,0 +1,154 @@
+package mirror
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outcome is the primary and mirror responses of a mirrored request, as
+// written to the outcome log, one json object per line
+type Outcome struct {
+	Time   time.Time `json:"time"`
+	Method string    `json:"method"`
+	// Route is the request path with ids replaced by :id, eg /items/:id
+	Route          string  `json:"route"`
+	PrimaryStatus  int     `json:"primary_status"`
+	PrimaryLatency float64 `json:"primary_latency_ms"`
+	PrimaryHash    string  `json:"primary_body_hash"`
+	// MirrorStatus and MirrorHash are empty when MirrorError or
+	// MirrorDropped is set
+	MirrorStatus  int     `json:"mirror_status,omitempty"`
+	MirrorLatency float64 `json:"mirror_latency_ms"`
+	MirrorHash    string  `json:"mirror_body_hash,omitempty"`
+	MirrorError   string  `json:"mirror_error,omitempty"`
+	// MirrorDropped is set when the request was never sent, because the
+	// sink queue was full
+	MirrorDropped bool `json:"mirror_dropped,omitempty"`
+}
+
+// RouteOf returns the route of a request path, with the segments that look
+// like ids replaced by :id so that requests for different items are
+// grouped together
+func RouteOf(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if isIDSegment(segment) {
+			segments[i] = ":id"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// isIDSegment reports whether a path segment is a number, a uuid or a long
+// hex string
+func isIDSegment(segment string) bool {
+	if segment == "" {
+		return false
+	}
+
+	digits := true
+	for _, r := range segment {
+		switch {
+		case r >= '0' && r <= '9':
+		case r >= 'a' && r <= 'f', r >= 'A' && r <= 'F', r == '-':
+			digits = false
+		default:
+			return false
+		}
+	}
+	return digits || len(segment) >= 16
+}
+
+// bodyHash hashes the body of res, prefixed with partial: when only the
+// start of it was captured
+func bodyHash(res *CapturedResponse) string {
+	sum := sha256.Sum256(res.Body)
+	if res.Truncated {
+		return "partial:" + hex.EncodeToString(sum[:])
+	}
+	return hex.EncodeToString(sum[:])
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// outcomeLog writes outcomes to a file, rotated like the file sink. It is
+// shared by the targets with the same path, and closed with the last one
+type outcomeLog struct {
+	path string
+	file *fileSink
+
+	mux  sync.Mutex
+	refs int
+}
+
+func newOutcomeLog(path string) *outcomeLog {
+	return &outcomeLog{
+		path: path,
+		file: &fileSink{path: path, maxSize: defaultSinkMaxSize, maxBackups: defaultSinkMaxBackups},
+		refs: 1,
+	}
+}
+
+// share returns l for another target
+func (l *outcomeLog) share() *outcomeLog {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.refs++
+	return l
+}
+
+// record writes the outcome of a request. Requests sent to sinks without
+// responses have nothing to compare and aren't recorded
+func (l *outcomeLog) record(method, path string, primary, mirror *CapturedResponse, err error) error {
+	if l == nil || (mirror == nil && err == nil) {
+		return nil
+	}
+
+	outcome := &Outcome{
+		Time:           time.Now().UTC(),
+		Method:         method,
+		Route:          RouteOf(path),
+		PrimaryStatus:  primary.StatusCode,
+		PrimaryLatency: milliseconds(primary.Latency),
+		PrimaryHash:    bodyHash(primary),
+	}
+	switch {
+	case err == errSinkFull:
+		outcome.MirrorDropped = true
+	case err != nil:
+		outcome.MirrorError = err.Error()
+	default:
+		outcome.MirrorStatus = mirror.StatusCode
+		outcome.MirrorLatency = milliseconds(mirror.Latency)
+		outcome.MirrorHash = bodyHash(mirror)
+	}
+
+	line, err := json.Marshal(outcome)
+	if err != nil {
+		return err
+	}
+	return l.file.write(append(line, '\n'))
+}
+
+// close closes the file once no target shares l anymore
+func (l *outcomeLog) close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mux.Lock()
+	l.refs--
+	last := l.refs == 0
+	l.mux.Unlock()
+
+	if !last {
+		return nil
+	}
+	return l.file.Close()
+}
@@ -0,0 +1,187 @@
+package mirror
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouteOf(t *testing.T) {
+	cases := map[string]string{
+		"/":                "/",
+		"/items":           "/items",
+		"/items/42":        "/items/:id",
+		"/items/42/tags/7": "/items/:id/tags/:id",
+		"/users/3f2504e0-4f89-11d3-9a0c-0305e82c3301": "/users/:id",
+		"/commits/0123456789abcdef0123":               "/commits/:id",
+		"/v2/items/cafe":                              "/v2/items/cafe",
+	}
+
+	for path, route := range cases {
+		assert.Equal(t, route, RouteOf(path), path)
+	}
+}
+
+func TestOutcomeLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomirror-outcomes")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	primary := httptest.NewServer(returnBody("same", http.StatusOK))
+	defer primary.Close()
+	mirrored := httptest.NewServer(returnBody("different", http.StatusNotFound))
+	defer mirrored.Close()
+
+	responses := make(chan struct{}, 1)
+	path := filepath.Join(dir, "outcomes.ndjson")
+	m, err := NewMirror(
+		WithConfig(&Config{Mirror: MirrorConfig{OutcomeLog: path}}),
+		WithPrimary(primary.URL),
+		WithMirrorTarget(mirrored.URL),
+		WithObserver(&ObserverFuncs{
+			MirrorResponse: func(req *http.Request, primary, mirror *CapturedResponse, err error, latency time.Duration) {
+				assert.True(t, primary.Latency > 0)
+				assert.Equal(t, latency, mirror.Latency)
+				responses <- struct{}{}
+			},
+		}),
+	)
+	assert.NoError(t, err)
+
+	proxy := httptest.NewServer(m)
+	defer proxy.Close()
+
+	res, err := http.Get(proxy.URL + "/items/42")
+	assert.NoError(t, err)
+	res.Body.Close()
+
+	select {
+	case <-time.After(5 * time.Second):
+		panic("timed out waiting for mirror")
+	case <-responses:
+	}
+
+	// the outcome is written before the observers are notified
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+
+	outcome := Outcome{}
+	assert.NoError(t, json.Unmarshal([]byte(strings.TrimSpace(string(data))), &outcome))
+	assert.Equal(t, http.MethodGet, outcome.Method)
+	assert.Equal(t, "/items/:id", outcome.Route)
+	assert.Equal(t, http.StatusOK, outcome.PrimaryStatus)
+	assert.Equal(t, http.StatusNotFound, outcome.MirrorStatus)
+	assert.Equal(t, bodyHash(&CapturedResponse{Body: []byte("same")}), outcome.PrimaryHash)
+	assert.Equal(t, bodyHash(&CapturedResponse{Body: []byte("different")}), outcome.MirrorHash)
+	assert.True(t, outcome.PrimaryLatency > 0)
+	assert.Empty(t, outcome.MirrorError)
+}
+
+func TestOutcomeDropped(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomirror-outcomes")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "outcomes.ndjson")
+	log := newOutcomeLog(path)
+	assert.NoError(t, log.record(http.MethodPost, "/items", &CapturedResponse{StatusCode: http.StatusOK}, nil, errSinkFull))
+	assert.NoError(t, log.close())
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+
+	outcome := Outcome{}
+	assert.NoError(t, json.Unmarshal(data, &outcome))
+	assert.True(t, outcome.MirrorDropped)
+	assert.Empty(t, outcome.MirrorError)
+}
+
+func TestOutcomeLogUpdateConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomirror-outcomes")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	primary := httptest.NewServer(returnBody("primary", http.StatusOK))
+	defer primary.Close()
+
+	received := make(chan struct{}, 1)
+	release := make(chan struct{})
+	mirrored := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-release
+		w.Write([]byte("mirror"))
+	}))
+	defer mirrored.Close()
+
+	responses := make(chan error, 1)
+	path := filepath.Join(dir, "outcomes.ndjson")
+	cfg := &Config{
+		Primary: PrimaryConfig{URL: primary.URL},
+		Mirror:  MirrorConfig{URL: mirrored.URL, OutcomeLog: path},
+	}
+	m, err := NewMirror(
+		WithConfig(cfg),
+		WithObserver(&ObserverFuncs{
+			MirrorResponse: func(req *http.Request, primary, mirror *CapturedResponse, err error, latency time.Duration) {
+				responses <- err
+			},
+		}),
+	)
+	assert.NoError(t, err)
+
+	proxy := httptest.NewServer(m)
+	defer proxy.Close()
+
+	res, err := http.Get(proxy.URL + "/items/42")
+	assert.NoError(t, err)
+	res.Body.Close()
+
+	select {
+	case <-time.After(5 * time.Second):
+		panic("timed out waiting for mirror")
+	case <-received:
+	}
+
+	// the log is kept by the new target while the request is in flight
+	previous := m.current()
+	assert.NoError(t, m.UpdateConfig(cfg))
+	assert.True(t, m.current().outcomes == previous.outcomes)
+	close(release)
+
+	select {
+	case <-time.After(5 * time.Second):
+		panic("timed out waiting for mirror")
+	case err := <-responses:
+		assert.NoError(t, err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	outcome := Outcome{}
+	assert.NoError(t, json.Unmarshal(data, &outcome))
+	assert.Equal(t, http.StatusOK, outcome.MirrorStatus)
+
+	// the log is closed with the last target using it, once the previous
+	// targets are drained
+	shared := m.current().outcomes
+	assert.NoError(t, m.UpdateConfig(&Config{Primary: cfg.Primary, Mirror: MirrorConfig{URL: mirrored.URL}}))
+	for start := time.Now(); !shared.isClosed(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			panic("timed out waiting for the outcome log to close")
+		}
+	}
+}
+
+func (l *outcomeLog) isClosed() bool {
+	l.file.mux.Lock()
+	defer l.file.mux.Unlock()
+	return l.file.closed
+}
@@ -0,0 +1,269 @@
+package mirror
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+// protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errTruncatedProto = errors.New("truncated protobuf message")
+
+// protoMessage decodes protobuf messages with the descriptors of their
+// types, into values compared like json. Fields are keyed by name, and
+// unknown fields by number, eg #5
+type protoMessage struct {
+	root     *descriptor.DescriptorProto
+	messages map[string]*descriptor.DescriptorProto
+	enums    map[string]*descriptor.EnumDescriptorProto
+}
+
+// loadProtoMessage reads a file descriptor set and finds the message with
+// the full name message, eg shop.v1.Item
+func loadProtoMessage(path, message string) (*protoMessage, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	set := &descriptor.FileDescriptorSet{}
+	if err := proto.Unmarshal(data, set); err != nil {
+		return nil, fmt.Errorf("%s is not a file descriptor set: %s", path, err)
+	}
+
+	p := &protoMessage{
+		messages: map[string]*descriptor.DescriptorProto{},
+		enums:    map[string]*descriptor.EnumDescriptorProto{},
+	}
+	for _, file := range set.File {
+		scope := ""
+		if file.GetPackage() != "" {
+			scope = "." + file.GetPackage()
+		}
+
+		for _, enum := range file.EnumType {
+			p.enums[scope+"."+enum.GetName()] = enum
+		}
+		for _, msg := range file.MessageType {
+			p.addMessage(scope, msg)
+		}
+	}
+
+	p.root = p.messages["."+strings.TrimPrefix(message, ".")]
+	if p.root == nil {
+		return nil, fmt.Errorf("message %s not found in %s", message, path)
+	}
+	return p, nil
+}
+
+// addMessage indexes a message and its nested types by their full names,
+// as used in field type names, eg .shop.v1.Item
+func (p *protoMessage) addMessage(scope string, msg *descriptor.DescriptorProto) {
+	name := scope + "." + msg.GetName()
+	p.messages[name] = msg
+
+	for _, enum := range msg.EnumType {
+		p.enums[name+"."+enum.GetName()] = enum
+	}
+	for _, nested := range msg.NestedType {
+		p.addMessage(name, nested)
+	}
+}
+
+func (p *protoMessage) decode(body []byte) (interface{}, error) {
+	return p.decodeMessage(p.root, body)
+}
+
+func (p *protoMessage) decodeMessage(msg *descriptor.DescriptorProto, b []byte) (map[string]interface{}, error) {
+	fields := map[int32]*descriptor.FieldDescriptorProto{}
+	for _, field := range msg.Field {
+		fields[field.GetNumber()] = field
+	}
+
+	decoded := map[string]interface{}{}
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errTruncatedProto
+		}
+		b = b[n:]
+
+		number, wireType := int32(key>>3), key&7
+		var raw uint64
+		var data []byte
+		switch wireType {
+		case wireVarint:
+			if raw, n = binary.Uvarint(b); n <= 0 {
+				return nil, errTruncatedProto
+			}
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return nil, errTruncatedProto
+			}
+			raw, b = binary.LittleEndian.Uint64(b), b[8:]
+		case wireFixed32:
+			if len(b) < 4 {
+				return nil, errTruncatedProto
+			}
+			raw, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case wireBytes:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < length {
+				return nil, errTruncatedProto
+			}
+			data, b = b[n:n+int(length)], b[n+int(length):]
+		default:
+			return nil, fmt.Errorf("unsupported protobuf wire type %d", wireType)
+		}
+
+		field := fields[number]
+		if field == nil {
+			var value interface{} = raw
+			if wireType == wireBytes {
+				value = data
+			}
+			appendProtoValue(decoded, fmt.Sprintf("#%d", number), value)
+			continue
+		}
+
+		values, err := p.fieldValues(field, wireType, raw, data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", field.GetName(), err)
+		}
+
+		if field.GetLabel() != descriptor.FieldDescriptorProto_LABEL_REPEATED {
+			// the last value of a singular field wins
+			decoded[field.GetName()] = values[len(values)-1]
+			continue
+		}
+		for _, value := range values {
+			appendProtoValue(decoded, field.GetName(), value)
+		}
+	}
+	return decoded, nil
+}
+
+// appendProtoValue appends a value of a repeated or unknown field
+func appendProtoValue(decoded map[string]interface{}, name string, value interface{}) {
+	list, _ := decoded[name].([]interface{})
+	decoded[name] = append(list, value)
+}
+
+// fieldValues decodes the values of a field, which are several for packed
+// repeated fields
+func (p *protoMessage) fieldValues(field *descriptor.FieldDescriptorProto, wireType, raw uint64, data []byte) ([]interface{}, error) {
+	packedType, packable := packedWireType(field.GetType())
+	if wireType != wireBytes || !packable {
+		value, err := p.fieldValue(field, raw, data)
+		return []interface{}{value}, err
+	}
+
+	values := []interface{}{}
+	for len(data) > 0 {
+		switch packedType {
+		case wireVarint:
+			value, n := binary.Uvarint(data)
+			if n <= 0 {
+				return nil, errTruncatedProto
+			}
+			raw, data = value, data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return nil, errTruncatedProto
+			}
+			raw, data = binary.LittleEndian.Uint64(data), data[8:]
+		case wireFixed32:
+			if len(data) < 4 {
+				return nil, errTruncatedProto
+			}
+			raw, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		}
+
+		value, err := p.fieldValue(field, raw, nil)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// packedWireType is the wire type of the values of packed fields of type t,
+// ok is false for types that can't be packed
+func packedWireType(t descriptor.FieldDescriptorProto_Type) (uint64, bool) {
+	switch t {
+	case descriptor.FieldDescriptorProto_TYPE_INT32, descriptor.FieldDescriptorProto_TYPE_INT64,
+		descriptor.FieldDescriptorProto_TYPE_UINT32, descriptor.FieldDescriptorProto_TYPE_UINT64,
+		descriptor.FieldDescriptorProto_TYPE_SINT32, descriptor.FieldDescriptorProto_TYPE_SINT64,
+		descriptor.FieldDescriptorProto_TYPE_BOOL, descriptor.FieldDescriptorProto_TYPE_ENUM:
+		return wireVarint, true
+	case descriptor.FieldDescriptorProto_TYPE_FIXED64, descriptor.FieldDescriptorProto_TYPE_SFIXED64,
+		descriptor.FieldDescriptorProto_TYPE_DOUBLE:
+		return wireFixed64, true
+	case descriptor.FieldDescriptorProto_TYPE_FIXED32, descriptor.FieldDescriptorProto_TYPE_SFIXED32,
+		descriptor.FieldDescriptorProto_TYPE_FLOAT:
+		return wireFixed32, true
+	}
+	return 0, false
+}
+
+// fieldValue decodes a single value of field, from raw for numeric types
+// and data for strings, bytes and messages
+func (p *protoMessage) fieldValue(field *descriptor.FieldDescriptorProto, raw uint64, data []byte) (interface{}, error) {
+	switch field.GetType() {
+	case descriptor.FieldDescriptorProto_TYPE_DOUBLE:
+		return math.Float64frombits(raw), nil
+	case descriptor.FieldDescriptorProto_TYPE_FLOAT:
+		return float64(math.Float32frombits(uint32(raw))), nil
+	case descriptor.FieldDescriptorProto_TYPE_INT64, descriptor.FieldDescriptorProto_TYPE_SFIXED64:
+		return int64(raw), nil
+	case descriptor.FieldDescriptorProto_TYPE_INT32:
+		return int64(int32(raw)), nil
+	case descriptor.FieldDescriptorProto_TYPE_SFIXED32:
+		return int64(int32(uint32(raw))), nil
+	case descriptor.FieldDescriptorProto_TYPE_UINT64, descriptor.FieldDescriptorProto_TYPE_FIXED64:
+		return raw, nil
+	case descriptor.FieldDescriptorProto_TYPE_UINT32, descriptor.FieldDescriptorProto_TYPE_FIXED32:
+		return uint64(uint32(raw)), nil
+	case descriptor.FieldDescriptorProto_TYPE_SINT32, descriptor.FieldDescriptorProto_TYPE_SINT64:
+		// zigzag encoded
+		return int64(raw>>1) ^ -int64(raw&1), nil
+	case descriptor.FieldDescriptorProto_TYPE_BOOL:
+		return raw != 0, nil
+	case descriptor.FieldDescriptorProto_TYPE_ENUM:
+		if enum := p.enums[field.GetTypeName()]; enum != nil {
+			for _, value := range enum.Value {
+				if value.GetNumber() == int32(raw) {
+					return value.GetName(), nil
+				}
+			}
+		}
+		return int64(int32(raw)), nil
+	case descriptor.FieldDescriptorProto_TYPE_STRING:
+		return string(data), nil
+	case descriptor.FieldDescriptorProto_TYPE_BYTES:
+		return data, nil
+	case descriptor.FieldDescriptorProto_TYPE_MESSAGE:
+		msg := p.messages[field.GetTypeName()]
+		if msg == nil {
+			return nil, fmt.Errorf("unknown message type %s", field.GetTypeName())
+		}
+		return p.decodeMessage(msg, data)
+	default:
+		return nil, fmt.Errorf("unsupported field type %s", field.GetType())
+	}
+}
@@ -0,0 +1,613 @@
+package mirror
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Sink schemes of the mirror url, other than http and https
+const (
+	// SinkFile appends requests to a file, eg file:///var/log/shadow.ndjson.
+	// The file is rotated once it reaches the max-size query parameter
+	// (100MB by default, 0 disables it), keeping max-backups (3) old files
+	SinkFile = "file"
+	// SinkStdout writes requests to stdout, eg stdout://
+	SinkStdout = "stdout"
+	// SinkUnix writes requests to a unix socket, eg unix:///tmp/sink.sock.
+	// Requests are dropped while the socket falls behind
+	SinkUnix = "unix"
+	// SinkExec writes requests to the stdin of a command, started once and
+	// again when it exits, eg exec:///usr/bin/consumer?arg=--topic&arg=shadow.
+	// Requests are dropped while the command falls behind
+	SinkExec = "exec"
+)
+
+const (
+	defaultSinkMaxSize    = 100 << 20
+	defaultSinkMaxBackups = 3
+	sinkWriteTimeout      = 10 * time.Second
+	// sinkQueueSize is the most records waiting for a unix or exec sink
+	sinkQueueSize = 1024
+)
+
+var (
+	errSinkClosed = errors.New("sink is closed")
+	errSinkFull   = errors.New("sink queue is full")
+)
+
+// Sink is where mirrored requests are sent, chosen by the scheme of the
+// mirror url
+type Sink interface {
+	// Send sends a mirrored request, returning the response when the sink
+	// has one
+	Send(req *http.Request) (*CapturedResponse, error)
+	Close() error
+}
+
+// Record is a mirrored request as written by the file, stdout, unix and
+// exec sinks, one json object per line
+type Record struct {
+	Time   time.Time   `json:"time"`
+	Method string      `json:"method"`
+	Host   string      `json:"host"`
+	URI    string      `json:"uri"`
+	Header http.Header `json:"header,omitempty"`
+	// Body is set when the body is valid utf-8, and BodyBase64 otherwise
+	Body       string `json:"body,omitempty"`
+	BodyBase64 []byte `json:"body_base64,omitempty"`
+	// Truncated is set when the body was longer than the max capture size
+	// and only its start is kept
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// newRecord reads req into a Record, with up to limit bytes of its body
+func newRecord(req *http.Request, limit int64) (*Record, error) {
+	record := &Record{
+		Time:   time.Now().UTC(),
+		Method: req.Method,
+		Host:   req.Host,
+		URI:    req.URL.RequestURI(),
+		Header: req.Header,
+	}
+
+	if req.Body != nil {
+		body, truncated, err := readCaptured(req.Body, limit)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		record.Truncated = truncated
+
+		if utf8.Valid(body) {
+			record.Body = string(body)
+		} else {
+			record.BodyBase64 = body
+		}
+	}
+
+	return record, nil
+}
+
+// recordLine encodes req as a line of json
+func recordLine(req *http.Request, limit int64) ([]byte, error) {
+	record, err := newRecord(req, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+// isSinkScheme reports whether scheme is a sink writing records instead
+// of an http mirror
+func isSinkScheme(scheme string) bool {
+	switch scheme {
+	case SinkFile, SinkStdout, SinkUnix, SinkExec:
+		return true
+	}
+	return false
+}
+
+// parseSize parses a number of bytes, with an optional k, m or g suffix
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.ToLower(s), "b")
+
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(s, "k"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(s, "m"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(s, "g"):
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+
+	size, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return size * multiplier, nil
+}
+
+// newSink returns the sink for a mirror url with a sink scheme. Files,
+// sockets and commands are opened by the first request. Request bodies
+// longer than limit are truncated
+func newSink(u *url.URL, limit int64, log logrus.FieldLogger) (Sink, error) {
+	switch u.Scheme {
+	case SinkFile:
+		if u.Path == "" {
+			return nil, errors.New("file sink is missing a path")
+		}
+
+		query := u.Query()
+		sink := &fileSink{path: u.Path, limit: limit, maxSize: defaultSinkMaxSize, maxBackups: defaultSinkMaxBackups}
+		if maxSize := query.Get("max-size"); maxSize != "" {
+			size, err := parseSize(maxSize)
+			if err != nil {
+				return nil, fmt.Errorf("max-size: %s", err)
+			}
+			sink.maxSize = size
+		}
+		if maxBackups := query.Get("max-backups"); maxBackups != "" {
+			backups, err := strconv.Atoi(maxBackups)
+			if err != nil || backups < 0 {
+				return nil, fmt.Errorf("max-backups: invalid number %q", maxBackups)
+			}
+			sink.maxBackups = backups
+		}
+		return sink, nil
+	case SinkStdout:
+		return &writerSink{w: os.Stdout, limit: limit}, nil
+	case SinkUnix:
+		if u.Path == "" {
+			return nil, errors.New("unix sink is missing a socket path")
+		}
+		unix := &unixSink{path: u.Path, timeout: sinkWriteTimeout}
+		return newQueuedSink(unix, limit, log.WithField("socket", u.Path)), nil
+	case SinkExec:
+		if u.Path == "" {
+			return nil, errors.New("exec sink is missing a command")
+		}
+		log := log.WithField("command", u.Path)
+		return newQueuedSink(newExecSink(u.Path, u.Query()["arg"], log), limit, log), nil
+	default:
+		return nil, fmt.Errorf("unknown sink %q", u.Scheme)
+	}
+}
+
+// httpSink sends requests to an http mirror
+type httpSink struct {
+	client *http.Client
+	log    logrus.FieldLogger
+	// limit is the most of a response body that is read
+	limit int64
+}
+
+func (s *httpSink) Send(proxyReq *http.Request) (*CapturedResponse, error) {
+	entry := s.log.WithField("mirror_url", proxyReq.URL.String())
+	entry.Debugln("mirroring")
+	response, err := s.client.Do(proxyReq)
+	if err != nil {
+		entry.WithError(err).
+			Debugln("error in mirrored request")
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, truncated, err := readCaptured(response.Body, s.limit)
+	if err != nil {
+		entry.WithError(err).
+			Debugln("error reading mirrored request")
+		return nil, err
+	}
+
+	if len(response.Trailer) > 0 {
+		entry = entry.WithField("trailer", response.Trailer)
+	}
+
+	entry.WithField("response", string(body)).
+		Debugln("mirrored response")
+
+	return &CapturedResponse{
+		StatusCode: response.StatusCode,
+		Header:     response.Header,
+		Trailer:    response.Trailer,
+		Body:       body,
+		Truncated:  truncated,
+	}, nil
+}
+
+func (s *httpSink) Close() error {
+	return nil
+}
+
+// writerSink writes records to w, which is never closed
+type writerSink struct {
+	mux   sync.Mutex
+	w     io.Writer
+	limit int64
+}
+
+func (s *writerSink) Send(req *http.Request) (*CapturedResponse, error) {
+	line, err := recordLine(req, s.limit)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	_, err = s.w.Write(line)
+	return nil, err
+}
+
+func (s *writerSink) Close() error {
+	return nil
+}
+
+// fileSink appends records to a file, rotating it once it reaches maxSize
+type fileSink struct {
+	path       string
+	limit      int64
+	maxSize    int64
+	maxBackups int
+
+	mux    sync.Mutex
+	f      *os.File
+	size   int64
+	closed bool
+}
+
+// open opens the file for appending, s.mux must be held
+func (s *fileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	s.f = f
+	s.size = info.Size()
+	return nil
+}
+
+// backup is the name of the nth old file
+func (s *fileSink) backup(n int) string {
+	return fmt.Sprintf("%s.%d", s.path, n)
+}
+
+// rotate renames the file to path.1, after shifting the older files, and
+// opens a new file. s.mux must be held
+func (s *fileSink) rotate() error {
+	err := s.f.Close()
+	s.f = nil
+	if err != nil {
+		return err
+	}
+
+	if s.maxBackups == 0 {
+		if err := os.Remove(s.path); err != nil {
+			return err
+		}
+		return s.open()
+	}
+
+	os.Remove(s.backup(s.maxBackups))
+	for n := s.maxBackups - 1; n > 0; n-- {
+		if err := os.Rename(s.backup(n), s.backup(n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if err := os.Rename(s.path, s.backup(1)); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+// write appends a line to the file, rotating it first when it would
+// grow over maxSize
+func (s *fileSink) write(line []byte) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.closed {
+		return errSinkClosed
+	}
+
+	if s.f == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return fmt.Errorf("error rotating %s: %s", s.path, err)
+		}
+	}
+
+	n, err := s.f.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+func (s *fileSink) Send(req *http.Request) (*CapturedResponse, error) {
+	line, err := recordLine(req, s.limit)
+	if err != nil {
+		return nil, err
+	}
+	return nil, s.write(line)
+}
+
+func (s *fileSink) Close() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.closed = true
+	if s.f == nil {
+		return nil
+	}
+	return s.f.Close()
+}
+
+// recordWriter writes the records of a queuedSink, only ever from its
+// writer goroutine
+type recordWriter interface {
+	write(line []byte) error
+	// close is called once every queued record was written or dropped
+	close() error
+}
+
+// queuedSink queues records for a single writer, so a writer that doesn't
+// keep up drops records instead of holding up the mirrored requests
+type queuedSink struct {
+	w     recordWriter
+	limit int64
+	log   logrus.FieldLogger
+
+	queue chan []byte
+	// done is closed once the writer wrote or dropped every queued record
+	done chan struct{}
+
+	mux     sync.Mutex
+	started bool
+	closed  bool
+
+	err error
+}
+
+func newQueuedSink(w recordWriter, limit int64, log logrus.FieldLogger) *queuedSink {
+	return &queuedSink{
+		w:     w,
+		limit: limit,
+		log:   log,
+		queue: make(chan []byte, sinkQueueSize),
+		done:  make(chan struct{}),
+	}
+}
+
+// run writes the queued records until the sink is closed
+func (s *queuedSink) run() {
+	defer close(s.done)
+
+	for line := range s.queue {
+		if err := s.w.write(line); err != nil {
+			s.log.WithError(err).Warnln("error writing mirrored request to sink")
+			if s.isClosed() {
+				// don't wait on a failing writer for every record left
+				for range s.queue {
+				}
+			}
+		}
+	}
+	s.err = s.w.close()
+}
+
+func (s *queuedSink) isClosed() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.closed
+}
+
+// Send queues the record of req, dropping it when the queue is full
+func (s *queuedSink) Send(req *http.Request) (*CapturedResponse, error) {
+	line, err := recordLine(req, s.limit)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.closed {
+		return nil, errSinkClosed
+	}
+
+	if !s.started {
+		s.started = true
+		go s.run()
+	}
+
+	select {
+	case s.queue <- line:
+		return nil, nil
+	default:
+		return nil, errSinkFull
+	}
+}
+
+// Close writes the queued records and waits for the writer to close
+func (s *queuedSink) Close() error {
+	s.mux.Lock()
+	if s.closed {
+		s.mux.Unlock()
+		return nil
+	}
+	s.closed = true
+	started := s.started
+	close(s.queue)
+	s.mux.Unlock()
+
+	if !started {
+		return nil
+	}
+	<-s.done
+	return s.err
+}
+
+// unixSink writes records to a unix socket, connecting again after errors
+type unixSink struct {
+	path string
+	// timeout is how long connecting and writing a record may take
+	timeout time.Duration
+
+	conn net.Conn
+}
+
+func (s *unixSink) write(line []byte) error {
+	if s.conn == nil {
+		conn, err := net.DialTimeout("unix", s.path, s.timeout)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+	if _, err := s.conn.Write(line); err != nil {
+		s.close()
+		return err
+	}
+	return nil
+}
+
+func (s *unixSink) close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// execSink writes records to the stdin of a command, starting it again
+// when it exits
+type execSink struct {
+	path string
+	args []string
+	log  logrus.FieldLogger
+	// timeout is how long the command has to read a record, or to exit once
+	// its stdin is closed, before it is killed
+	timeout time.Duration
+
+	cmd   *exec.Cmd
+	stdin *os.File
+}
+
+func newExecSink(path string, args []string, log logrus.FieldLogger) *execSink {
+	return &execSink{
+		path:    path,
+		args:    args,
+		log:     log,
+		timeout: sinkWriteTimeout,
+	}
+}
+
+// start starts the command
+func (s *execSink) start() error {
+	pipe, stdin, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	// the command has its own copy of the read end
+	defer pipe.Close()
+
+	cmd := exec.Command(s.path, s.args...)
+	cmd.Stdin = pipe
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		stdin.Close()
+		return err
+	}
+
+	s.log.Infoln("started sink command")
+	s.cmd, s.stdin = cmd, stdin
+	return nil
+}
+
+// stop closes the stdin of the command and waits for it to exit, killing it
+// first when it may be stuck, or when it doesn't exit in time
+func (s *execSink) stop(kill bool) error {
+	if s.cmd == nil {
+		return nil
+	}
+	cmd := s.cmd
+	s.cmd = nil
+
+	if kill {
+		cmd.Process.Kill()
+	}
+	s.stdin.Close()
+	s.stdin = nil
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	select {
+	case err := <-exited:
+		return err
+	case <-time.After(s.timeout):
+		s.log.Warnln("sink command didn't exit after its stdin was closed, killing it")
+		cmd.Process.Kill()
+		return <-exited
+	}
+}
+
+func (s *execSink) write(line []byte) error {
+	if s.cmd == nil {
+		if err := s.start(); err != nil {
+			return err
+		}
+	}
+
+	s.stdin.SetWriteDeadline(time.Now().Add(s.timeout))
+	if _, err := s.stdin.Write(line); err != nil {
+		// the command exited or stopped reading, it is started again by the
+		// next record
+		s.stop(true)
+		return err
+	}
+	return nil
+}
+
+func (s *execSink) close() error {
+	return s.stop(false)
+}
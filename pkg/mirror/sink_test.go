@@ -0,0 +1,357 @@
+package mirror
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSink(t *testing.T, rawURL string) Sink {
+	u, err := url.Parse(rawURL)
+	assert.NoError(t, err)
+	sink, err := newSink(u, DefaultMaxCaptureSize, logrus.StandardLogger())
+	assert.NoError(t, err)
+	return sink
+}
+
+func readRecords(t *testing.T, path string) []Record {
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+
+	records := []Record{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line == "" {
+			continue
+		}
+		record := Record{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &record))
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomirror-sink")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "shadow.ndjson")
+	sink := newTestSink(t, "file://"+path+"?max-size=1&max-backups=1")
+	defer sink.Close()
+
+	for _, body := range []string{"one", "two", "three"} {
+		req := httptest.NewRequest(http.MethodPost, "http://api.internal/items?id=1", strings.NewReader(body))
+		req.Header.Set("X-Test", body)
+		response, err := sink.Send(req)
+		assert.NoError(t, err)
+		assert.Nil(t, response)
+	}
+
+	// each record is over max-size, so every file has one record
+	// and the oldest is removed
+	records := readRecords(t, path)
+	assert.Len(t, records, 1)
+	assert.Equal(t, "three", records[0].Body)
+	assert.Equal(t, http.MethodPost, records[0].Method)
+	assert.Equal(t, "api.internal", records[0].Host)
+	assert.Equal(t, "/items?id=1", records[0].URI)
+	assert.Equal(t, "three", records[0].Header.Get("X-Test"))
+
+	backups := readRecords(t, path+".1")
+	assert.Len(t, backups, 1)
+	assert.Equal(t, "two", backups[0].Body)
+
+	_, err = os.Stat(path + ".2")
+	assert.True(t, os.IsNotExist(err))
+
+	assert.NoError(t, sink.Close())
+	_, err = sink.Send(httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, errSinkClosed, err)
+}
+
+func TestFileSinkBinaryBody(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomirror-sink")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "shadow.ndjson")
+	sink := newTestSink(t, "file://"+path)
+	defer sink.Close()
+
+	body := []byte{0xff, 0x00, 0xfe}
+	_, err = sink.Send(httptest.NewRequest(http.MethodPost, "/", strings.NewReader(string(body))))
+	assert.NoError(t, err)
+
+	records := readRecords(t, path)
+	assert.Len(t, records, 1)
+	assert.Empty(t, records[0].Body)
+	assert.Equal(t, body, records[0].BodyBase64)
+}
+
+func TestSinkBodyLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomirror-sink")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "shadow.ndjson")
+	u, err := url.Parse("file://" + path)
+	assert.NoError(t, err)
+	sink, err := newSink(u, 4, logrus.StandardLogger())
+	assert.NoError(t, err)
+	defer sink.Close()
+
+	_, err = sink.Send(httptest.NewRequest(http.MethodPost, "/", strings.NewReader("hello")))
+	assert.NoError(t, err)
+
+	records := readRecords(t, path)
+	assert.Len(t, records, 1)
+	assert.Equal(t, "hell", records[0].Body)
+	assert.True(t, records[0].Truncated)
+}
+
+func TestUnixSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomirror-sink")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sink.sock")
+	listener, err := net.Listen("unix", path)
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	lines := make(chan string, 2)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	sink := newTestSink(t, "unix://"+path)
+	defer sink.Close()
+
+	for _, body := range []string{"one", "two"} {
+		_, err := sink.Send(httptest.NewRequest(http.MethodPost, "/items", strings.NewReader(body)))
+		assert.NoError(t, err)
+	}
+
+	for _, body := range []string{"one", "two"} {
+		select {
+		case <-time.After(5 * time.Second):
+			panic("timed out waiting for mirror")
+		case line := <-lines:
+			record := Record{}
+			assert.NoError(t, json.Unmarshal([]byte(line), &record))
+			assert.Equal(t, "/items", record.URI)
+			assert.Equal(t, body, record.Body)
+		}
+	}
+}
+
+func TestExecSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomirror-sink")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "out.ndjson")
+	query := url.Values{"arg": {"-c", "cat > " + path}}
+	sink := newTestSink(t, "exec:///bin/sh?"+query.Encode())
+
+	_, err = sink.Send(httptest.NewRequest(http.MethodPut, "/items/1", strings.NewReader("hello")))
+	assert.NoError(t, err)
+
+	// closing the sink waits for the command to exit
+	assert.NoError(t, sink.Close())
+
+	records := readRecords(t, path)
+	assert.Len(t, records, 1)
+	assert.Equal(t, http.MethodPut, records[0].Method)
+	assert.Equal(t, "/items/1", records[0].URI)
+	assert.Equal(t, "hello", records[0].Body)
+}
+
+func TestExecSinkStuck(t *testing.T) {
+	// the command never reads, so the first record fills the pipe and the
+	// next ones queue up behind it
+	cmd := newExecSink("/bin/sh", []string{"-c", "exec sleep 30"}, logrus.StandardLogger())
+	cmd.timeout = 100 * time.Millisecond
+	sink := newQueuedSink(cmd, DefaultMaxCaptureSize, logrus.StandardLogger())
+	sink.queue = make(chan []byte, 1)
+
+	assertSinkStuck(t, sink)
+}
+
+func TestExecSinkIgnoresEOF(t *testing.T) {
+	// the command reads the record but doesn't exit once its stdin is closed
+	cmd := newExecSink("/bin/sh", []string{"-c", "head -n 1 >/dev/null; exec sleep 30"}, logrus.StandardLogger())
+	cmd.timeout = 100 * time.Millisecond
+	sink := newQueuedSink(cmd, DefaultMaxCaptureSize, logrus.StandardLogger())
+
+	_, err := sink.Send(httptest.NewRequest(http.MethodPost, "/items", strings.NewReader("hello")))
+	assert.NoError(t, err)
+
+	// the command is killed instead of holding up close
+	closed := make(chan error)
+	go func() { closed <- sink.Close() }()
+	select {
+	case <-time.After(5 * time.Second):
+		panic("timed out waiting for the sink to close")
+	case err := <-closed:
+		assert.Error(t, err)
+	}
+}
+
+func TestUnixSinkStuck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomirror-sink")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sink.sock")
+	listener, err := net.Listen("unix", path)
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	// the socket is accepted but never read
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		time.Sleep(30 * time.Second)
+	}()
+
+	unix := &unixSink{path: path, timeout: 100 * time.Millisecond}
+	sink := newQueuedSink(unix, DefaultMaxCaptureSize, logrus.StandardLogger())
+	sink.queue = make(chan []byte, 1)
+
+	assertSinkStuck(t, sink)
+}
+
+// assertSinkStuck sends records to a sink whose writer never keeps up, and
+// checks they are dropped instead of blocking, and that closing it returns
+func assertSinkStuck(t *testing.T, sink Sink) {
+	body := strings.Repeat("a", 256<<10)
+	var full int
+	for i := 0; i < 3; i++ {
+		_, err := sink.Send(httptest.NewRequest(http.MethodPost, "/items", strings.NewReader(body)))
+		if err == errSinkFull {
+			full++
+			continue
+		}
+		assert.NoError(t, err)
+	}
+	assert.NotZero(t, full)
+
+	closed := make(chan error)
+	go func() { closed <- sink.Close() }()
+	select {
+	case <-time.After(5 * time.Second):
+		panic("timed out waiting for the sink to close")
+	case err := <-closed:
+		assert.NoError(t, err)
+	}
+
+	_, err := sink.Send(httptest.NewRequest(http.MethodPost, "/items", nil))
+	assert.Equal(t, errSinkClosed, err)
+}
+
+func TestMirrorFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomirror-sink")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	primary := httptest.NewServer(returnBody("primary", http.StatusOK))
+	defer primary.Close()
+
+	responses := make(chan *CapturedResponse, 1)
+	path := filepath.Join(dir, "shadow.ndjson")
+	m, err := NewMirror(
+		WithPrimary(primary.URL),
+		WithMirrorTarget("file://"+path, Header{Key: "X-Mirror", Value: "true"}),
+		WithObserver(&ObserverFuncs{
+			MirrorResponse: func(req *http.Request, primary, mirror *CapturedResponse, err error, latency time.Duration) {
+				assert.NoError(t, err)
+				assert.Nil(t, mirror)
+				responses <- primary
+			},
+		}),
+	)
+	assert.NoError(t, err)
+
+	proxy := httptest.NewServer(m)
+	defer proxy.Close()
+
+	res, err := http.Post(proxy.URL+"/items?id=1", "text/plain", strings.NewReader("hello"))
+	assert.NoError(t, err)
+	res.Body.Close()
+
+	select {
+	case <-time.After(5 * time.Second):
+		panic("timed out waiting for mirror")
+	case response := <-responses:
+		assert.Equal(t, "primary", string(response.Body))
+	}
+
+	records := readRecords(t, path)
+	assert.Len(t, records, 1)
+	assert.Equal(t, "/items?id=1", records[0].URI)
+	assert.Equal(t, strings.TrimPrefix(proxy.URL, "http://"), records[0].Host)
+	assert.Equal(t, "true", records[0].Header.Get("X-Mirror"))
+	assert.Equal(t, "hello", records[0].Body)
+}
+
+func TestValidateSink(t *testing.T) {
+	cases := map[string]string{
+		"file://":                        "file sink is missing a path",
+		"file:///tmp/a?max-size=lots":    `max-size: invalid size "lots"`,
+		"file:///tmp/a?max-backups=-1":   `max-backups: invalid number "-1"`,
+		"unix://":                        "unix sink is missing a socket path",
+		"exec://":                        "exec sink is missing a command",
+		"ftp://mirror.internal":          `scheme must be http, https, ws, wss, file, stdout, unix or exec, got "ftp"`,
+		"file:///nonexistent/dir/a.json": "",
+	}
+
+	for rawURL, message := range cases {
+		cfg := &Config{
+			Primary: PrimaryConfig{URL: "http://primary.internal"},
+			Mirror:  MirrorConfig{URL: rawURL},
+		}
+
+		err := cfg.Validate()
+		assert.Error(t, err, rawURL)
+		assert.Equal(t, "mirror.url", err.(ValidationError)[0].Field, rawURL)
+		if message != "" {
+			assert.Equal(t, message, err.(ValidationError)[0].Message, rawURL)
+		}
+	}
+
+	cfg := &Config{
+		Primary: PrimaryConfig{URL: "http://primary.internal"},
+		Mirror: MirrorConfig{
+			URL:       "stdout://",
+			Discovery: DiscoveryConfig{Provider: ProviderStatic, Endpoints: []string{"mirror:80"}},
+		},
+	}
+	err := cfg.Validate()
+	assert.Error(t, err)
+	assert.Equal(t, "mirror.discovery", err.(ValidationError)[0].Field)
+}
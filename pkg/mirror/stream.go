@@ -0,0 +1,99 @@
+package mirror
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// mirrorStreamBuffer is the number of client writes that can be queued for
+// a mirror connection before it is abandoned
+const mirrorStreamBuffer = 256
+
+// mirrorStream copies the client side of a long lived connection to a mirror
+// connection. Client bytes are queued and written by a single goroutine, so
+// a slow or broken mirror never blocks the primary connection. A mirror that
+// can't keep up is abandoned, as dropping bytes would corrupt the stream
+type mirrorStream struct {
+	entry  *logrus.Entry
+	chunks chan []byte
+
+	mux    sync.Mutex
+	closed bool
+}
+
+// newMirrorStream starts a mirror stream. connect opens the mirror
+// connection, and drain consumes everything the mirror sends back
+func newMirrorStream(
+	entry *logrus.Entry,
+	connect func() (net.Conn, io.Reader, error),
+	drain func(io.Reader),
+) *mirrorStream {
+	s := &mirrorStream{
+		entry:  entry,
+		chunks: make(chan []byte, mirrorStreamBuffer),
+	}
+
+	go s.run(connect, drain)
+	return s
+}
+
+// send queues a copy of client bytes for the mirror
+func (s *mirrorStream) send(p []byte) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	chunk := make([]byte, len(p))
+	copy(chunk, p)
+
+	select {
+	case s.chunks <- chunk:
+	default:
+		s.entry.Warnln("mirror could not keep up with the client, abandoning mirror connection")
+		s.closed = true
+		close(s.chunks)
+	}
+}
+
+func (s *mirrorStream) Close() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.chunks)
+}
+
+// discard drains queued chunks once the mirror connection is gone
+func (s *mirrorStream) discard() {
+	for range s.chunks {
+	}
+}
+
+func (s *mirrorStream) run(connect func() (net.Conn, io.Reader, error), drain func(io.Reader)) {
+	conn, reader, err := connect()
+	if err != nil {
+		s.entry.WithError(err).Debugln("error connecting to mirror")
+		s.discard()
+		return
+	}
+	defer conn.Close()
+
+	go drain(reader)
+
+	for chunk := range s.chunks {
+		if _, err := conn.Write(chunk); err != nil {
+			s.entry.WithError(err).Debugln("error writing to mirror")
+			s.discard()
+			return
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package mirror
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"time"
+)
+
+// tcpDialTimeout bounds the time spent connecting to the primary and mirror
+const tcpDialTimeout = 10 * time.Second
+
+// tcpAddress returns the host:port of a tcp://host:port url
+func tcpAddress(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	if u.Scheme != "tcp" || u.Hostname() == "" || u.Port() == "" {
+		return "", fmt.Errorf("expected a tcp://host:port url, got %q", rawURL)
+	}
+
+	return u.Host, nil
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// serveTCP proxies raw tcp connections to the primary, and copies the
+// client side of every connection to the mirror
+func (m *Mirror) serveTCP(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go m.handleTCP(conn)
+	}
+}
+
+func (m *Mirror) handleTCP(client net.Conn) {
+	defer client.Close()
+
+	cfg := m.current().cfg
+	entry := m.log.WithField("client", client.RemoteAddr().String())
+
+	primaryAddress, err := tcpAddress(cfg.Primary.URL)
+	if err != nil {
+		entry.WithError(err).Errorln("invalid primary url")
+		return
+	}
+	entry = entry.WithField("primary_address", primaryAddress)
+
+	primary, err := net.DialTimeout("tcp", primaryAddress, tcpDialTimeout)
+	if err != nil {
+		entry.WithError(err).Errorln("error connecting to primary")
+		return
+	}
+	defer primary.Close()
+
+	mirrorAddress, err := tcpAddress(cfg.Mirror.URL)
+	if err != nil {
+		// the primary connection is proxied regardless
+		entry.WithError(err).Errorln("invalid mirror url")
+	}
+
+	mirrorEntry := entry.WithField("mirror_address", mirrorAddress)
+	mirrorEntry.Debugln("mirroring tcp connection")
+
+	stream := newMirrorStream(
+		mirrorEntry,
+		func() (net.Conn, io.Reader, error) {
+			if mirrorAddress == "" {
+				return nil, nil, errors.New("no mirror address")
+			}
+			conn, err := net.DialTimeout("tcp", mirrorAddress, tcpDialTimeout)
+			return conn, conn, err
+		},
+		func(r io.Reader) {
+			// mirror output is never sent anywhere
+			n, _ := io.Copy(ioutil.Discard, r)
+			mirrorEntry.WithField("bytes", n).Debugln("mirrored tcp connection closed")
+		},
+	)
+	defer stream.Close()
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(client, primary)
+		// unblock the client read once the primary is done
+		client.Close()
+		close(done)
+	}()
+
+	io.Copy(primary, &teeReader{client, stream})
+	stream.Close()
+
+	// let the primary finish responding to a half closed connection
+	if cw, ok := primary.(closeWriter); ok {
+		cw.CloseWrite()
+		<-done
+	}
+}
+
+// teeReader sends everything read from the client to the mirror stream
+type teeReader struct {
+	io.Reader
+	stream *mirrorStream
+}
+
+func (t *teeReader) Read(p []byte) (int, error) {
+	n, err := t.Reader.Read(p)
+	if n > 0 {
+		t.stream.send(p[:n])
+	}
+	return n, err
+}
+
+func (m *Mirror) listenTCP(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	cfg := m.current().cfg
+	if cfg.TLS.Enabled {
+		tlsConfig, err := cfg.TLS.serverConfig(m.log)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	return m.serveTCP(listener)
+}
@@ -0,0 +1,126 @@
+package mirror
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// listenTCPTest starts a tcp server on a random port, handling every
+// connection with handle
+func listenTCPTest(t *testing.T, handle func(net.Conn)) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+
+	return listener
+}
+
+func startTCPMirror(t *testing.T, primaryAddress, mirrorAddress string) net.Listener {
+	cfg := &Config{
+		Mode:    ModeTCP,
+		Primary: PrimaryConfig{URL: "tcp://" + primaryAddress},
+		Mirror:  MirrorConfig{URL: "tcp://" + mirrorAddress},
+	}
+	mirror, err := New(cfg)
+	assert.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	go mirror.serveTCP(listener)
+	return listener
+}
+
+func echoLines(conn net.Conn) {
+	defer conn.Close()
+	io.Copy(conn, conn)
+}
+
+func TestMirrorTCP(t *testing.T) {
+	primary := listenTCPTest(t, echoLines)
+	defer primary.Close()
+
+	received := make(chan string, 1)
+	mirrored := listenTCPTest(t, func(conn net.Conn) {
+		defer conn.Close()
+		// responses from the mirror are discarded
+		conn.Write([]byte("from mirror\n"))
+		body, _ := ioutil.ReadAll(conn)
+		received <- string(body)
+	})
+	defer mirrored.Close()
+
+	proxy := startTCPMirror(t, primary.Addr().String(), mirrored.Addr().String())
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	assert.NoError(t, err)
+
+	reader := bufio.NewReader(conn)
+	for _, line := range []string{"PING\n", "SET key value\n"} {
+		_, err = conn.Write([]byte(line))
+		assert.NoError(t, err)
+
+		reply, err := reader.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, line, reply)
+	}
+	conn.Close()
+
+	select {
+	case <-time.After(5 * time.Second):
+		panic("timed out waiting for mirror")
+	case body := <-received:
+		assert.Equal(t, "PING\nSET key value\n", body)
+	}
+}
+
+func TestMirrorTCPMirrorDown(t *testing.T) {
+	primary := listenTCPTest(t, echoLines)
+	defer primary.Close()
+
+	// reserve an address with nothing listening on it
+	unused, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	unused.Close()
+
+	proxy := startTCPMirror(t, primary.Addr().String(), unused.Addr().String())
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("PING\n"))
+	assert.NoError(t, err)
+
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "PING\n", reply)
+}
+
+func TestTCPAddress(t *testing.T) {
+	address, err := tcpAddress("tcp://redis:6379")
+	assert.NoError(t, err)
+	assert.Equal(t, "redis:6379", address)
+
+	for _, bad := range []string{"http://redis:6379", "tcp://redis", "redis:6379"} {
+		_, err = tcpAddress(bad)
+		assert.Error(t, err, bad)
+	}
+}
@@ -0,0 +1,271 @@
+package mirror
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// certReloadInterval is the minimum time between checks of the certificate
+// files on disk
+var certReloadInterval = time.Second
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"none":               tls.NoClientCert,
+	"request":            tls.RequestClientCert,
+	"require":            tls.RequireAnyClientCert,
+	"verify-if-given":    tls.VerifyClientCertIfGiven,
+	"require-and-verify": tls.RequireAndVerifyClientCert,
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	if version == "" {
+		return tls.VersionTLS12, nil
+	}
+
+	v, ok := tlsVersions[strings.TrimPrefix(version, "TLS")]
+	if !ok {
+		return 0, fmt.Errorf("unknown tls version %q", version)
+	}
+	return v, nil
+}
+
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+
+	return pool, nil
+}
+
+// certReloader serves a certificate keypair, reloading it from disk
+// whenever either file changes
+type certReloader struct {
+	certFile string
+	keyFile  string
+	log      logrus.FieldLogger
+
+	mux       sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(certFile, keyFile string, log logrus.FieldLogger) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, log: log}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certReloader) reload() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.cert = &cert
+	r.modTime = modTime
+	r.lastCheck = time.Now()
+	return nil
+}
+
+// GetCertificate satisfies tls.Config.GetCertificate. If the files on disk
+// can't be reloaded the previously loaded certificate keeps being served
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if time.Since(r.lastCheck) < certReloadInterval {
+		return r.cert, nil
+	}
+	r.lastCheck = time.Now()
+
+	entry := r.log.WithField("cert_file", r.certFile).WithField("key_file", r.keyFile)
+
+	modTime, err := r.latestModTime()
+	if err != nil {
+		entry.WithError(err).Errorln("error checking tls certificate")
+		return r.cert, nil
+	}
+
+	if modTime.Equal(r.modTime) {
+		return r.cert, nil
+	}
+
+	if err := r.reload(); err != nil {
+		entry.WithError(err).Errorln("error reloading tls certificate")
+		return r.cert, nil
+	}
+
+	entry.Infoln("reloaded tls certificate")
+	return r.cert, nil
+}
+
+// ServerConfig builds a *tls.Config for the gomirror listener
+func (c *TLSConfig) ServerConfig() (*tls.Config, error) {
+	return c.serverConfig(logrus.StandardLogger())
+}
+
+// serverConfig builds the listener *tls.Config, logging certificate
+// reloads to log
+func (c *TLSConfig) serverConfig(log logrus.FieldLogger) (*tls.Config, error) {
+	reloader, err := newCertReloader(c.CertFile, c.KeyFile, log)
+	if err != nil {
+		return nil, err
+	}
+
+	minVersion, err := parseTLSVersion(c.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	cipherSuites, err := parseCipherSuites(c.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     minVersion,
+		CipherSuites:   cipherSuites,
+	}
+
+	clientAuth := strings.ToLower(c.ClientAuth)
+	if clientAuth == "" && c.ClientCAFile != "" {
+		clientAuth = "require-and-verify"
+	}
+
+	if clientAuth != "" {
+		authType, ok := clientAuthTypes[clientAuth]
+		if !ok {
+			return nil, fmt.Errorf("unknown client auth type %q", c.ClientAuth)
+		}
+		tlsConfig.ClientAuth = authType
+	}
+
+	if c.ClientCAFile != "" {
+		pool, err := loadCertPool(c.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
+// ClientConfig builds a *tls.Config for connections to an upstream server
+func (c *UpstreamTLSConfig) ClientConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+
+	if c.CAFile != "" {
+		pool, err := loadCertPool(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// upstreamTransport returns a copy of http.DefaultTransport using the
+// upstream tls config, or an HTTP/2 transport when h2c is set
+func upstreamTransport(c *UpstreamTLSConfig, h2c bool, log logrus.FieldLogger) (http.RoundTripper, error) {
+	tlsConfig, err := c.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.InsecureSkipVerify {
+		log.WithField("server_name", c.ServerName).
+			Warnln("upstream tls certificate verification is disabled")
+	}
+
+	if h2c {
+		return h2cTransport(tlsConfig), nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.ForceAttemptHTTP2 = true
+	return transport, nil
+}
@@ -0,0 +1,262 @@
+package mirror
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/petereps/gomirror/pkg/testutils"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLSServerConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomirror-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := testutils.WriteCertificate(dir, "gomirror-ca", nil)
+	serverCert := testutils.WriteCertificate(dir, "gomirror-server", ca)
+	clientCert := testutils.WriteCertificate(dir, "gomirror-client", ca)
+
+	backendServer := httptest.NewServer(returnBody("primary", http.StatusOK))
+	defer backendServer.Close()
+
+	mirroredServer := httptest.NewServer(returnBody("mirror", http.StatusOK))
+	defer mirroredServer.Close()
+
+	cfg := &Config{
+		TLS: TLSConfig{
+			Enabled:      true,
+			CertFile:     serverCert.CertFile,
+			KeyFile:      serverCert.KeyFile,
+			MinVersion:   "1.2",
+			CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+			ClientCAFile: ca.CertFile,
+		},
+		Primary: PrimaryConfig{URL: backendServer.URL},
+		Mirror:  MirrorConfig{URL: mirroredServer.URL},
+	}
+
+	mirror, err := New(cfg)
+	assert.NoError(t, err)
+
+	tlsConfig, err := cfg.TLS.ServerConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, tlsConfig.ClientAuth)
+
+	mirrorProxy := httptest.NewUnstartedServer(mirror)
+	mirrorProxy.TLS = tlsConfig
+	mirrorProxy.StartTLS()
+	defer mirrorProxy.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+
+	keyPair, err := tls.LoadX509KeyPair(clientCert.CertFile, clientCert.KeyFile)
+	assert.NoError(t, err)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs:      roots,
+				ServerName:   "localhost",
+				Certificates: []tls.Certificate{keyPair},
+			},
+		},
+	}
+
+	response, err := client.Get(mirrorProxy.URL)
+	assert.NoError(t, err)
+
+	resStr, err := ioutil.ReadAll(response.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "primary", string(resStr))
+	assert.Equal(t, serverCert.Cert.SerialNumber, response.TLS.PeerCertificates[0].SerialNumber)
+
+	// without a client certificate the handshake is rejected
+	noCertClient := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "localhost"},
+		},
+	}
+	_, err = noCertClient.Get(mirrorProxy.URL)
+	assert.Error(t, err)
+
+	// rotate the server certificate on disk
+	certReloadInterval = 0
+	defer func() { certReloadInterval = time.Second }()
+
+	rotated := testutils.WriteCertificate(dir, "gomirror-server", ca)
+	future := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(rotated.CertFile, future, future))
+
+	client.Transport.(*http.Transport).CloseIdleConnections()
+	response, err = client.Get(mirrorProxy.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, rotated.Cert.SerialNumber, response.TLS.PeerCertificates[0].SerialNumber)
+}
+
+func TestTLSServerConfigErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomirror-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cert := testutils.WriteCertificate(dir, "gomirror-server", nil)
+
+	cfg := TLSConfig{CertFile: cert.CertFile, KeyFile: cert.KeyFile, MinVersion: "0.9"}
+	_, err = cfg.ServerConfig()
+	assert.Error(t, err)
+
+	cfg = TLSConfig{CertFile: cert.CertFile, KeyFile: cert.KeyFile, CipherSuites: []string{"nope"}}
+	_, err = cfg.ServerConfig()
+	assert.Error(t, err)
+
+	cfg = TLSConfig{CertFile: cert.CertFile, KeyFile: cert.KeyFile, ClientAuth: "sometimes"}
+	_, err = cfg.ServerConfig()
+	assert.Error(t, err)
+
+	cfg = TLSConfig{CertFile: dir + "/missing.crt", KeyFile: cert.KeyFile}
+	_, err = cfg.ServerConfig()
+	assert.Error(t, err)
+}
+
+func newMTLSServer(t *testing.T, ca, cert *testutils.Certificate, handler http.Handler) *httptest.Server {
+	server := newUnstartedMTLSServer(t, ca, cert, handler)
+	server.StartTLS()
+	return server
+}
+
+func newUnstartedMTLSServer(t *testing.T, ca, cert *testutils.Certificate, handler http.Handler) *httptest.Server {
+	keyPair, err := tls.LoadX509KeyPair(cert.CertFile, cert.KeyFile)
+	assert.NoError(t, err)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.Cert)
+
+	server := httptest.NewUnstartedServer(handler)
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{keyPair},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	return server
+}
+
+func TestUpstreamMTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomirror-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := testutils.WriteCertificate(dir, "gomirror-ca", nil)
+	upstreamCert := testutils.WriteCertificate(dir, "upstream.internal", ca)
+	clientCert := testutils.WriteCertificate(dir, "gomirror-client", ca)
+
+	backendServer := newMTLSServer(t, ca, upstreamCert, returnBody("primary", http.StatusOK))
+	defer backendServer.Close()
+
+	done := make(chan struct{})
+	var once sync.Once
+	mirroredServer := newMTLSServer(t, ca, upstreamCert, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("mirror"))
+		once.Do(func() { close(done) })
+	}))
+	defer mirroredServer.Close()
+
+	upstreamTLS := UpstreamTLSConfig{
+		CAFile:     ca.CertFile,
+		CertFile:   clientCert.CertFile,
+		KeyFile:    clientCert.KeyFile,
+		ServerName: "upstream.internal",
+	}
+
+	cfg := &Config{
+		Primary: PrimaryConfig{URL: backendServer.URL, TLS: upstreamTLS},
+		Mirror:  MirrorConfig{URL: mirroredServer.URL, TLS: upstreamTLS},
+	}
+
+	mirror, err := New(cfg)
+	assert.NoError(t, err)
+
+	mirrorProxy := httptest.NewServer(mirror)
+	defer mirrorProxy.Close()
+
+	response, err := http.Get(mirrorProxy.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	resStr, err := ioutil.ReadAll(response.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "primary", string(resStr))
+
+	select {
+	case <-time.After(5 * time.Second):
+		panic("timed out waiting for mirror")
+	case <-done:
+	}
+
+	// without a client certificate the primary rejects the proxy
+	cfg.Primary.TLS = UpstreamTLSConfig{CAFile: ca.CertFile}
+	mirror, err = New(cfg)
+	assert.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+	mirror.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusBadGateway, recorder.Code)
+
+	cfg.Primary.TLS = UpstreamTLSConfig{CAFile: dir + "/missing.crt"}
+	_, err = New(cfg)
+	assert.Error(t, err)
+}
+
+func TestUpstreamH2CTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomirror-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := testutils.WriteCertificate(dir, "gomirror-ca", nil)
+	upstreamCert := testutils.WriteCertificate(dir, "upstream.internal", ca)
+	clientCert := testutils.WriteCertificate(dir, "gomirror-client", ca)
+
+	server := newUnstartedMTLSServer(t, ca, upstreamCert, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			http.Error(w, "no client certificate", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(r.Proto))
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	upstreamTLS := UpstreamTLSConfig{
+		CAFile:     ca.CertFile,
+		CertFile:   clientCert.CertFile,
+		KeyFile:    clientCert.KeyFile,
+		ServerName: "upstream.internal",
+	}
+	transport, err := upstreamTransport(&upstreamTLS, true, logrus.StandardLogger())
+	assert.NoError(t, err)
+
+	// https urls keep their tls settings with h2c
+	res, err := (&http.Client{Transport: transport}).Get(server.URL)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "HTTP/2.0", string(body))
+
+	// and the certificate of the upstream is verified
+	transport, err = upstreamTransport(&UpstreamTLSConfig{ServerName: "upstream.internal"}, true, logrus.StandardLogger())
+	assert.NoError(t, err)
+	_, err = (&http.Client{Transport: transport}).Get(server.URL)
+	assert.Error(t, err)
+}
@@ -0,0 +1,413 @@
+package mirror
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/petereps/gomirror/pkg/discovery"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http/httpguts"
+)
+
+// FieldError is a problem with a single config field
+type FieldError struct {
+	// Field is the path of the field as written in a config file,
+	// eg mirror.headers[0].key
+	Field   string
+	Message string
+}
+
+func (e FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// ValidationError holds every problem found in a Config
+type ValidationError []FieldError
+
+func (e ValidationError) Error() string {
+	problems := make([]string, len(e))
+	for i, fieldErr := range e {
+		problems[i] = fieldErr.Error()
+	}
+	return fmt.Sprintf("invalid config:\n  %s", strings.Join(problems, "\n  "))
+}
+
+type validator struct {
+	errs ValidationError
+}
+
+func (v *validator) add(field, format string, args ...interface{}) {
+	v.errs = append(v.errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) check(field string, err error) {
+	if err != nil {
+		v.add(field, "%s", err)
+	}
+}
+
+func (v *validator) url(field, rawURL, mode string) {
+	v.schemeURL(field, rawURL, mode, urlSchemes)
+}
+
+// schemeURL validates an upstream url with one of schemes, or a tcp
+// address in tcp mode
+func (v *validator) schemeURL(field, rawURL, mode string, schemes []string) {
+	if rawURL == "" {
+		v.add(field, "is required")
+		return
+	}
+
+	if mode == ModeTCP {
+		_, err := tcpAddress(rawURL)
+		v.check(field, err)
+		return
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		v.add(field, "%s", err)
+		return
+	}
+
+	if !hasScheme(schemes, u.Scheme) {
+		v.add(field, "scheme must be %s, got %q", schemeList(schemes), u.Scheme)
+	}
+
+	if u.Hostname() == "" {
+		v.add(field, "is missing a host")
+	}
+}
+
+// urlSchemes are the schemes of upstream urls, and mirrorSchemes also the
+// sinks the mirror url can be
+var (
+	urlSchemes    = []string{"http", "https", "ws", "wss"}
+	mirrorSchemes = append(append([]string{}, urlSchemes...), SinkFile, SinkStdout, SinkUnix, SinkExec)
+)
+
+func hasScheme(schemes []string, scheme string) bool {
+	for _, s := range schemes {
+		if s == scheme {
+			return true
+		}
+	}
+	return false
+}
+
+// schemeList lists schemes in a sentence, eg "http, https or ws"
+func schemeList(schemes []string) string {
+	if len(schemes) == 1 {
+		return schemes[0]
+	}
+	return strings.Join(schemes[:len(schemes)-1], ", ") + " or " + schemes[len(schemes)-1]
+}
+
+// mirrorURL validates the mirror url, which can also be a sink url
+func (v *validator) mirrorURL(field, rawURL, mode string) {
+	u, err := url.Parse(rawURL)
+	if err != nil || mode == ModeTCP || !isSinkScheme(u.Scheme) {
+		v.schemeURL(field, rawURL, mode, mirrorSchemes)
+		return
+	}
+
+	if _, err := newSink(u, DefaultMaxCaptureSize, logrus.StandardLogger()); err != nil {
+		v.add(field, "%s", err)
+		return
+	}
+
+	if u.Scheme == SinkFile {
+		v.writableFile(field, u.Path)
+	}
+}
+
+func (v *validator) diff(field string, c *Config, mode string) {
+	d := &c.Mirror.Diff
+	if !d.Enabled {
+		return
+	}
+
+	if mode == ModeTCP {
+		v.add(field+".enabled", "diffing is not supported in tcp mode")
+		return
+	}
+	if u, err := url.Parse(c.Mirror.URL); err == nil && isSinkScheme(u.Scheme) {
+		v.add(field+".enabled", "is not supported by the %s sink", u.Scheme)
+	}
+	if !c.Primary.DoMirrorBody {
+		v.add(field+".enabled", "needs primary.do-mirror-body, so that requests can be copied")
+	}
+
+	v.url(field+".secondary-url", d.SecondaryURL, mode)
+	if d.SampleRate < 0 || d.SampleRate > 1 {
+		v.add(field+".sample-rate", "must be between 0 and 1, got %v", d.SampleRate)
+	}
+
+	for i, method := range d.SecondaryMethods {
+		// methods are tokens, like header names
+		if !httpguts.ValidHeaderFieldName(method) {
+			v.add(fmt.Sprintf("%s.secondary-methods[%d]", field, i), "%q is not a valid method", method)
+		}
+	}
+	if d.NoiseSamples < 0 {
+		v.add(field+".noise-samples", "must not be negative, got %d", d.NoiseSamples)
+	}
+	if d.NoiseRatio < 0 || d.NoiseRatio > 1 {
+		v.add(field+".noise-ratio", "must be between 0 and 1, got %v", d.NoiseRatio)
+	}
+	if d.MaxDecodedSize < 0 {
+		v.add(field+".max-decoded-size", "must not be negative, got %d", d.MaxDecodedSize)
+	}
+
+	if _, err := loadNoise(d.NoiseFile); err != nil {
+		v.add(field+".noise-file", "%s", err)
+	} else {
+		v.writableFile(field+".noise-file", d.NoiseFile)
+	}
+
+	for i := range d.Compare {
+		compareField := fmt.Sprintf("%s.compare[%d]", field, i)
+		if d.Compare[i].Route == "" {
+			v.add(compareField+".route", "is required")
+			continue
+		}
+		if _, err := NewComparator(&d.Compare[i]); err != nil {
+			v.add(compareField, "%s", err)
+		}
+	}
+}
+
+func (v *validator) headers(field string, headers []Header) {
+	for i, header := range headers {
+		if !httpguts.ValidHeaderFieldName(header.Key) {
+			v.add(fmt.Sprintf("%s[%d].key", field, i), "%q is not a valid header name", header.Key)
+		}
+		if !httpguts.ValidHeaderFieldValue(header.Value) {
+			v.add(fmt.Sprintf("%s[%d].value", field, i), "contains invalid characters")
+		}
+	}
+}
+
+func (v *validator) file(field, path string) {
+	if path == "" {
+		return
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		v.add(field, "%s", err)
+		return
+	}
+
+	if info.IsDir() {
+		v.add(field, "%s is a directory", path)
+	}
+}
+
+// writableFile checks a file can be opened for writing, without creating it
+func (v *validator) writableFile(field, path string) {
+	if path == "" {
+		return
+	}
+
+	if info, err := os.Stat(path); err == nil {
+		if info.IsDir() {
+			v.add(field, "%s is a directory", path)
+			return
+		}
+
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			v.add(field, "%s", err)
+			return
+		}
+		f.Close()
+		return
+	}
+
+	dir := filepath.Dir(path)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		v.add(field, "directory %s does not exist", dir)
+		return
+	}
+
+	f, err := ioutil.TempFile(dir, ".gomirror-validate")
+	if err != nil {
+		v.add(field, "directory %s is not writable", dir)
+		return
+	}
+	f.Close()
+	os.Remove(f.Name())
+}
+
+func (v *validator) upstreamTLS(field string, c *UpstreamTLSConfig) {
+	v.file(field+".ca-file", c.CAFile)
+	v.file(field+".cert-file", c.CertFile)
+	v.file(field+".key-file", c.KeyFile)
+
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		v.add(field, "cert-file and key-file must be set together")
+	}
+}
+
+func (v *validator) grpcMethods(field string, methods []string) {
+	for i, method := range methods {
+		if method != "*" && !strings.HasPrefix(method, "/") {
+			v.add(fmt.Sprintf("%s[%d]", field, i), "%q should be in the form /package.Service/Method", method)
+		}
+	}
+}
+
+func (v *validator) dockerLookup(field string, c *DockerLookupConfig, mode string) {
+	if !c.Enabled {
+		return
+	}
+	if mode == ModeTCP {
+		v.add(field+".enabled", "docker lookup is not supported in tcp mode")
+	}
+	if strings.ContainsAny(c.LabelPrefix, " \t=") {
+		v.add(field+".label-prefix", "invalid docker label %q", c.LabelPrefix)
+	}
+}
+
+func (v *validator) discovery(field string, c *DiscoveryConfig, mode string) {
+	switch c.Provider {
+	case "", ProviderDocker:
+	case ProviderStatic:
+		if len(c.Endpoints) == 0 {
+			v.add(field+".endpoints", "are required by the static provider")
+		}
+		for i, endpoint := range c.Endpoints {
+			_, err := discovery.ParseEndpoint(endpoint)
+			v.check(fmt.Sprintf("%s.endpoints[%d]", field, i), err)
+		}
+	case ProviderDNS:
+		if c.DNSServer != "" {
+			_, _, err := net.SplitHostPort(c.DNSServer)
+			v.check(field+".dns-server", err)
+		}
+	case ProviderFile:
+		if c.File == "" {
+			v.add(field+".file", "is required by the file provider")
+		} else if _, err := discovery.ParseEndpointsFile(c.File); err != nil {
+			v.add(field+".file", "%s", err)
+		}
+	default:
+		v.add(field+".provider", "must be one of %s, %s, %s or %s, got %q",
+			ProviderDocker, ProviderStatic, ProviderDNS, ProviderFile, c.Provider)
+	}
+
+	if c.Provider != "" && mode == ModeTCP {
+		v.add(field+".provider", "discovery is not supported in tcp mode")
+	}
+
+	switch c.Balance {
+	case "", discovery.RoundRobin, discovery.Random:
+	default:
+		v.add(field+".balance", "must be %s or %s, got %q", discovery.RoundRobin, discovery.Random, c.Balance)
+	}
+}
+
+// Validate checks the config for problems, returning a ValidationError
+// listing all of them
+func (c *Config) Validate() error {
+	v := &validator{}
+	v.errs = append(v.errs, c.interpolationErrs...)
+
+	mode := c.Mode
+	switch mode {
+	case "":
+		mode = ModeHTTP
+	case ModeHTTP, ModeTCP:
+	default:
+		v.add("mode", "must be %s or %s, got %q", ModeHTTP, ModeTCP, c.Mode)
+	}
+
+	if c.Port < 0 || c.Port > 65535 {
+		v.add("port", "must be a valid tcp port, got %d", c.Port)
+	}
+
+	if c.Health.AdminPort < 0 || c.Health.AdminPort > 65535 {
+		v.add("health.admin-port", "must be a valid tcp port, got %d", c.Health.AdminPort)
+	} else if c.Health.AdminPort != 0 && c.Health.AdminPort == c.Port {
+		v.add("health.admin-port", "must be different from the port")
+	}
+	if c.Health.PrimaryPath != "" && !strings.HasPrefix(c.Health.PrimaryPath, "/") {
+		v.add("health.primary-path", "must start with /, got %q", c.Health.PrimaryPath)
+	}
+
+	switch strings.ToLower(c.LogLevel) {
+	case "", "debug", "info", "warn", "error":
+	default:
+		v.add("log-level", "must be one of error, warn, info or debug, got %q", c.LogLevel)
+	}
+	v.writableFile("log-file", c.LogFile)
+
+	if c.TLS.Enabled {
+		if c.TLS.CertFile == "" {
+			v.add("tls.cert-file", "is required when tls is enabled")
+		}
+		if c.TLS.KeyFile == "" {
+			v.add("tls.key-file", "is required when tls is enabled")
+		}
+		v.file("tls.cert-file", c.TLS.CertFile)
+		v.file("tls.key-file", c.TLS.KeyFile)
+		v.file("tls.client-ca-file", c.TLS.ClientCAFile)
+
+		_, err := parseTLSVersion(c.TLS.MinVersion)
+		v.check("tls.min-version", err)
+
+		_, err = parseCipherSuites(c.TLS.CipherSuites)
+		v.check("tls.cipher-suites", err)
+
+		if _, ok := clientAuthTypes[strings.ToLower(c.TLS.ClientAuth)]; c.TLS.ClientAuth != "" && !ok {
+			v.add("tls.client-auth", "unknown client auth type %q", c.TLS.ClientAuth)
+		}
+	}
+
+	v.url("primary.url", c.Primary.URL, mode)
+	v.headers("primary.headers", c.Primary.Headers)
+	v.upstreamTLS("primary.tls", &c.Primary.TLS)
+
+	v.dockerLookup("primary.docker-lookup-config", &c.Primary.DockerLookup, mode)
+	v.discovery("primary.discovery", &c.Primary.Discovery, mode)
+
+	v.mirrorURL("mirror.url", c.Mirror.URL, mode)
+	v.headers("mirror.headers", c.Mirror.Headers)
+	v.upstreamTLS("mirror.tls", &c.Mirror.TLS)
+	v.grpcMethods("mirror.grpc.methods", c.Mirror.GRPC.Methods)
+	v.grpcMethods("mirror.grpc.stream-methods", c.Mirror.GRPC.StreamMethods)
+	v.dockerLookup("mirror.docker-lookup-config", &c.Mirror.DockerLookup, mode)
+	v.discovery("mirror.discovery", &c.Mirror.Discovery, mode)
+	if u, err := url.Parse(c.Mirror.URL); err == nil && isSinkScheme(u.Scheme) &&
+		c.Mirror.Discovery.provider(c.Mirror.DockerLookup) != "" {
+		v.add("mirror.discovery", "is not supported by the %s sink", u.Scheme)
+	}
+	if c.Mirror.SampleRate < 0 || c.Mirror.SampleRate > 1 {
+		v.add("mirror.sample-rate", "must be between 0 and 1, got %v", c.Mirror.SampleRate)
+	}
+	v.writableFile("mirror.outcome-log", c.Mirror.OutcomeLog)
+	if c.Mirror.MaxCaptureSize < 0 {
+		v.add("mirror.max-capture-size", "must not be negative, got %d", c.Mirror.MaxCaptureSize)
+	}
+	v.diff("mirror.diff", c, mode)
+
+	// the primary and mirror share one docker resolver
+	if c.Primary.Discovery.provider(c.Primary.DockerLookup) == ProviderDocker &&
+		c.Mirror.Discovery.provider(c.Mirror.DockerLookup) == ProviderDocker &&
+		(c.Primary.DockerLookup.HostIdentifier != c.Mirror.DockerLookup.HostIdentifier ||
+			c.Primary.DockerLookup.LabelPrefix != c.Mirror.DockerLookup.LabelPrefix ||
+			c.Primary.DockerLookup.Network != c.Mirror.DockerLookup.Network) {
+		v.add("mirror.docker-lookup-config", "must use the same host-identifier, label-prefix and network as the primary")
+	}
+
+	if len(v.errs) > 0 {
+		return v.errs
+	}
+	return nil
+}
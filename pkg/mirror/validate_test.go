@@ -0,0 +1,148 @@
+package mirror
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	cfg := &Config{
+		Primary: PrimaryConfig{URL: "http://127.0.0.1:8002"},
+		Mirror: MirrorConfig{
+			URL:     "https://mirror.internal/",
+			Headers: []Header{{Key: "X-Mirror-Header", Value: "example-header"}},
+		},
+	}
+	assert.NoError(t, cfg.Validate())
+
+	cfg = &Config{
+		Port:     70000,
+		LogLevel: "loud",
+		LogFile:  "/nonexistent/gomirror.log",
+		TLS:      TLSConfig{Enabled: true, MinVersion: "0.9"},
+		Primary: PrimaryConfig{
+			URL:          "ftp://primary",
+			DockerLookup: DockerLookupConfig{Enabled: true, LabelPrefix: "gomirror host"},
+			TLS:          UpstreamTLSConfig{CertFile: "/nonexistent/client.crt"},
+		},
+		Mirror: MirrorConfig{
+			Headers: []Header{{Key: "bad key", Value: "value"}},
+			GRPC:    GRPCConfig{Methods: []string{"pkg.Service/Method"}},
+		},
+	}
+
+	err := cfg.Validate()
+	assert.Error(t, err)
+
+	fields := []string{}
+	for _, fieldErr := range err.(ValidationError) {
+		fields = append(fields, fieldErr.Field)
+	}
+
+	assert.Equal(t, []string{
+		"port",
+		"log-level",
+		"log-file",
+		"tls.cert-file",
+		"tls.key-file",
+		"tls.min-version",
+		"primary.url",
+		"primary.tls.cert-file",
+		"primary.tls",
+		"primary.docker-lookup-config.label-prefix",
+		"mirror.url",
+		"mirror.headers[0].key",
+		"mirror.grpc.methods[0]",
+	}, fields)
+	assert.Equal(t, `scheme must be http, https, ws or wss, got "ftp"`, err.(ValidationError)[6].Message)
+}
+
+func TestValidateDockerLookup(t *testing.T) {
+	cfg := &Config{
+		Primary: PrimaryConfig{
+			URL:          "http://api.internal",
+			DockerLookup: DockerLookupConfig{Enabled: true},
+		},
+		Mirror: MirrorConfig{
+			URL:          "http://api-shadow.internal",
+			DockerLookup: DockerLookupConfig{Enabled: true},
+		},
+	}
+	assert.NoError(t, cfg.Validate())
+
+	cfg.Primary.Discovery.Balance = "least-connections"
+	cfg.Mirror.DockerLookup.HostIdentifier = "VIRTUAL_HOST"
+	err := cfg.Validate()
+	assert.Error(t, err)
+	assert.Equal(t, "primary.discovery.balance", err.(ValidationError)[0].Field)
+	assert.Equal(t, "mirror.docker-lookup-config", err.(ValidationError)[1].Field)
+}
+
+func TestValidateDiscovery(t *testing.T) {
+	cfg := &Config{
+		Primary: PrimaryConfig{
+			URL: "http://api.internal",
+			Discovery: DiscoveryConfig{
+				Provider:  ProviderStatic,
+				Endpoints: []string{"10.0.0.1:8080", "10.0.0.2"},
+			},
+		},
+		Mirror: MirrorConfig{
+			URL:       "http://api-shadow.internal",
+			Discovery: DiscoveryConfig{Provider: ProviderDNS, DNSServer: "10.0.0.53:53"},
+		},
+	}
+	assert.NoError(t, cfg.Validate())
+
+	cfg.Primary.Discovery.Endpoints = []string{"10.0.0.1:8080", ":8080"}
+	cfg.Mirror.Discovery = DiscoveryConfig{Provider: "consul"}
+	err := cfg.Validate()
+	assert.Error(t, err)
+	assert.Equal(t, "primary.discovery.endpoints[1]", err.(ValidationError)[0].Field)
+	assert.Equal(t, "mirror.discovery.provider", err.(ValidationError)[1].Field)
+
+	cfg.Primary.Discovery = DiscoveryConfig{Provider: ProviderFile, File: "testdata/missing-endpoints"}
+	cfg.Mirror.Discovery = DiscoveryConfig{}
+	err = cfg.Validate()
+	assert.Error(t, err)
+	assert.Equal(t, "primary.discovery.file", err.(ValidationError)[0].Field)
+}
+
+func TestValidateTCP(t *testing.T) {
+	cfg := &Config{
+		Mode:    ModeTCP,
+		Primary: PrimaryConfig{URL: "tcp://redis:6379"},
+		Mirror:  MirrorConfig{URL: "tcp://redis-shadow:6379"},
+	}
+	assert.NoError(t, cfg.Validate())
+
+	cfg.Mirror.URL = "http://redis-shadow"
+	cfg.Primary.DockerLookup = DockerLookupConfig{Enabled: true, HostIdentifier: "HOST"}
+	err := cfg.Validate()
+	assert.Error(t, err)
+	assert.Len(t, err.(ValidationError), 2)
+}
+
+func TestValidateScheme(t *testing.T) {
+	v := &validator{}
+	v.schemeURL("url", "wss://mirror.internal", ModeHTTP, []string{"http", "https"})
+	v.schemeURL("url", "https://mirror.internal", ModeHTTP, []string{"http", "https"})
+	assert.Len(t, v.errs, 1)
+	assert.Equal(t, `scheme must be http or https, got "wss"`, v.errs[0].Message)
+}
+
+func TestServeHTTPWithoutMirrorURL(t *testing.T) {
+	backendServer := httptest.NewServer(returnBody("primary", http.StatusOK))
+	defer backendServer.Close()
+
+	mirror, err := New(&Config{Primary: PrimaryConfig{URL: backendServer.URL, DoMirrorBody: true}})
+	assert.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+	mirror.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("hello")))
+	assert.Equal(t, "primary", recorder.Body.String())
+}
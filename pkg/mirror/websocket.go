@@ -0,0 +1,282 @@
+package mirror
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/petereps/gomirror/pkg/discovery"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxRecordedFrame is the largest mirror frame payload that is logged
+const maxRecordedFrame = 64 * 1024
+
+// websocketHandshakeHeaders are copied to the mirror handshake even when
+// DoMirrorHeaders is disabled
+var websocketHandshakeHeaders = []string{
+	"Origin",
+	"Connection",
+	"Upgrade",
+	"Sec-Websocket-Key",
+	"Sec-Websocket-Version",
+	"Sec-Websocket-Protocol",
+	"Sec-Websocket-Extensions",
+}
+
+type websocketSessionKey struct{}
+
+func headerContainsToken(header http.Header, key, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(key)] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isWebSocketUpgrade(r *http.Request) bool {
+	return headerContainsToken(r.Header, "Connection", "upgrade") &&
+		strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+func (t *mirrorTarget) startWebSocketMirror(proxyReq *http.Request, r *http.Request) *mirrorStream {
+	for _, key := range websocketHandshakeHeaders {
+		if value, ok := r.Header[key]; ok {
+			proxyReq.Header[key] = value
+		}
+	}
+
+	entry := t.log.WithField("mirror_url", proxyReq.URL.String())
+	entry.Debugln("mirroring websocket")
+
+	return newMirrorStream(
+		entry,
+		func() (net.Conn, io.Reader, error) { return t.websocketHandshake(proxyReq) },
+		func(r io.Reader) { recordWebSocketFrames(entry, r) },
+	)
+}
+
+// recordWebSocketFrames logs the frames sent back by the mirror, which are
+// otherwise discarded
+func recordWebSocketFrames(entry *logrus.Entry, r io.Reader) {
+	for {
+		opcode, payload, err := readWebSocketFrame(r)
+		if err != nil {
+			if err != io.EOF {
+				entry.WithError(err).Debugln("mirrored websocket closed")
+			}
+			return
+		}
+
+		entry.WithField("opcode", opcode).
+			WithField("response", string(payload)).
+			Debugln("mirrored websocket frame")
+	}
+}
+
+func (t *mirrorTarget) dialMirror(ctx context.Context, proxyReq *http.Request) (net.Conn, error) {
+	u := proxyReq.URL
+	secure := u.Scheme == "https" || u.Scheme == "wss"
+
+	address := u.Host
+	if u.Port() == "" {
+		if secure {
+			address = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			address = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+
+	dial := (&net.Dialer{}).DialContext
+	tlsConfig := &tls.Config{}
+	transport := t.client.Transport
+	balanced, isBalanced := transport.(*discovery.Transport)
+	if isBalanced {
+		transport = balanced.Next
+	}
+	if transport, ok := transport.(*http.Transport); ok {
+		if transport.DialContext != nil {
+			dial = transport.DialContext
+		}
+		if transport.TLSClientConfig != nil {
+			tlsConfig = transport.TLSClientConfig.Clone()
+		}
+	}
+	if isBalanced {
+		// the session is one connection, so an endpoint is picked for it
+		dial = balanced.Balancer.DialContext
+	}
+
+	conn, err := dial(ctx, "tcp", address)
+	if err != nil || !secure {
+		return conn, err
+	}
+
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = u.Hostname()
+	}
+	// websocket upgrades are only defined for http/1.1
+	tlsConfig.NextProtos = []string{"http/1.1"}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func (t *mirrorTarget) websocketHandshake(proxyReq *http.Request) (net.Conn, *bufio.Reader, error) {
+	ctx := context.Background()
+	if t.client.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.client.Timeout)
+		defer cancel()
+	}
+
+	conn, err := t.dialMirror(ctx, proxyReq)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if err := proxyReq.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, proxyReq)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, maxRecordedFrame))
+		conn.Close()
+		return nil, nil, fmt.Errorf("mirror refused websocket upgrade with %s: %s", res.Status, body)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, reader, nil
+}
+
+func readWebSocketFrame(r io.Reader) (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	opcode := header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	recorded := length
+	if recorded > maxRecordedFrame {
+		recorded = maxRecordedFrame
+	}
+
+	payload := make([]byte, recorded)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+
+	if _, err := io.CopyN(ioutil.Discard, r, int64(length-recorded)); err != nil {
+		return 0, nil, err
+	}
+
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+
+	return opcode, payload, nil
+}
+
+// websocketConn tees bytes written to the primary websocket connection into
+// the mirror session
+type websocketConn struct {
+	io.ReadWriteCloser
+	session *mirrorStream
+}
+
+func (c *websocketConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	if n > 0 {
+		c.session.send(p[:n])
+	}
+	return n, err
+}
+
+func (c *websocketConn) Close() error {
+	c.session.Close()
+	return c.ReadWriteCloser.Close()
+}
+
+// upgradeTransport hooks the primary connection of websocket upgrades so
+// that client frames can be copied to the mirror
+type upgradeTransport struct {
+	http.RoundTripper
+}
+
+func (t *upgradeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.RoundTripper.RoundTrip(req)
+
+	session, ok := req.Context().Value(websocketSessionKey{}).(*mirrorStream)
+	if !ok {
+		return res, err
+	}
+
+	if err != nil || res.StatusCode != http.StatusSwitchingProtocols {
+		session.Close()
+		return res, err
+	}
+
+	backConn, ok := res.Body.(io.ReadWriteCloser)
+	if !ok {
+		session.Close()
+		return res, err
+	}
+
+	res.Body = &websocketConn{backConn, session}
+	return res, nil
+}
@@ -0,0 +1,96 @@
+package mirror
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+)
+
+func TestMirrorWebSocket(t *testing.T) {
+	backendServer := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		io.Copy(ws, ws)
+	}))
+	defer backendServer.Close()
+
+	received := make(chan string, 10)
+	mirroredServer := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		assert.Equal(t, "/mirror/chat", ws.Request().URL.Path)
+		for {
+			var msg string
+			if err := websocket.Message.Receive(ws, &msg); err != nil {
+				return
+			}
+			received <- msg
+			// replies from the mirror never reach the client
+			websocket.Message.Send(ws, "from mirror")
+		}
+	}))
+	defer mirroredServer.Close()
+
+	cfg := &Config{
+		Primary: PrimaryConfig{URL: backendServer.URL},
+		Mirror:  MirrorConfig{URL: mirroredServer.URL + "/mirror"},
+	}
+	mirror, err := New(cfg)
+	assert.NoError(t, err)
+
+	mirrorProxy := httptest.NewServer(mirror)
+	defer mirrorProxy.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(mirrorProxy.URL, "http") + "/chat"
+	ws, err := websocket.Dial(wsURL, "", mirrorProxy.URL)
+	assert.NoError(t, err)
+	defer ws.Close()
+
+	for _, msg := range []string{"hello", "world"} {
+		assert.NoError(t, websocket.Message.Send(ws, msg))
+
+		var reply string
+		assert.NoError(t, websocket.Message.Receive(ws, &reply))
+		assert.Equal(t, msg, reply)
+
+		select {
+		case <-time.After(5 * time.Second):
+			panic("timed out waiting for mirror")
+		case mirrored := <-received:
+			assert.Equal(t, msg, mirrored)
+		}
+	}
+}
+
+func TestMirrorWebSocketMirrorDown(t *testing.T) {
+	backendServer := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		io.Copy(ws, ws)
+	}))
+	defer backendServer.Close()
+
+	mirroredServer := httptest.NewServer(returnBody("no websockets here", http.StatusNotFound))
+	defer mirroredServer.Close()
+
+	cfg := &Config{
+		Primary: PrimaryConfig{URL: backendServer.URL},
+		Mirror:  MirrorConfig{URL: mirroredServer.URL},
+	}
+	mirror, err := New(cfg)
+	assert.NoError(t, err)
+
+	mirrorProxy := httptest.NewServer(mirror)
+	defer mirrorProxy.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(mirrorProxy.URL, "http")
+	ws, err := websocket.Dial(wsURL, "", mirrorProxy.URL)
+	assert.NoError(t, err)
+	defer ws.Close()
+
+	assert.NoError(t, websocket.Message.Send(ws, "hello"))
+
+	var reply string
+	assert.NoError(t, websocket.Message.Receive(ws, &reply))
+	assert.Equal(t, "hello", reply)
+}
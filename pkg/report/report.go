@@ -0,0 +1,245 @@
+// Package report summarizes the outcome log written by gomirror, comparing
+// the latency, statuses and bodies of the primary and mirror responses
+package report
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/petereps/gomirror/pkg/mirror"
+)
+
+// maxLine is the longest outcome log line read
+const maxLine = 1 << 20
+
+// Latency is the percentiles of response latencies, in milliseconds
+type Latency struct {
+	P50 float64 `json:"p50_ms"`
+	P95 float64 `json:"p95_ms"`
+	P99 float64 `json:"p99_ms"`
+}
+
+// Route is the comparison of the responses for one method and route
+type Route struct {
+	// Route is the method and route, eg GET /items/:id, or "all"
+	Route    string `json:"route"`
+	Requests int    `json:"requests"`
+	// Mirror latency only covers the requests the mirror answered
+	Primary Latency `json:"primary_latency"`
+	Mirror  Latency `json:"mirror_latency"`
+	// StatusAgreement and BodyAgreement are the fraction of requests with
+	// the same status or body hash from both
+	StatusAgreement float64 `json:"status_agreement"`
+	BodyAgreement   float64 `json:"body_agreement"`
+	// PrimaryErrorRate is the fraction of 5xx responses, and
+	// MirrorErrorRate also includes requests the mirror failed to answer
+	PrimaryErrorRate float64 `json:"primary_error_rate"`
+	MirrorErrorRate  float64 `json:"mirror_error_rate"`
+	// Dropped is the number of requests that were never sent to the mirror
+	// because its sink fell behind. They aren't counted in Requests
+	Dropped int `json:"dropped"`
+}
+
+// StatusPair counts the requests answered with one status by the primary
+// and another by the mirror. Mirror is 0 when the mirror failed
+type StatusPair struct {
+	Primary int `json:"primary"`
+	Mirror  int `json:"mirror"`
+	Count   int `json:"count"`
+}
+
+// Report is the summary of an outcome log
+type Report struct {
+	Total  Route   `json:"total"`
+	Routes []Route `json:"routes"`
+	// Statuses is the status agreement matrix, sorted by the primary and
+	// then the mirror status
+	Statuses []StatusPair `json:"statuses"`
+}
+
+// routeStats collects the outcomes of a route
+type routeStats struct {
+	primary, mirror []float64
+
+	statusMatches, bodyMatches  int
+	primaryErrors, mirrorErrors int
+	dropped                     int
+}
+
+func (s *routeStats) add(outcome *mirror.Outcome) {
+	if outcome.MirrorDropped {
+		s.dropped++
+		return
+	}
+
+	s.primary = append(s.primary, outcome.PrimaryLatency)
+	if outcome.MirrorError == "" {
+		s.mirror = append(s.mirror, outcome.MirrorLatency)
+	}
+
+	if outcome.PrimaryStatus == outcome.MirrorStatus {
+		s.statusMatches++
+	}
+	if outcome.PrimaryHash == outcome.MirrorHash {
+		s.bodyMatches++
+	}
+	if outcome.PrimaryStatus >= 500 {
+		s.primaryErrors++
+	}
+	if outcome.MirrorError != "" || outcome.MirrorStatus >= 500 {
+		s.mirrorErrors++
+	}
+}
+
+func (s *routeStats) route(name string) Route {
+	requests := len(s.primary)
+	return Route{
+		Route:            name,
+		Requests:         requests,
+		Primary:          latency(s.primary),
+		Mirror:           latency(s.mirror),
+		StatusAgreement:  fraction(s.statusMatches, requests),
+		BodyAgreement:    fraction(s.bodyMatches, requests),
+		PrimaryErrorRate: fraction(s.primaryErrors, requests),
+		MirrorErrorRate:  fraction(s.mirrorErrors, requests),
+		Dropped:          s.dropped,
+	}
+}
+
+func fraction(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
+
+// latency returns the percentiles of values, which are sorted
+func latency(values []float64) Latency {
+	sort.Float64s(values)
+	return Latency{
+		P50: percentile(values, 50),
+		P95: percentile(values, 95),
+		P99: percentile(values, 99),
+	}
+}
+
+// percentile returns the nearest rank percentile p of sorted values
+func percentile(sorted []float64, p int) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// collector collects the outcomes of one or more logs
+type collector struct {
+	total    routeStats
+	routes   map[string]*routeStats
+	statuses map[StatusPair]int
+}
+
+func newCollector() *collector {
+	return &collector{
+		routes:   map[string]*routeStats{},
+		statuses: map[StatusPair]int{},
+	}
+}
+
+func (c *collector) read(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxLine)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		outcome := &mirror.Outcome{}
+		if err := json.Unmarshal(scanner.Bytes(), outcome); err != nil {
+			return fmt.Errorf("line %d: %s", line, err)
+		}
+
+		name := outcome.Method + " " + outcome.Route
+		if c.routes[name] == nil {
+			c.routes[name] = &routeStats{}
+		}
+		c.routes[name].add(outcome)
+		c.total.add(outcome)
+		if outcome.MirrorDropped {
+			continue
+		}
+		c.statuses[StatusPair{Primary: outcome.PrimaryStatus, Mirror: outcome.MirrorStatus}]++
+	}
+	return scanner.Err()
+}
+
+func (c *collector) report() *Report {
+	report := &Report{
+		Total:    c.total.route("all"),
+		Routes:   []Route{},
+		Statuses: []StatusPair{},
+	}
+
+	for name, stats := range c.routes {
+		report.Routes = append(report.Routes, stats.route(name))
+	}
+	sort.Slice(report.Routes, func(i, j int) bool {
+		return report.Routes[i].Route < report.Routes[j].Route
+	})
+
+	for pair, count := range c.statuses {
+		pair.Count = count
+		report.Statuses = append(report.Statuses, pair)
+	}
+	sort.Slice(report.Statuses, func(i, j int) bool {
+		a, b := report.Statuses[i], report.Statuses[j]
+		if a.Primary != b.Primary {
+			return a.Primary < b.Primary
+		}
+		return a.Mirror < b.Mirror
+	})
+
+	return report
+}
+
+// Read reads an outcome log and summarizes it
+func Read(r io.Reader) (*Report, error) {
+	c := newCollector()
+	if err := c.read(r); err != nil {
+		return nil, err
+	}
+	return c.report(), nil
+}
+
+// ReadFiles reads outcome log files, eg a log and its rotated backups, and
+// summarizes them together
+func ReadFiles(paths ...string) (*Report, error) {
+	c := newCollector()
+	for _, path := range paths {
+		if err := readFile(c, path); err != nil {
+			return nil, err
+		}
+	}
+	return c.report(), nil
+}
+
+func readFile(c *collector, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := c.read(f); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/petereps/gomirror/pkg/mirror"
+	"github.com/stretchr/testify/assert"
+)
+
+func outcomeLog(t *testing.T, outcomes ...mirror.Outcome) string {
+	lines := []string{}
+	for _, outcome := range outcomes {
+		line, err := json.Marshal(outcome)
+		assert.NoError(t, err)
+		lines = append(lines, string(line))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func testOutcomes() []mirror.Outcome {
+	outcomes := []mirror.Outcome{}
+	for i := 1; i <= 100; i++ {
+		outcomes = append(outcomes, mirror.Outcome{
+			Method:         "GET",
+			Route:          "/items/:id",
+			PrimaryStatus:  200,
+			PrimaryLatency: float64(i),
+			PrimaryHash:    "a",
+			MirrorStatus:   200,
+			MirrorLatency:  float64(i * 2),
+			MirrorHash:     "a",
+		})
+	}
+
+	return append(outcomes,
+		mirror.Outcome{Method: "POST", Route: "/items", PrimaryStatus: 201, PrimaryHash: "b", MirrorStatus: 500, MirrorHash: "c"},
+		mirror.Outcome{Method: "POST", Route: "/items", PrimaryStatus: 201, PrimaryHash: "b", MirrorError: "connection refused"},
+		mirror.Outcome{Method: "POST", Route: "/items", PrimaryStatus: 503, PrimaryHash: "d", MirrorStatus: 503, MirrorHash: "d"},
+		mirror.Outcome{Method: "POST", Route: "/items", PrimaryStatus: 201, PrimaryHash: "b", MirrorDropped: true},
+	)
+}
+
+func TestRead(t *testing.T) {
+	r, err := Read(strings.NewReader(outcomeLog(t, testOutcomes()...)))
+	assert.NoError(t, err)
+
+	assert.Len(t, r.Routes, 2)
+	get := r.Routes[0]
+	assert.Equal(t, "GET /items/:id", get.Route)
+	assert.Equal(t, 100, get.Requests)
+	assert.Equal(t, Latency{P50: 50, P95: 95, P99: 99}, get.Primary)
+	assert.Equal(t, Latency{P50: 100, P95: 190, P99: 198}, get.Mirror)
+	assert.Equal(t, 1.0, get.StatusAgreement)
+	assert.Equal(t, 1.0, get.BodyAgreement)
+	assert.Zero(t, get.MirrorErrorRate)
+
+	post := r.Routes[1]
+	assert.Equal(t, "POST /items", post.Route)
+	assert.Equal(t, 3, post.Requests)
+	assert.InDelta(t, 1.0/3, post.StatusAgreement, 0.001)
+	assert.InDelta(t, 1.0/3, post.BodyAgreement, 0.001)
+	assert.InDelta(t, 1.0/3, post.PrimaryErrorRate, 0.001)
+	assert.Equal(t, 1.0, post.MirrorErrorRate)
+	// dropped requests are counted apart from the compared ones
+	assert.Equal(t, 1, post.Dropped)
+	assert.Zero(t, get.Dropped)
+
+	assert.Equal(t, "all", r.Total.Route)
+	assert.Equal(t, 103, r.Total.Requests)
+	assert.Equal(t, 1, r.Total.Dropped)
+
+	assert.Equal(t, []StatusPair{
+		{Primary: 200, Mirror: 200, Count: 100},
+		{Primary: 201, Mirror: 0, Count: 1},
+		{Primary: 201, Mirror: 500, Count: 1},
+		{Primary: 503, Mirror: 503, Count: 1},
+	}, r.Statuses)
+}
+
+func TestReadFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomirror-report")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	outcomes := testOutcomes()
+	path := filepath.Join(dir, "outcomes.ndjson")
+	assert.NoError(t, ioutil.WriteFile(path+".1", []byte(outcomeLog(t, outcomes[:50]...)), 0644))
+	assert.NoError(t, ioutil.WriteFile(path, []byte(outcomeLog(t, outcomes[50:]...)), 0644))
+
+	r, err := ReadFiles(path+".1", path)
+	assert.NoError(t, err)
+	assert.Equal(t, 103, r.Total.Requests)
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("{}\nnot json\n"), 0644))
+	_, err = ReadFiles(path)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), path+": line 2")
+}
+
+func TestWrite(t *testing.T) {
+	r, err := Read(strings.NewReader(outcomeLog(t, testOutcomes()...)))
+	assert.NoError(t, err)
+
+	text := &bytes.Buffer{}
+	assert.NoError(t, WriteText(text, r))
+	assert.Contains(t, text.String(), "GET /items/:id")
+	assert.Contains(t, text.String(), "33.3%")
+	assert.Contains(t, text.String(), "error")
+
+	out := &bytes.Buffer{}
+	assert.NoError(t, WriteJSON(out, r))
+	decoded := &Report{}
+	assert.NoError(t, json.Unmarshal(out.Bytes(), decoded))
+	assert.Equal(t, r, decoded)
+
+	html := &bytes.Buffer{}
+	assert.NoError(t, WriteHTML(html, r))
+	assert.Contains(t, html.String(), "<td>POST /items</td>")
+	assert.Contains(t, html.String(), `<td class="match">100</td>`)
+	assert.NotContains(t, html.String(), "<script")
+}
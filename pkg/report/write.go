@@ -0,0 +1,147 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// statusName is the name of a status in the matrix, 0 is a mirror failure
+func statusName(status int) string {
+	if status == 0 {
+		return "error"
+	}
+	return fmt.Sprint(status)
+}
+
+func percent(f float64) string {
+	return fmt.Sprintf("%.1f%%", f*100)
+}
+
+func milliseconds(f float64) string {
+	return fmt.Sprintf("%.1fms", f)
+}
+
+// matrix is the status agreement matrix as rows of primary statuses and
+// columns of mirror statuses
+type matrix struct {
+	Primary []int
+	Mirror  []int
+	counts  map[[2]int]int
+}
+
+func newMatrix(statuses []StatusPair) *matrix {
+	m := &matrix{counts: map[[2]int]int{}}
+	primary, mirror := map[int]bool{}, map[int]bool{}
+	for _, pair := range statuses {
+		m.counts[[2]int{pair.Primary, pair.Mirror}] = pair.Count
+		if !primary[pair.Primary] {
+			primary[pair.Primary] = true
+			m.Primary = append(m.Primary, pair.Primary)
+		}
+		if !mirror[pair.Mirror] {
+			mirror[pair.Mirror] = true
+			m.Mirror = append(m.Mirror, pair.Mirror)
+		}
+	}
+	sort.Ints(m.Mirror)
+	return m
+}
+
+// Count is the number of requests with a primary and mirror status
+func (m *matrix) Count(primary, mirror int) int {
+	return m.counts[[2]int{primary, mirror}]
+}
+
+// WriteText writes the report as tables of text
+func WriteText(w io.Writer, r *Report) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "ROUTE\tREQUESTS\tPRIMARY P50\tP95\tP99\tMIRROR P50\tP95\tP99\tSTATUS MATCH\tBODY MATCH\tPRIMARY ERRORS\tMIRROR ERRORS\tDROPPED")
+	for _, route := range append(append([]Route{}, r.Routes...), r.Total) {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\n",
+			route.Route, route.Requests,
+			milliseconds(route.Primary.P50), milliseconds(route.Primary.P95), milliseconds(route.Primary.P99),
+			milliseconds(route.Mirror.P50), milliseconds(route.Mirror.P95), milliseconds(route.Mirror.P99),
+			percent(route.StatusAgreement), percent(route.BodyAgreement),
+			percent(route.PrimaryErrorRate), percent(route.MirrorErrorRate), route.Dropped)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	m := newMatrix(r.Statuses)
+	columns := []string{"PRIMARY \\ MIRROR"}
+	for _, status := range m.Mirror {
+		columns = append(columns, statusName(status))
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(tw, strings.Join(columns, "\t"))
+	for _, primary := range m.Primary {
+		row := []string{statusName(primary)}
+		for _, mirror := range m.Mirror {
+			row = append(row, fmt.Sprint(m.Count(primary, mirror)))
+		}
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+// WriteJSON writes the report as indented json
+func WriteJSON(w io.Writer, r *Report) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+var htmlReport = template.Must(template.New("report").Funcs(template.FuncMap{
+	"percent":      percent,
+	"milliseconds": milliseconds,
+	"status":       statusName,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>gomirror report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: right; }
+th { background: #f0f0f0; }
+td:first-child, th:first-child { text-align: left; }
+.total td { font-weight: bold; }
+td.match { background: #e6f4e6; }
+</style>
+</head>
+<body>
+<h1>gomirror report</h1>
+<p>{{.Report.Total.Requests}} mirrored requests</p>
+<h2>Routes</h2>
+<table>
+<tr><th rowspan="2">Route</th><th rowspan="2">Requests</th><th colspan="3">Primary latency</th><th colspan="3">Mirror latency</th><th rowspan="2">Status match</th><th rowspan="2">Body match</th><th rowspan="2">Primary errors</th><th rowspan="2">Mirror errors</th><th rowspan="2">Dropped</th></tr>
+<tr><th>p50</th><th>p95</th><th>p99</th><th>p50</th><th>p95</th><th>p99</th></tr>
+{{range .Report.Routes}}{{template "route" .}}{{end}}
+{{with .Report.Total}}<tbody class="total">{{template "route" .}}</tbody>{{end}}
+</table>
+<h2>Statuses</h2>
+<table>
+<tr><th>Primary \ Mirror</th>{{range .Matrix.Mirror}}<th>{{status .}}</th>{{end}}</tr>
+{{$m := .Matrix}}{{range $primary := $m.Primary}}<tr><th>{{status $primary}}</th>{{range $mirror := $m.Mirror}}<td{{if eq $primary $mirror}} class="match"{{end}}>{{$m.Count $primary $mirror}}</td>{{end}}</tr>
+{{end}}</table>
+</body>
+</html>
+{{define "route"}}<tr><td>{{.Route}}</td><td>{{.Requests}}</td><td>{{milliseconds .Primary.P50}}</td><td>{{milliseconds .Primary.P95}}</td><td>{{milliseconds .Primary.P99}}</td><td>{{milliseconds .Mirror.P50}}</td><td>{{milliseconds .Mirror.P95}}</td><td>{{milliseconds .Mirror.P99}}</td><td>{{percent .StatusAgreement}}</td><td>{{percent .BodyAgreement}}</td><td>{{percent .PrimaryErrorRate}}</td><td>{{percent .MirrorErrorRate}}</td><td>{{.Dropped}}</td></tr>
+{{end}}`))
+
+// WriteHTML writes the report as a self-contained html page
+func WriteHTML(w io.Writer, r *Report) error {
+	return htmlReport.Execute(w, struct {
+		Report *Report
+		Matrix *matrix
+	}{r, newMatrix(r.Statuses)})
+}
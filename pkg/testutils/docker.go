@@ -16,7 +16,8 @@ var pool *dockertest.Pool
 var containers int
 
 // GetServerContainer returns an ephemeral test http server docker container,
-// that responds "hello world" from GET requests on any path
+// that responds "hello world" from GET requests on any path. It can be
+// discovered as testing-app.com by its VIRTUAL_HOST env var or its labels
 func GetServerContainer() *dockertest.Resource {
 	var err error
 	if pool == nil {
@@ -31,6 +32,10 @@ func GetServerContainer() *dockertest.Resource {
 		Repository: "thelonix/http-hello-world",
 		Tag:        "latest",
 		Env:        []string{"VIRTUAL_HOST=testing-app.com"},
+		Labels: map[string]string{
+			"gomirror.host": "testing-app.com",
+			"gomirror.port": "80",
+		},
 	})
 
 	containers++
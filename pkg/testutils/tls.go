@@ -0,0 +1,89 @@
+package testutils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"time"
+)
+
+// Certificate is a PEM encoded certificate and key written to disk
+type Certificate struct {
+	CertFile string
+	KeyFile  string
+	Cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+}
+
+var serial int64
+
+// WriteCertificate writes a certificate for commonName (valid for localhost
+// and 127.0.0.1) to dir. The certificate is signed by parent, or self signed
+// and usable as a CA when parent is nil
+func WriteCertificate(dir, commonName string, parent *Certificate) *Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+
+	serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost", commonName},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.Cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		panic(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		panic(err)
+	}
+
+	c := &Certificate{
+		CertFile: filepath.Join(dir, commonName+".crt"),
+		KeyFile:  filepath.Join(dir, commonName+".key"),
+		Cert:     cert,
+		key:      key,
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(c.CertFile, certPEM, 0644); err != nil {
+		panic(err)
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(c.KeyFile, keyPEM, 0600); err != nil {
+		panic(err)
+	}
+
+	return c
+}